@@ -0,0 +1,94 @@
+// Package config loads and validates the configs of ssmgr master and slave, the files
+// are parsed as YAML if they end with .yaml or .yml, and as JSON otherwise.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is a config of both master and slave, either can be omitted.
+type Config struct {
+	Master *Master `json:"master,omitempty" yaml:"master,omitempty"`
+	Slave  *Slave  `json:"slave,omitempty" yaml:"slave,omitempty"`
+}
+
+// Validate checks the config and returns an error naming the bad field.
+func (c *Config) Validate() error {
+	if c.Master == nil && c.Slave == nil {
+		return fmt.Errorf("master, slave: at least one is required")
+	}
+	if c.Master != nil {
+		if err := c.Master.Validate(); err != nil {
+			return fmt.Errorf("master.%s", err)
+		}
+	}
+	if c.Slave != nil {
+		if err := c.Slave.Validate(); err != nil {
+			return fmt.Errorf("slave.%s", err)
+		}
+	}
+	return nil
+}
+
+// LoadConfig loads the config with master and slave sections from path.
+func LoadConfig(path string) (*Config, error) {
+	c := &Config{}
+	if err := load(path, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadMaster loads the config of master from path.
+func LoadMaster(path string) (*Master, error) {
+	c := &Master{}
+	if err := load(path, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadSlave loads the config of slave from path, the fields not set are defaulted.
+func LoadSlave(path string) (*Slave, error) {
+	c := &Slave{}
+	if err := load(path, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type validator interface {
+	Validate() error
+}
+
+func load(path string, c validator) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	default:
+		err = json.Unmarshal(data, c)
+	}
+	if err != nil {
+		return fmt.Errorf("malformed config %s: %s", path, err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("invalid config %s: %s", path, err)
+	}
+	return nil
+}
+
+func validPort(p int) bool {
+	return p > 0 && p < 65536
+}
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+const validMaster = `{
+	"host": "127.0.0.1",
+	"port": 8080,
+	"interval": 60,
+	"slaves": [
+		{"id": "s1", "host": "10.0.0.1", "port": 6001, "token": "t1", "portMin": 10000, "portMax": 10100},
+		{"id": "s2", "host": "10.0.0.2", "port": 6001, "token": "t2", "portMin": 10000, "portMax": 10100}
+	],
+	"groups": [
+		{"id": "default", "slaves": ["s1", "s2"], "limit": {"flow": 1024, "time": 720}}
+	],
+	"database": {"dialect": "sqlite3", "args": "ssmgr.db"}
+}`
+
+const validMasterYAML = `
+host: 127.0.0.1
+port: 8080
+interval: 60
+slaves:
+- {id: s1, host: 10.0.0.1, port: 6001, token: t1, portMin: 10000, portMax: 10100}
+- {id: s2, host: 10.0.0.2, port: 6001, token: t2, portMin: 10000, portMax: 10100}
+groups:
+- id: default
+  slaves: [s1, s2]
+  limit: {flow: 1024, time: 720}
+database: {dialect: sqlite3, args: ssmgr.db}
+`
+
+const validSlave = `{
+	"port": 6001,
+	"manager_port": 6002,
+	"token": "t1",
+	"binary": "/usr/bin/ss-server",
+	"admin_address": "127.0.0.1:8002",
+	"port_min": 10000,
+	"port_max": 10100,
+	"tls": {"cert_file": "server.crt", "key_file": "server.key"}
+}`
+
+func writeConfig(t *testing.T, name, data string) string {
+	p := path.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(p, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadMaster(t *testing.T) {
+	for _, f := range []struct{ name, data string }{
+		{"config.json", validMaster},
+		{"config.yaml", validMasterYAML},
+		{"config.yml", validMasterYAML},
+	} {
+		c, err := LoadMaster(writeConfig(t, f.name, f.data))
+		if err != nil {
+			t.Fatalf("%s: %s", f.name, err)
+		}
+		if len(c.Slaves) != 2 || c.Slaves[1].Token != "t2" || c.Slaves[0].PortMax != 10100 {
+			t.Errorf("%s: got slaves %+v", f.name, c.Slaves)
+		}
+		if c.Database.Dialect != "sqlite3" || c.Groups[0].Limit.Flow != 1024 {
+			t.Errorf("%s: got config %+v", f.name, c)
+		}
+	}
+
+	if _, err := LoadMaster(writeConfig(t, "config.json", `{"port": 8080,`)); err == nil {
+		t.Error("malformed json is loaded")
+	}
+	if _, err := LoadMaster(writeConfig(t, "config.yaml", "port: [8080")); err == nil {
+		t.Error("malformed yaml is loaded")
+	}
+	if _, err := LoadMaster(path.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file is loaded")
+	}
+	_, err := LoadMaster(writeConfig(t, "config.json", `{"port": 8080, "interval": 60}`))
+	if err == nil || !strings.Contains(err.Error(), "database.dialect:") {
+		t.Errorf("got error %v, want it naming database.dialect", err)
+	}
+}
+
+func TestLoadSlave(t *testing.T) {
+	c, err := LoadSlave(writeConfig(t, "config.json", validSlave))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 6001 || c.MgrPort != 6002 || c.Binary != "/usr/bin/ss-server" || c.TLS.KeyFile != "server.key" {
+		t.Errorf("got config %+v", c)
+	}
+
+	for _, f := range []struct{ name, data string }{
+		{"config.json", `{"token": "t1"}`},
+		{"config.yaml", "token: t1"},
+	} {
+		c, err := LoadSlave(writeConfig(t, f.name, f.data))
+		if err != nil {
+			t.Fatalf("%s: %s", f.name, err)
+		}
+		if c.Port != 8001 || c.MgrPort != 6001 || c.MgrAddr != "127.0.0.1" || c.Timeout != 60 || c.Binary != "ss-server" {
+			t.Errorf("%s: defaults are not set, got %+v", f.name, c)
+		}
+	}
+
+	_, err = LoadSlave(writeConfig(t, "config.yaml", "token: t1\nport: 6001\nmanager_port: 6001\n"))
+	if err == nil || !strings.Contains(err.Error(), "manager_port:") {
+		t.Errorf("got error %v, want it naming manager_port", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	data := `
+master:
+  port: 8080
+  interval: 60
+  slaves:
+  - {id: s1, host: 10.0.0.1, port: 6001, token: t1}
+  database: {dialect: mysql, args: "root@/ssmgr"}
+slave:
+  token: t1
+  port: 6001
+  manager_port: 6002
+`
+	c, err := LoadConfig(writeConfig(t, "config.yaml", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Master.Slaves[0].Token != "t1" || c.Master.Database.Dialect != "mysql" {
+		t.Errorf("got master %+v", c.Master)
+	}
+	if c.Slave.MgrPort != 6002 || c.Slave.MgrAddr != "127.0.0.1" {
+		t.Errorf("got slave %+v", c.Slave)
+	}
+
+	tests := []struct {
+		name  string
+		data  string
+		field string
+	}{
+		{"empty", `{}`, "master, slave:"},
+		{"bad master", `{"master": {"port": 0}}`, "master.port:"},
+		{"bad slave", `{"slave": {"token": ""}}`, "slave.token:"},
+	}
+	for _, tt := range tests {
+		_, err := LoadConfig(writeConfig(t, "config.json", tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.field) {
+			t.Errorf("%s: got error %v, want it naming %s", tt.name, err, tt.field)
+		}
+	}
+}
+
+func TestValidateMaster(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		edit  func(c *Master)
+	}{
+		{"bad port", "port:", func(c *Master) { c.Port = 70000 }},
+		{"zero interval", "interval:", func(c *Master) { c.Interval = 0 }},
+		{"negative allocate timeout", "allocateTimeout:", func(c *Master) { c.AllocateTimeout = -1 }},
+		{"unknown dialect", "database.dialect:", func(c *Master) { c.Database.Dialect = "postgres" }},
+		{"empty dsn", "database.args:", func(c *Master) { c.Database.Args = "" }},
+		{"null slave", "slaves[1]:", func(c *Master) { c.Slaves[1] = nil }},
+		{"empty slave id", "slaves[0].id:", func(c *Master) { c.Slaves[0].ID = "" }},
+		{"duplicate slave id", "slaves[1].id:", func(c *Master) { c.Slaves[1].ID = "s1" }},
+		{"empty slave host", "slaves[1].host:", func(c *Master) { c.Slaves[1].Host = "" }},
+		{"bad slave port", "slaves[0].port:", func(c *Master) { c.Slaves[0].Port = 0 }},
+		{"empty token", "slaves[1].token:", func(c *Master) { c.Slaves[1].Token = "" }},
+		{"inverted port range", "slaves[0].portMin:", func(c *Master) { c.Slaves[0].PortMin = 20000 }},
+		{"duplicate address", "slaves[1].port:", func(c *Master) { c.Slaves[1].Host = "10.0.0.1" }},
+		{"unknown slave of group", "groups[0].slaves:", func(c *Master) { c.Groups[0].SlaveIDs = []string{"s3"} }},
+	}
+	for _, tt := range tests {
+		c, err := LoadMaster(writeConfig(t, "config.json", validMaster))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.edit(c)
+		err = c.Validate()
+		if err == nil {
+			t.Errorf("%s: config is valid", tt.name)
+		} else if !strings.HasPrefix(err.Error(), tt.field) {
+			t.Errorf("%s: got error %q, want it naming %s", tt.name, err, tt.field)
+		}
+	}
+}
+
+func TestValidateSlave(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		edit  func(c *Slave)
+	}{
+		{"empty token", "token:", func(c *Slave) { c.Token = "" }},
+		{"bad port", "port:", func(c *Slave) { c.Port = 0 }},
+		{"bad manager port", "manager_port:", func(c *Slave) { c.MgrPort = 65536 }},
+		{"same ports", "manager_port:", func(c *Slave) { c.MgrPort = c.Port }},
+		{"empty manager address", "manager_address:", func(c *Slave) { c.MgrAddr = "" }},
+		{"empty binary", "binary:", func(c *Slave) { c.Binary = "" }},
+		{"negative timeout", "timeout:", func(c *Slave) { c.Timeout = -1 }},
+		{"negative ports per user", "max_ports_per_user:", func(c *Slave) { c.UserPorts = -1 }},
+		{"negative stale after", "stale_after:", func(c *Slave) { c.StaleAfter = -1 }},
+		{"empty tenant token", "namespaces:", func(c *Slave) { c.Tenants = map[string]string{"": "ns"} }},
+		{"bad port min", "port_min:", func(c *Slave) { c.PortMin = 0 }},
+		{"bad port max", "port_max:", func(c *Slave) { c.PortMax = 70000 }},
+		{"inverted port range", "port_min:", func(c *Slave) { c.PortMin = 20000 }},
+		{"range with port", "port_min:", func(c *Slave) { c.PortMin = 6000 }},
+		{"range with manager port", "port_min:", func(c *Slave) { c.PortMin, c.PortMax = 6002, 6002 }},
+		{"bad admin address", "admin_address:", func(c *Slave) { c.AdminAddr = "8002" }},
+		{"admin on rpc port", "admin_address:", func(c *Slave) { c.AdminAddr = ":6001" }},
+		{"metrics on admin port", "metrics_address:", func(c *Slave) { c.MetricsAddr = "0.0.0.0:8002" }},
+		{"empty cert file", "tls.cert_file:", func(c *Slave) { c.TLS.CertFile = "" }},
+		{"empty key file", "tls.key_file:", func(c *Slave) { c.TLS.KeyFile = "" }},
+	}
+	for _, tt := range tests {
+		c, err := LoadSlave(writeConfig(t, "config.json", validSlave))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.edit(c)
+		err = c.Validate()
+		if err == nil {
+			t.Errorf("%s: config is valid", tt.name)
+		} else if !strings.HasPrefix(err.Error(), tt.field) {
+			t.Errorf("%s: got error %q, want it naming %s", tt.name, err, tt.field)
+		}
+	}
+}
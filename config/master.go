@@ -0,0 +1,144 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Dialects are the database dialects supported.
+var Dialects = []string{"mysql", "sqlite3"}
+
+// SlaveEntry is a slave managed by master.
+type SlaveEntry struct {
+	ID      string `json:"id" yaml:"id"`
+	Name    string `json:"name" yaml:"name"`
+	Host    string `json:"host" yaml:"host"`
+	Port    int    `json:"port" yaml:"port"`
+	Token   string `json:"token" yaml:"token"`
+	PortMax int    `json:"portMax" yaml:"portMax"`
+	PortMin int    `json:"portMin" yaml:"portMin"`
+}
+
+// Group is a group of slaves sharing the limit of users.
+type Group struct {
+	ID       string   `json:"id" yaml:"id"`
+	Name     string   `json:"name" yaml:"name"`
+	SlaveIDs []string `json:"slaves" yaml:"slaves"`
+	Limit    struct {
+		Flow int64 `json:"flow" yaml:"flow"` // MB
+		Time int64 `json:"time" yaml:"time"` // hours
+	} `json:"limit" yaml:"limit"`
+}
+
+// Master is the config of master.
+type Master struct {
+	Host     string        `json:"host" yaml:"host"`
+	Port     int           `json:"port" yaml:"port"`
+	Password string        `json:"password" yaml:"password"`
+	Interval int           `json:"interval" yaml:"interval"`
+	Slaves   []*SlaveEntry `json:"slaves" yaml:"slaves"`
+	Groups   []*Group      `json:"groups" yaml:"groups"`
+	Email    struct {
+		Host      string `json:"host" yaml:"host"`
+		Port      int    `json:"port" yaml:"port"`
+		Username  string `json:"username" yaml:"username"`
+		Password  string `json:"password" yaml:"password"`
+		FromAddr  string `json:"fromAddr" yaml:"fromAddr"`
+		FromAlias string `json:"fromAlias" yaml:"fromAlias"`
+	} `json:"email" yaml:"email"`
+	Database struct {
+		Dialect   string `json:"dialect" yaml:"dialect"`
+		Args      string `json:"args" yaml:"args"`
+		EnableLog bool   `json:"enable_log,omitempty" yaml:"enable_log,omitempty"`
+	} `json:"database" yaml:"database"`
+	Slack *struct {
+		Token   string   `json:"token" yaml:"token"`
+		Channel string   `json:"channel" yaml:"channel"`
+		Levels  []string `json:"levels" yaml:"levels"`
+	} `json:"slack,omitempty" yaml:"slack,omitempty"`
+	// Seconds to wait for established connections before freeing a port
+	DrainTimeout int64 `json:"drainTimeout,omitempty" yaml:"drainTimeout,omitempty"`
+	// Only report the drift between db and slaves without fixing it
+	ReconcileDryRun bool `json:"reconcileDryRun,omitempty" yaml:"reconcileDryRun,omitempty"`
+	// Level of the logs of rpc calls to slaves, e.g. "info", "debug" by default
+	RPCLogLevel string `json:"rpcLogLevel,omitempty" yaml:"rpcLogLevel,omitempty"`
+	// Max number of slaves polled at the same time, all at once by default
+	PollConcurrency int `json:"pollConcurrency,omitempty" yaml:"pollConcurrency,omitempty"`
+	// Spread the polls of slaves over the interval, enabled by default
+	PollStagger *bool `json:"pollStagger,omitempty" yaml:"pollStagger,omitempty"`
+	// Address serving the prometheus metrics, metrics are disabled when empty
+	MetricsAddress string `json:"metricsAddress,omitempty" yaml:"metricsAddress,omitempty"`
+	// Max number of redials when a slave is unavailable, 3 by default and -1 to disable
+	RedialRetries int `json:"redialRetries,omitempty" yaml:"redialRetries,omitempty"`
+	// Milliseconds to wait before the first redial, doubled on each retry, 500 by default
+	RedialDelay int64 `json:"redialDelay,omitempty" yaml:"redialDelay,omitempty"`
+	// Seconds to wait for slaves to be connected on start, 10 by default
+	DialTimeout int `json:"dialTimeout,omitempty" yaml:"dialTimeout,omitempty"`
+	// Milliseconds to wait for an allocation call to slaves before retrying, 10000 by default
+	AllocateTimeout int64 `json:"allocateTimeout,omitempty" yaml:"allocateTimeout,omitempty"`
+}
+
+// Validate checks the config and returns an error naming the bad field.
+func (c *Master) Validate() error {
+	if !validPort(c.Port) {
+		return fmt.Errorf("port: %d is not a valid port", c.Port)
+	}
+	if c.Interval <= 0 {
+		return errors.New("interval: must be positive")
+	}
+	if c.AllocateTimeout < 0 {
+		return fmt.Errorf("allocateTimeout: %d is negative", c.AllocateTimeout)
+	}
+
+	supported := false
+	for _, d := range Dialects {
+		if c.Database.Dialect == d {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("database.dialect: %q is not one of %v", c.Database.Dialect, Dialects)
+	}
+	if len(c.Database.Args) == 0 {
+		return errors.New("database.args: must not be empty")
+	}
+
+	ids := make(map[string]bool)
+	targets := make(map[string]bool)
+	for i, s := range c.Slaves {
+		switch {
+		case s == nil:
+			return fmt.Errorf("slaves[%d]: must not be null", i)
+		case len(s.ID) == 0:
+			return fmt.Errorf("slaves[%d].id: must not be empty", i)
+		case ids[s.ID]:
+			return fmt.Errorf("slaves[%d].id: duplicate id %s", i, s.ID)
+		case len(s.Host) == 0:
+			return fmt.Errorf("slaves[%d].host: must not be empty", i)
+		case !validPort(s.Port):
+			return fmt.Errorf("slaves[%d].port: %d is not a valid port", i, s.Port)
+		case len(s.Token) == 0:
+			return fmt.Errorf("slaves[%d].token: must not be empty", i)
+		case s.PortMin > s.PortMax:
+			return fmt.Errorf("slaves[%d].portMin: %d is greater than portMax %d", i, s.PortMin, s.PortMax)
+		}
+		target := fmt.Sprintf("%s:%d", s.Host, s.Port)
+		if targets[target] {
+			return fmt.Errorf("slaves[%d].port: duplicate address %s", i, target)
+		}
+		ids[s.ID] = true
+		targets[target] = true
+	}
+
+	for i, g := range c.Groups {
+		if g == nil {
+			return fmt.Errorf("groups[%d]: must not be null", i)
+		}
+		for _, id := range g.SlaveIDs {
+			if !ids[id] {
+				return fmt.Errorf("groups[%d].slaves: unknown slave %s", i, id)
+			}
+		}
+	}
+	return nil
+}
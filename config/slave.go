@@ -0,0 +1,150 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Slave is the config of slave.
+type Slave struct {
+	Port      int    `json:"port,omitempty" yaml:"port,omitempty"`
+	MgrPort   int    `json:"manager_port,omitempty" yaml:"manager_port,omitempty"`
+	MgrAddr   string `json:"manager_address,omitempty" yaml:"manager_address,omitempty"`
+	Token     string `json:"token" yaml:"token"`
+	AdminAddr string `json:"admin_address,omitempty" yaml:"admin_address,omitempty"`
+	Timeout   int    `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	DNS       string `json:"nameserver,omitempty" yaml:"nameserver,omitempty"`
+	Binary    string `json:"binary,omitempty" yaml:"binary,omitempty"`
+	RPCLog    string `json:"rpc_log_level,omitempty" yaml:"rpc_log_level,omitempty"`
+	UserPorts int    `json:"max_ports_per_user,omitempty" yaml:"max_ports_per_user,omitempty"`
+	// Tokens of the masters sharing the slave, mapped to their namespaces
+	Tenants map[string]string `json:"namespaces,omitempty" yaml:"namespaces,omitempty"`
+	// Address serving the prometheus metrics, metrics are disabled when empty
+	MetricsAddr string `json:"metrics_address,omitempty" yaml:"metrics_address,omitempty"`
+	// Dir storing the files of servers, $HOME/.ssmgr by default
+	DataPath string `json:"data_path,omitempty" yaml:"data_path,omitempty"`
+	// Token required to get the passwords from the admin http api, never served if empty
+	AdminToken string `json:"admin_token,omitempty" yaml:"admin_token,omitempty"`
+	// Range of the ports chosen for the allocations without port, [10000, 20000] by default
+	PortMin int32 `json:"port_min,omitempty" yaml:"port_min,omitempty"`
+	PortMax int32 `json:"port_max,omitempty" yaml:"port_max,omitempty"`
+	// Count the established connections of servers, it scans the connection tables
+	CountConnections bool `json:"count_connections,omitempty" yaml:"count_connections,omitempty"`
+	// Seconds without stats after which an alive server is stale, 0 disables the check
+	StaleAfter   int  `json:"stale_after,omitempty" yaml:"stale_after,omitempty"`
+	RestartStale bool `json:"restart_stale,omitempty" yaml:"restart_stale,omitempty"`
+	TLS          *struct {
+		CertFile string `json:"cert_file" yaml:"cert_file"`
+		KeyFile  string `json:"key_file" yaml:"key_file"`
+		// CA of the client certificates, masters must present one signed by it when set
+		ClientCAFile string `json:"client_ca_file,omitempty" yaml:"client_ca_file,omitempty"`
+	} `json:"tls,omitempty" yaml:"tls,omitempty"`
+}
+
+// plainSlave has the fields of Slave without its unmarshal methods.
+type plainSlave Slave
+
+func defaultSlave() plainSlave {
+	return plainSlave{Port: 8001, MgrPort: 6001, MgrAddr: "127.0.0.1", Timeout: 60, Binary: "ss-server"}
+}
+
+// UnmarshalJSON sets the defaults of the fields missing in data.
+func (c *Slave) UnmarshalJSON(data []byte) error {
+	p := defaultSlave()
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*c = Slave(p)
+	return nil
+}
+
+// UnmarshalYAML sets the defaults of the fields missing in the yaml.
+func (c *Slave) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := defaultSlave()
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	*c = Slave(p)
+	return nil
+}
+
+// Validate checks the config and returns an error naming the bad field.
+func (c *Slave) Validate() error {
+	switch {
+	case len(c.Token) == 0:
+		return errors.New("token: must not be empty")
+	case !validPort(c.Port):
+		return fmt.Errorf("port: %d is not a valid port", c.Port)
+	case !validPort(c.MgrPort):
+		return fmt.Errorf("manager_port: %d is not a valid port", c.MgrPort)
+	case c.MgrPort == c.Port:
+		return fmt.Errorf("manager_port: %d is already used by port", c.MgrPort)
+	case len(c.MgrAddr) == 0:
+		return errors.New("manager_address: must not be empty")
+	case len(c.Binary) == 0:
+		return errors.New("binary: must not be empty")
+	case c.Timeout < 0:
+		return fmt.Errorf("timeout: %d is negative", c.Timeout)
+	case c.UserPorts < 0:
+		return fmt.Errorf("max_ports_per_user: %d is negative", c.UserPorts)
+	case c.StaleAfter < 0:
+		return fmt.Errorf("stale_after: %d is negative", c.StaleAfter)
+	}
+
+	for token := range c.Tenants {
+		if len(token) == 0 {
+			return errors.New("namespaces: token must not be empty")
+		}
+	}
+
+	if c.PortMin != 0 || c.PortMax != 0 {
+		switch min, max := int(c.PortMin), int(c.PortMax); {
+		case !validPort(min):
+			return fmt.Errorf("port_min: %d is not a valid port", min)
+		case !validPort(max):
+			return fmt.Errorf("port_max: %d is not a valid port", max)
+		case min > max:
+			return fmt.Errorf("port_min: %d is greater than port_max %d", min, max)
+		case min <= c.Port && c.Port <= max:
+			return fmt.Errorf("port_min: range [%d, %d] contains port %d", min, max, c.Port)
+		case min <= c.MgrPort && c.MgrPort <= max:
+			return fmt.Errorf("port_min: range [%d, %d] contains manager_port %d", min, max, c.MgrPort)
+		}
+	}
+
+	// admin and metrics are served over tcp as the rpc
+	ports := map[int]string{c.Port: "port"}
+	for _, addr := range []struct{ field, addr string }{
+		{"admin_address", c.AdminAddr},
+		{"metrics_address", c.MetricsAddr},
+	} {
+		if len(addr.addr) == 0 {
+			continue
+		}
+		_, p, err := net.SplitHostPort(addr.addr)
+		if err != nil {
+			return fmt.Errorf("%s: %s", addr.field, err)
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil || !validPort(port) {
+			return fmt.Errorf("%s: %s is not a valid port", addr.field, p)
+		}
+		if field, ok := ports[port]; ok {
+			return fmt.Errorf("%s: %d is already used by %s", addr.field, port, field)
+		}
+		ports[port] = addr.field
+	}
+
+	if c.TLS != nil {
+		if len(c.TLS.CertFile) == 0 {
+			return errors.New("tls.cert_file: must not be empty")
+		}
+		if len(c.TLS.KeyFile) == 0 {
+			return errors.New("tls.key_file: must not be empty")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Package backoff implements exponential backoff with jitter, it's shared by the retry,
+// reconnect and monitor loops of master and slave.
+package backoff
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DefaultFactor is the multiplier used when Factor is not set.
+const DefaultFactor = 2
+
+// Backoff computes exponentially growing delays. It's not safe for concurrent use.
+type Backoff struct {
+	// Initial is the delay returned by the first call of Next.
+	Initial time.Duration
+	// Max caps the delay, zero means no cap.
+	Max time.Duration
+	// Factor is the multiplier applied on each attempt.
+	Factor float64
+	// Jitter randomizes each delay within [1-Jitter, 1+Jitter] times of it, it should
+	// be in [0, 1].
+	Jitter float64
+
+	attempts int
+}
+
+// Next returns the delay to wait before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	factor := b.Factor
+	if factor <= 0 {
+		factor = DefaultFactor
+	}
+
+	d := float64(b.Initial) * math.Pow(factor, float64(b.attempts))
+	if b.Max > 0 && d >= float64(b.Max) {
+		d = float64(b.Max)
+	} else {
+		b.attempts++
+	}
+
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	if d > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// Reset restarts the delays from Initial.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
@@ -0,0 +1,51 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextGrows(t *testing.T) {
+	b := &Backoff{Initial: 10 * time.Millisecond}
+	for i, want := range []time.Duration{10, 20, 40, 80} {
+		if d := b.Next(); d != want*time.Millisecond {
+			t.Errorf("attempt %d: got %s, want %s", i, d, want*time.Millisecond)
+		}
+	}
+
+	b = &Backoff{Initial: time.Second, Factor: 3}
+	for i, want := range []time.Duration{1, 3, 9} {
+		if d := b.Next(); d != want*time.Second {
+			t.Errorf("factor 3, attempt %d: got %s, want %s", i, d, want*time.Second)
+		}
+	}
+}
+
+func TestNextCapped(t *testing.T) {
+	b := &Backoff{Initial: time.Second, Max: 5 * time.Second}
+	for i, want := range []time.Duration{1, 2, 4, 5, 5, 5} {
+		if d := b.Next(); d != want*time.Second {
+			t.Errorf("attempt %d: got %s, want %s", i, d, want*time.Second)
+		}
+	}
+}
+
+func TestNextJitter(t *testing.T) {
+	b := &Backoff{Initial: time.Second, Max: time.Second, Jitter: 0.5}
+	for i := 0; i < 1000; i++ {
+		d := b.Next()
+		if d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("delay %s out of [500ms, 1.5s]", d)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	b := &Backoff{Initial: time.Second}
+	b.Next()
+	b.Next()
+	b.Reset()
+	if d := b.Next(); d != time.Second {
+		t.Errorf("got %s after reset, want %s", d, time.Second)
+	}
+}
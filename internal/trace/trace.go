@@ -0,0 +1,57 @@
+// Package trace correlates the logs of master and slave by carrying a request id in the
+// metadata of grpc calls.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataKey is the key of request id in grpc metadata.
+const MetadataKey = "request-id"
+
+// NewID generates a random request id.
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithID returns a context carrying the request id, other metadata in ctx are kept.
+func WithID(ctx context.Context, id string) context.Context {
+	md, ok := metadata.FromContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	md[MetadataKey] = []string{id}
+	return metadata.NewContext(ctx, md)
+}
+
+// FromContext returns the request id in ctx, or an empty string if there's none.
+func FromContext(ctx context.Context) string {
+	md, ok := metadata.FromContext(ctx)
+	if !ok || len(md[MetadataKey]) == 0 {
+		return ""
+	}
+	return md[MetadataKey][0]
+}
+
+// Log logs the message at given level.
+func Log(entry *logrus.Entry, level logrus.Level, msg string) {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		entry.Error(msg)
+	case logrus.WarnLevel:
+		entry.Warn(msg)
+	case logrus.InfoLevel:
+		entry.Info(msg)
+	default:
+		entry.Debug(msg)
+	}
+}
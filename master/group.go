@@ -1,6 +1,10 @@
 package main
 
-import "github.com/Sirupsen/logrus"
+import (
+	"github.com/Sirupsen/logrus"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
 
 type Group struct {
 	Config *GroupConfig
@@ -16,12 +20,26 @@ func InitGroups() {
 		groups[config.ID] = &Group{
 			Config: config,
 		}
+
+		// keep the quota defaults in db for the users to refer
+		err := db.Save(&orm.Group{
+			Name:      config.ID,
+			QuotaFlow: config.Limit.Flow * 1024 * 1024,
+			Duration:  config.Limit.Time * 3600,
+		}).Error
+		if err != nil {
+			logrus.Errorf("Failed to save group %s: %s", config.ID, err.Error())
+		}
 	}
 
 	defaultGroup = groups["default"]
 	if defaultGroup == nil {
 		logrus.Fatal("Group 'default' is required")
 	}
+
+	if err := orm.MigrateGroups(db); err != nil {
+		logrus.Fatalf("Failed to migrate the groups of users: %s", err.Error())
+	}
 }
 
 // GetGroupIDs returns all groups' ids.
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/arkbriar/ssmgr/internal/trace"
+)
+
+// rpcLogLevel returns the level of rpc logs in config, calls are logged at debug level
+// by default.
+func rpcLogLevel() logrus.Level {
+	level, err := logrus.ParseLevel(config.RPCLogLevel)
+	if err != nil {
+		return logrus.DebugLevel
+	}
+	return level
+}
+
+// unaryTraceInterceptor returns an interceptor which tags each call with a request id,
+// the slave logs it too so logs of both sides can be joined, and logs the method,
+// duration and outcome of the call. The duration is recorded in metrics as well.
+func unaryTraceInterceptor(slaveName string, level logrus.Level) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		id := trace.NewID()
+		start := time.Now()
+		err := invoker(trace.WithID(ctx, id), method, req, reply, cc, opts...)
+		duration := time.Since(start)
+		observeRPC(slaveName, method, duration)
+
+		entry := logrus.WithFields(logrus.Fields{
+			"slave":      slaveName,
+			"method":     method,
+			"request_id": id,
+			"duration":   duration,
+			"code":       grpc.Code(err),
+		})
+		if err != nil {
+			entry.Warnf("RPC failed: %s", err.Error())
+		} else {
+			trace.Log(entry, level, "RPC done")
+		}
+		return err
+	}
+}
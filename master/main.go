@@ -1,11 +1,9 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"time"
@@ -13,6 +11,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/jinzhu/gorm"
 
+	cfg "github.com/arkbriar/ssmgr/config"
 	"github.com/arkbriar/ssmgr/master/orm"
 
 	"github.com/arkbriar/ssmgr/master/slack"
@@ -24,52 +23,14 @@ var (
 	webroot    = flag.String("w", "./frontend", "Path of web UI files")
 )
 
-type SlaveConfig struct {
-	ID      string `json:"id"`
-	Name    string `json:"name"`
-	Host    string `json:"host"`
-	Port    int    `json:"port"`
-	Token   string `json:"token"`
-	PortMax int    `json:"portMax"`
-	PortMin int    `json:"portMin"`
-}
+// SlaveConfig is a slave in the config.
+type SlaveConfig = cfg.SlaveEntry
 
-type GroupConfig struct {
-	ID       string   `json:"id"`
-	Name     string   `json:"name"`
-	SlaveIDs []string `json:"slaves"`
-	Limit    struct {
-		Flow int64 `json:"flow"` // MB
-		Time int64 `json:"time"` // hours
-	} `json:"limit"`
-}
+// GroupConfig is a group of slaves in the config.
+type GroupConfig = cfg.Group
 
-type Config struct {
-	Host     string         `json:"host"`
-	Port     int            `json:"port"`
-	Password string         `json:"password"`
-	Interval int            `json:"interval"`
-	Slaves   []*SlaveConfig `json:"slaves"`
-	Groups   []*GroupConfig `json:"groups"`
-	Email    struct {
-		Host      string `json:"host"`
-		Port      int    `json:"port"`
-		Username  string `json:"username"`
-		Password  string `json:"password"`
-		FromAddr  string `json:"fromAddr"`
-		FromAlias string `json:"fromAddr"`
-	} `json:"email"`
-	Database struct {
-		Dialect   string `json:"dialect"`
-		Args      string `json:"args"`
-		EnableLog bool   `json:"enable_log,omitempty"`
-	} `json:"database"`
-	Slack *struct {
-		Token   string   `json:"token"`
-		Channel string   `json:"channel"`
-		Levels  []string `json:"levels"`
-	} `json:"slack,omitempty"`
-}
+// Config is the config of master.
+type Config = cfg.Master
 
 var db *gorm.DB
 
@@ -106,7 +67,7 @@ func main() {
 	}
 
 	var err error
-	config, err = parseConfig(*configPath)
+	config, err = cfg.LoadMaster(*configPath)
 	if err != nil {
 		logrus.Fatal(err)
 	}
@@ -140,6 +101,7 @@ func main() {
 		), "\r\n", 0)})
 	}
 
+	InitMetrics()
 	InitSlaves()
 	InitGroups()
 
@@ -153,24 +115,3 @@ func main() {
 	listenAddr := fmt.Sprintf("%s:%d", config.Host, config.Port)
 	webServer.Listen(listenAddr)
 }
-
-func parseConfig(path string) (*Config, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	data, err := ioutil.ReadAll(file)
-	if err != nil {
-		return nil, err
-	}
-
-	var config Config
-	err = json.Unmarshal(data, &config)
-	if err != nil {
-		return nil, err
-	}
-
-	return &config, nil
-}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// rpcLatency records the latencies of rpc calls to slaves, it's nil unless metrics are
+// enabled by config.MetricsAddress.
+var rpcLatency *prometheus.HistogramVec
+
+// serverCPU and serverRSS are the resource usage of ss-servers reported by slaves, they're
+// nil unless metrics are enabled.
+var (
+	serverCPU *prometheus.GaugeVec
+	serverRSS *prometheus.GaugeVec
+)
+
+// InitMetrics registers the metrics and serves them on config.MetricsAddress in
+// background, nothing is recorded when the address is not set.
+func InitMetrics() {
+	if len(config.MetricsAddress) == 0 {
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	rpcLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ssmgr",
+		Subsystem: "master",
+		Name:      "rpc_duration_seconds",
+		Help:      "Latencies of rpc calls to slaves.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"slave", "method"})
+	serverCPU = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ssmgr",
+		Subsystem: "server",
+		Name:      "cpu_percent",
+		Help:      "CPU usage of ss-servers in percent of one core.",
+	}, []string{"slave", "port"})
+	serverRSS = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ssmgr",
+		Subsystem: "server",
+		Name:      "resident_memory_bytes",
+		Help:      "Resident memory of ss-servers in bytes.",
+	}, []string{"slave", "port"})
+	registry.MustRegister(rpcLatency, serverCPU, serverRSS)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go func() {
+		logrus.Infof("Serving metrics on %s", config.MetricsAddress)
+		if err := http.ListenAndServe(config.MetricsAddress, mux); err != nil {
+			logrus.Errorf("Failed to serve metrics: %s", err.Error())
+		}
+	}()
+}
+
+// observeRPC records the latency of an rpc call.
+func observeRPC(slaveName, method string, d time.Duration) {
+	if rpcLatency == nil {
+		return
+	}
+	rpcLatency.WithLabelValues(slaveName, method).Observe(d.Seconds())
+}
+
+// observeUsage records the resource usage of the ss-server on port of a slave.
+func observeUsage(slaveName string, port int32, cpuPercent float64, rssBytes int64) {
+	if serverCPU == nil {
+		return
+	}
+	label := strconv.Itoa(int(port))
+	serverCPU.WithLabelValues(slaveName, label).Set(cpuPercent)
+	serverRSS.WithLabelValues(slaveName, label).Set(float64(rssBytes))
+}
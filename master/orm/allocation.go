@@ -0,0 +1,25 @@
+package orm
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// AllocationsByUser returns the allocations of the user on all servers ordered by port,
+// it's empty if the user has none.
+func AllocationsByUser(db *gorm.DB, userID string) ([]Allocation, error) {
+	allocs := make([]Allocation, 0)
+	if err := db.Where("user_id = ?", userID).Order("port").Find(&allocs).Error; err != nil {
+		return nil, err
+	}
+	return allocs, nil
+}
+
+// AllocationsByServer returns the allocations on the server ordered by port, it's empty
+// if the server has none.
+func AllocationsByServer(db *gorm.DB, serverID string) ([]Allocation, error) {
+	allocs := make([]Allocation, 0)
+	if err := db.Where("server_id = ?", serverID).Order("port").Find(&allocs).Error; err != nil {
+		return nil, err
+	}
+	return allocs, nil
+}
@@ -0,0 +1,48 @@
+package orm
+
+import (
+	"testing"
+)
+
+func TestAllocationsByUserAndServer(t *testing.T) {
+	db := newTestDB(t)
+
+	if !db.Dialect().HasIndex("allocation", "idx_allocation_port") {
+		t.Error("index of port is not created")
+	}
+
+	allocs := []Allocation{
+		{UserID: "a", ServerID: "s1", Port: 10002},
+		{UserID: "a", ServerID: "s2", Port: 10001},
+		{UserID: "b", ServerID: "s1", Port: 10000},
+	}
+	for i := range allocs {
+		if err := db.Create(&allocs[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byUser, err := AllocationsByUser(db, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byUser) != 2 || byUser[0].Port != 10001 || byUser[1].Port != 10002 {
+		t.Errorf("allocations of user a: got %+v", byUser)
+	}
+
+	byServer, err := AllocationsByServer(db, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byServer) != 2 || byServer[0].Port != 10000 || byServer[1].Port != 10002 {
+		t.Errorf("allocations on server s1: got %+v", byServer)
+	}
+
+	none, err := AllocationsByUser(db, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if none == nil || len(none) != 0 {
+		t.Errorf("allocations of unknown user: got %#v, want empty", none)
+	}
+}
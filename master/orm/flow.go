@@ -0,0 +1,55 @@
+package orm
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// PortFlow is the cumulative flow of a port since its ss-server started at StartTime.
+type PortFlow struct {
+	Port      int32
+	StartTime int64
+	Flow      int64
+}
+
+// RecordFlow saves the flows of ports on the server into the flow records of the users
+// owning the ports, and returns the ports skipped for not being allocated. A record is
+// kept for each start of the ss-server, so the flow of a restarted server is recorded in
+// a new record rather than mixed into the old one. The records are saved in a single
+// transaction.
+func RecordFlow(db *gorm.DB, serverID string, flows []PortFlow, allocs []Allocation) ([]int32, error) {
+	owners := make(map[int32]string, len(allocs))
+	for _, alloc := range allocs {
+		owners[int32(alloc.Port)] = alloc.UserID
+	}
+
+	tx := db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+
+	var skipped []int32
+	for _, f := range flows {
+		userID, ok := owners[f.Port]
+		if !ok {
+			skipped = append(skipped, f.Port)
+			continue
+		}
+
+		key := &FlowRecord{
+			UserID:    userID,
+			ServerID:  serverID,
+			StartTime: f.StartTime,
+		}
+		var record FlowRecord
+		if err := tx.Where(key).FirstOrCreate(&record).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		// tx.Save(&record) not works as expected due to gorm's bug
+		if err := tx.Model(&FlowRecord{}).Where(key).Update("flow", f.Flow).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return skipped, tx.Commit().Error
+}
@@ -0,0 +1,60 @@
+package orm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func userFlow(t *testing.T, db *gorm.DB, userID string) (int64, int) {
+	var records []FlowRecord
+	if err := db.Where("user_id = ?", userID).Find(&records).Error; err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, r := range records {
+		total += r.Flow
+	}
+	return total, len(records)
+}
+
+func TestRecordFlow(t *testing.T) {
+	db := newTestDB(t)
+	allocs := []Allocation{
+		{UserID: "a", ServerID: "s1", Port: 10000},
+		{UserID: "b", ServerID: "s1", Port: 10001},
+	}
+
+	skipped, err := RecordFlow(db, "s1", []PortFlow{
+		{Port: 10000, StartTime: 1000, Flow: 100},
+		{Port: 10001, StartTime: 1000, Flow: 10},
+		{Port: 10002, StartTime: 1000, Flow: 99},
+	}, allocs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int32{10002}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("got skipped %v, want %v", skipped, want)
+	}
+
+	// the cumulative flow of the same start overwrites the record
+	if _, err := RecordFlow(db, "s1", []PortFlow{{Port: 10000, StartTime: 1000, Flow: 150}}, allocs); err != nil {
+		t.Fatal(err)
+	}
+	if flow, n := userFlow(t, db, "a"); flow != 150 || n != 1 {
+		t.Errorf("got flow %d in %d records, want 150 in 1", flow, n)
+	}
+
+	// the counter is reset by a restart, and counted in a new record
+	if _, err := RecordFlow(db, "s1", []PortFlow{{Port: 10000, StartTime: 2000, Flow: 30}}, allocs); err != nil {
+		t.Fatal(err)
+	}
+	if flow, n := userFlow(t, db, "a"); flow != 180 || n != 2 {
+		t.Errorf("got flow %d in %d records after restart, want 180 in 2", flow, n)
+	}
+
+	if flow, _ := userFlow(t, db, "b"); flow != 10 {
+		t.Errorf("got flow %d of other user, want 10", flow)
+	}
+}
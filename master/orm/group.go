@@ -0,0 +1,75 @@
+package orm
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DefaultGroup is the group of users whose group doesn't exist.
+const DefaultGroup = "default"
+
+// Group holds the quota defaults of the users in it.
+type Group struct {
+	Name      string `gorm:"primary_key"`
+	QuotaFlow int64  `gorm:"not null"` // in bytes
+	Duration  int64  `gorm:"not null"` // seconds a user is valid since created
+}
+
+func (Group) TableName() string {
+	return "user_group"
+}
+
+// MigrateGroups moves the users of groups not in the group table to the default group,
+// and makes the group of users reference the group table. It must be called after the
+// groups are saved.
+func MigrateGroups(db *gorm.DB) error {
+	var users []User
+	err := db.Where("`group` NOT IN (?)", db.Model(&Group{}).Select("name").QueryExpr()).Find(&users).Error
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		log.Printf("group %q of user %s not found, fall back to %q", user.Group, user.ID, DefaultGroup)
+
+		if err := db.Model(&User{}).Where("id = ?", user.ID).Update("group", DefaultGroup).Error; err != nil {
+			return err
+		}
+		if err := ApplyGroupDefaults(db, user.ID); err != nil {
+			return err
+		}
+	}
+
+	// the inline reference is only created by sqlite, and tables created by sqlite can't
+	// be altered to add one
+	if db.Dialect().GetName() == "mysql" {
+		return db.Model(&User{}).AddForeignKey("group", "user_group(name)", "RESTRICT", "CASCADE").Error
+	}
+	return nil
+}
+
+// ApplyGroupDefaults copies the quota and expiry of the user's group onto the user, it
+// should be called once the group of user is changed. The user falls back to the default
+// group if the group doesn't exist.
+func ApplyGroupDefaults(db *gorm.DB, userID string) error {
+	var user User
+	if db.Where("id = ?", userID).First(&user).RecordNotFound() {
+		return fmt.Errorf("user %s not found", userID)
+	}
+
+	var group Group
+	if db.Where("name = ?", user.Group).First(&group).RecordNotFound() {
+		log.Printf("group %q of user %s not found, fall back to %q", user.Group, userID, DefaultGroup)
+
+		if db.Where("name = ?", DefaultGroup).First(&group).RecordNotFound() {
+			return fmt.Errorf("group %q not found", DefaultGroup)
+		}
+	}
+
+	return db.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"group":      group.Name,
+		"quota_flow": group.QuotaFlow,
+		"expired":    user.Time + group.Duration,
+	}).Error
+}
@@ -0,0 +1,103 @@
+package orm
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func createGroups(t *testing.T, db *gorm.DB, groups ...Group) {
+	for i := range groups {
+		if err := db.Create(&groups[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestApplyGroupDefaults(t *testing.T) {
+	db := newTestDB(t)
+	createGroups(t, db,
+		Group{Name: DefaultGroup, QuotaFlow: 100, Duration: 3600},
+		Group{Name: "vip", QuotaFlow: 1000, Duration: 7200},
+	)
+	user := User{ID: "a", Time: 1000, Group: DefaultGroup}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		group     string
+		quotaFlow int64
+		expired   int64
+	}{
+		{DefaultGroup, 100, 4600},
+		{"vip", 1000, 8200},
+		{DefaultGroup, 100, 4600},
+	} {
+		if err := db.Model(&User{}).Where("id = ?", "a").Update("group", tt.group).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := ApplyGroupDefaults(db, "a"); err != nil {
+			t.Fatal(err)
+		}
+		var got User
+		db.Where("id = ?", "a").First(&got)
+		if got.QuotaFlow != tt.quotaFlow || got.Expired != tt.expired {
+			t.Errorf("group %s: got quota %d and expired %d, want %d and %d",
+				tt.group, got.QuotaFlow, got.Expired, tt.quotaFlow, tt.expired)
+		}
+	}
+}
+
+func TestUserGroupReference(t *testing.T) {
+	db := newTestDB(t)
+	createGroups(t, db, Group{Name: DefaultGroup, QuotaFlow: 100, Duration: 3600})
+
+	if err := db.Create(&User{ID: "a", Group: "missing"}).Error; err == nil {
+		t.Error("user of a missing group is created")
+	}
+	if err := db.Create(&User{ID: "b", Group: DefaultGroup}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&User{}).Where("id = ?", "b").Update("group", "missing").Error; err == nil {
+		t.Error("user is moved to a missing group")
+	}
+	if err := db.Delete(&Group{Name: DefaultGroup}).Error; err == nil {
+		t.Error("group having users is deleted")
+	}
+}
+
+func TestMigrateGroups(t *testing.T) {
+	db := newTestDB(t)
+	createGroups(t, db,
+		Group{Name: DefaultGroup, QuotaFlow: 100, Duration: 3600},
+		Group{Name: "vip", QuotaFlow: 1000, Duration: 7200},
+	)
+
+	// users saved before the groups are referenced
+	db.Exec("PRAGMA foreign_keys = OFF")
+	users := []User{
+		{ID: "a", Time: 1000, Group: "vip", QuotaFlow: 1000, Expired: 8200},
+		{ID: "b", Time: 1000, Group: "removed", QuotaFlow: 5000, Expired: 9000},
+	}
+	for i := range users {
+		if err := db.Create(&users[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Exec("PRAGMA foreign_keys = ON")
+
+	if err := MigrateGroups(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []User{
+		{ID: "a", Group: "vip", QuotaFlow: 1000, Expired: 8200},
+		{ID: "b", Group: DefaultGroup, QuotaFlow: 100, Expired: 4600},
+	} {
+		var got User
+		db.Where("id = ?", want.ID).First(&got)
+		if got.Group != want.Group || got.QuotaFlow != want.QuotaFlow || got.Expired != want.Expired {
+			t.Errorf("got user %+v, want %+v", got, want)
+		}
+	}
+}
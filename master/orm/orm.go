@@ -2,6 +2,7 @@ package orm
 
 import (
 	"log"
+	"strings"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
@@ -9,13 +10,22 @@ import (
 )
 
 func New(dialect, arg string) *gorm.DB {
+	// sqlite enforces foreign keys only if they're enabled on every connection
+	if dialect == "sqlite3" {
+		if strings.Contains(arg, "?") {
+			arg += "&_foreign_keys=1"
+		} else {
+			arg += "?_foreign_keys=1"
+		}
+	}
+
 	db, err := gorm.Open(dialect, arg)
 	if err != nil {
 		log.Fatal("failed to connect database: ", err.Error())
 	}
 
 	// create tables, missing columns and missing indexes
-	db.AutoMigrate(&User{}, &Allocation{}, &FlowRecord{}, &VerifyCode{})
+	db.AutoMigrate(&Group{}, &User{}, &Allocation{}, &FlowRecord{}, &VerifyCode{}, &MonthlyUsage{})
 
 	return db
 }
@@ -23,7 +33,9 @@ func New(dialect, arg string) *gorm.DB {
 type User struct {
 	ID    string `gorm:"priamry_key,size:32"`
 	Email string `gorm:"not null"`
-	Group string `gorm:"not null,DEFAULT:'default'"`
+	// Group references the group table, the reference is added by `MigrateGroups` on
+	// mysql, which ignores the inline one.
+	Group string `gorm:"type:varchar(255) NOT NULL DEFAULT 'default' REFERENCES user_group(name) ON UPDATE CASCADE"`
 	Time  int64  `gorm:"not null,DEFAULT:current_timestamp"`
 
 	// These fields do not conform with 3NF but for performance just keep them here.
@@ -56,6 +68,8 @@ type VerifyCode struct {
 	Email string `gorm:"priamry_key"`
 	Code  string `gorm:"not null"`
 	Time  int64  `gorm:"not null,DEFAULT:current_timestamp"`
+	// Seconds the code is valid for since Time
+	TTL int64 `gorm:"not null;default:0"`
 }
 
 func (VerifyCode) TableName() string {
@@ -67,7 +81,7 @@ func (VerifyCode) TableName() string {
 type Allocation struct {
 	UserID   string `gorm:"priamry_key,size:32"`
 	ServerID string `gorm:"priamry_key"`
-	Port     int    `gorm:"not null,index"`
+	Port     int    `gorm:"not null;index"`
 	Password string `gorm:"not null"`
 }
 
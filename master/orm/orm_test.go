@@ -0,0 +1,16 @@
+package orm
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// newTestDB returns a migrated in-memory sqlite database.
+func newTestDB(t *testing.T) *gorm.DB {
+	db := New("sqlite3", ":memory:")
+	// every connection of memory database is a new one
+	db.DB().SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
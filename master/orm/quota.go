@@ -0,0 +1,58 @@
+package orm
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// EnforceQuotas disables the users who have used up their quota flow or are expired at
+// now (unix seconds), and returns the IDs of the newly disabled ones. A zero quota flow
+// or expired time means unlimited. It runs in a single
+// transaction and the disabled users are skipped, so it's safe to re-run.
+func EnforceQuotas(db *gorm.DB, now int64) ([]string, error) {
+	const SQL = `SELECT users.id, users.quota_flow, COALESCE(sum(flow_record.flow), 0), users.expired
+FROM users LEFT JOIN flow_record ON users.id = flow_record.user_id
+WHERE users.disabled = ?
+GROUP BY users.id, users.quota_flow, users.expired`
+
+	tx := db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Raw(SQL, false).Rows()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	disabled := make([]string, 0)
+	for rows.Next() {
+		var (
+			userID      string
+			quotaFlow   int64
+			currentFlow int64
+			expired     int64
+		)
+		if err := rows.Scan(&userID, &quotaFlow, &currentFlow, &expired); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		if (quotaFlow > 0 && currentFlow >= quotaFlow) || (expired > 0 && expired <= now) {
+			disabled = append(disabled, userID)
+		}
+	}
+	rows.Close()
+
+	if len(disabled) > 0 {
+		err := tx.Model(&User{}).Where("id IN (?)", disabled).Update("disabled", true).Error
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return disabled, nil
+}
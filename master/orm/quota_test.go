@@ -0,0 +1,77 @@
+package orm
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestEnforceQuotas(t *testing.T) {
+	db := newTestDB(t)
+
+	const now = 1500000000
+	users := []User{
+		{ID: "unlimited", QuotaFlow: 0, Expired: 0},
+		{ID: "flow-unlimited", QuotaFlow: 0, Expired: now + 100},
+		{ID: "never-expired", QuotaFlow: 1000, Expired: 0},
+		{ID: "under-quota", QuotaFlow: 1000, Expired: now + 100},
+		{ID: "used-up", QuotaFlow: 100, Expired: now + 100},
+		{ID: "expired", QuotaFlow: 1000, Expired: now - 100},
+		{ID: "expired-now", QuotaFlow: 1000, Expired: now},
+		{ID: "disabled", QuotaFlow: 100, Expired: now - 100, Disabled: true},
+	}
+	createGroups(t, db, Group{Name: DefaultGroup})
+	for i := range users {
+		users[i].Group = DefaultGroup
+		if err := db.Create(&users[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	records := []FlowRecord{
+		{UserID: "unlimited", ServerID: "s1", StartTime: 1, Flow: 5000},
+		{UserID: "flow-unlimited", ServerID: "s1", StartTime: 1, Flow: 5000},
+		{UserID: "never-expired", ServerID: "s1", StartTime: 1, Flow: 10},
+		{UserID: "under-quota", ServerID: "s1", StartTime: 1, Flow: 10},
+		{UserID: "used-up", ServerID: "s1", StartTime: 1, Flow: 60},
+		{UserID: "used-up", ServerID: "s2", StartTime: 1, Flow: 40},
+	}
+	for i := range records {
+		if err := db.Create(&records[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	disabled, err := EnforceQuotas(db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(disabled)
+	want := []string{"expired", "expired-now", "used-up"}
+	if !reflect.DeepEqual(disabled, want) {
+		t.Errorf("got disabled %v, want %v", disabled, want)
+	}
+
+	wantSet := make(map[string]bool)
+	for _, id := range want {
+		wantSet[id] = true
+	}
+	for _, u := range users {
+		var got User
+		if err := db.Where("id = ?", u.ID).First(&got).Error; err != nil {
+			t.Fatal(err)
+		}
+		wantDisabled := u.Disabled || wantSet[u.ID]
+		if got.Disabled != wantDisabled {
+			t.Errorf("user %s: got disabled %t, want %t", u.ID, got.Disabled, wantDisabled)
+		}
+	}
+
+	// re-running disables no more
+	disabled, err = EnforceQuotas(db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disabled) != 0 {
+		t.Errorf("got %v disabled on re-run, want none", disabled)
+	}
+}
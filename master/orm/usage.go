@@ -0,0 +1,111 @@
+package orm
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// MonthlyUsage is the summary of flow used by a user in a month, which is rolled up from
+// flow records.
+type MonthlyUsage struct {
+	UserID string `gorm:"not null;unique_index:idx_user_month"`
+	Month  string `gorm:"not null;unique_index:idx_user_month"` // formatted as 2006-01
+	Flow   int64  `gorm:"not null"`
+}
+
+func (MonthlyUsage) TableName() string {
+	return "monthly_usage"
+}
+
+// monthKey formats the month of t in UTC.
+func monthKey(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// monthRange returns the start of the month of t and the next month in UnixNano.
+func monthRange(t time.Time) (int64, int64) {
+	t = t.UTC()
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start.UnixNano(), start.AddDate(0, 1, 0).UnixNano()
+}
+
+// RollupMonthly sums the flow records started in the month of given time for each user
+// and saves the summaries. It overwrites the previous summaries, so it's safe to re-run.
+func RollupMonthly(db *gorm.DB, month time.Time) error {
+	start, end := monthRange(month)
+	rows, err := db.Model(&FlowRecord{}).
+		Select("user_id, sum(flow)").
+		Where("start_time >= ? AND start_time < ?", start, end).
+		Group("user_id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	flows := make(map[string]int64)
+	for rows.Next() {
+		var (
+			userID string
+			flow   int64
+		)
+		if err := rows.Scan(&userID, &flow); err != nil {
+			return err
+		}
+		flows[userID] = flow
+	}
+	rows.Close()
+
+	key := monthKey(month)
+	tx := db.Begin()
+	for userID, flow := range flows {
+		var usage MonthlyUsage
+		err := tx.Where(&MonthlyUsage{UserID: userID, Month: key}).
+			Assign(MonthlyUsage{Flow: flow}).
+			FirstOrCreate(&usage).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// GetMonthlyUsage returns the flow used by the user in the month of given time, which is
+// 0 before the month is rolled up.
+func GetMonthlyUsage(db *gorm.DB, userID string, month time.Time) (int64, error) {
+	var usage MonthlyUsage
+	err := db.Where(&MonthlyUsage{UserID: userID, Month: monthKey(month)}).First(&usage).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, nil
+	}
+	return usage.Flow, err
+}
+
+// sumFlow sums the flow records of which column equals value and start time is in
+// [from, to). Rows duplicated due to the composite key bug hold the same cumulative
+// flow, so only one of them is counted.
+func sumFlow(db *gorm.DB, column, value string, from, to int64) (int64, error) {
+	SQL := `SELECT COALESCE(sum(flow), 0) FROM (
+SELECT max(flow) AS flow FROM flow_record
+WHERE ` + column + ` = ? AND start_time >= ? AND start_time < ?
+GROUP BY user_id, server_id, start_time) AS records`
+
+	var flow int64
+	if err := db.Raw(SQL, value, from, to).Row().Scan(&flow); err != nil {
+		return 0, err
+	}
+	return flow, nil
+}
+
+// FlowBetween returns the flow used by the user on all servers, which is recorded by
+// the records started in [from, to) in UnixNano.
+func FlowBetween(db *gorm.DB, userID string, from, to int64) (int64, error) {
+	return sumFlow(db, "user_id", userID, from, to)
+}
+
+// FlowByServer returns the flow used by all users on the server, which is recorded by
+// the records started in [from, to) in UnixNano.
+func FlowByServer(db *gorm.DB, serverID string, from, to int64) (int64, error) {
+	return sumFlow(db, "server_id", serverID, from, to)
+}
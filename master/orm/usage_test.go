@@ -0,0 +1,56 @@
+package orm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollupMonthly(t *testing.T) {
+	db := newTestDB(t)
+
+	month := time.Date(2017, 5, 10, 0, 0, 0, 0, time.UTC)
+	start, _ := monthRange(month)
+	records := []FlowRecord{
+		{UserID: "a", ServerID: "s1", StartTime: start, Flow: 100},
+		{UserID: "a", ServerID: "s2", StartTime: start + 1, Flow: 50},
+		{UserID: "b", ServerID: "s1", StartTime: start, Flow: 10},
+	}
+	for i := range records {
+		if err := db.Create(&records[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// re-running must overwrite rather than duplicate the summaries
+	for i := 0; i < 2; i++ {
+		if err := RollupMonthly(db, month); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	db.Model(&MonthlyUsage{}).Count(&count)
+	if count != 2 {
+		t.Errorf("got %d summaries, want 2", count)
+	}
+	for user, want := range map[string]int64{"a": 150, "b": 10} {
+		got, err := GetMonthlyUsage(db, user, month)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("usage of %s: got %d, want %d", user, got, want)
+		}
+	}
+}
+
+func TestMonthlyUsageUniqueIndex(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := db.Create(&MonthlyUsage{UserID: "a", Month: "2017-05", Flow: 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&MonthlyUsage{UserID: "a", Month: "2017-05", Flow: 2}).Error; err == nil {
+		t.Error("duplicated summary of user and month is inserted")
+	}
+}
@@ -0,0 +1,76 @@
+package orm
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// verifyCodeInterval is the min interval of issuing codes to an email.
+const verifyCodeInterval = time.Minute
+
+// ErrVerifyCodeTooFrequent is returned when a code is issued to the email within
+// verifyCodeInterval.
+var ErrVerifyCodeTooFrequent = errors.New("verify code is issued too frequently")
+
+// randomCode returns a random numeric code of 6 digits.
+func randomCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// IssueVerifyCode generates a code for the email at now valid for ttl, and saves it in
+// place of the previous one, so there's at most one active code per email.
+func IssueVerifyCode(db *gorm.DB, email string, ttl time.Duration, now int64) (string, error) {
+	tx := db.Begin()
+	if err := tx.Error; err != nil {
+		return "", err
+	}
+
+	var last VerifyCode
+	err := tx.Where("email = ?", email).Order("time desc").First(&last).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return "", err
+	}
+	if err == nil && last.Time > now-int64(verifyCodeInterval/time.Second) {
+		tx.Rollback()
+		return "", ErrVerifyCodeTooFrequent
+	}
+
+	code, err := randomCode()
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if err := tx.Where("email = ?", email).Delete(&VerifyCode{}).Error; err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	vc := &VerifyCode{Email: email, Code: code, Time: now, TTL: int64(ttl / time.Second)}
+	if err := tx.Create(vc).Error; err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// CheckVerifyCode returns if the code is the active one issued to the email and isn't
+// expired at now. The code is deleted once it's checked, so it can't be used again.
+func CheckVerifyCode(db *gorm.DB, email, code string, now int64) (bool, error) {
+	res := db.Where("email = ? AND code = ? AND time + ttl > ?", email, code, now).Delete(&VerifyCode{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
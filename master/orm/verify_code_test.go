@@ -0,0 +1,101 @@
+package orm
+
+import (
+	"testing"
+	"time"
+)
+
+// issueTime is the fixed time codes are issued at in tests.
+const issueTime int64 = 1500000000
+
+func TestIssueVerifyCode(t *testing.T) {
+	db := newTestDB(t)
+
+	first, err := IssueVerifyCode(db, "a@example.com", 10*time.Minute, issueTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 6 {
+		t.Errorf("got code %q, want 6 digits", first)
+	}
+
+	// a code is reissued at most once per minute, even if the ttl is longer
+	for _, at := range []int64{issueTime, issueTime + 59} {
+		if _, err := IssueVerifyCode(db, "a@example.com", 10*time.Minute, at); err != ErrVerifyCodeTooFrequent {
+			t.Errorf("got %v reissuing after %ds, want ErrVerifyCodeTooFrequent", err, at-issueTime)
+		}
+	}
+	// the limit is per email
+	if _, err := IssueVerifyCode(db, "b@example.com", 10*time.Minute, issueTime); err != nil {
+		t.Errorf("got %v issuing to another email", err)
+	}
+
+	second, err := IssueVerifyCode(db, "a@example.com", 10*time.Minute, issueTime+60)
+	if err != nil {
+		t.Fatalf("got %v reissuing after 60s", err)
+	}
+
+	// only the last code is active
+	if first != second {
+		if ok, err := CheckVerifyCode(db, "a@example.com", first, issueTime+60); err != nil || ok {
+			t.Errorf("previous code: got %t, %v, want it replaced", ok, err)
+		}
+	}
+	if ok, err := CheckVerifyCode(db, "a@example.com", second, issueTime+60); err != nil || !ok {
+		t.Errorf("last code: got %t, %v", ok, err)
+	}
+}
+
+func TestIssueVerifyCodeShortTTL(t *testing.T) {
+	db := newTestDB(t)
+	// a ttl shorter than a minute doesn't lift the limit
+	if _, err := IssueVerifyCode(db, "a@example.com", 10*time.Second, issueTime); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IssueVerifyCode(db, "a@example.com", 10*time.Second, issueTime+30); err != ErrVerifyCodeTooFrequent {
+		t.Errorf("got %v reissuing an expired code within a minute, want ErrVerifyCodeTooFrequent", err)
+	}
+}
+
+func TestCheckVerifyCode(t *testing.T) {
+	db := newTestDB(t)
+	code, err := IssueVerifyCode(db, "a@example.com", 5*time.Minute, issueTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "000001"
+	}
+	if ok, err := CheckVerifyCode(db, "a@example.com", wrong, issueTime); err != nil || ok {
+		t.Errorf("wrong code: got %t, %v", ok, err)
+	}
+	if ok, err := CheckVerifyCode(db, "b@example.com", code, issueTime); err != nil || ok {
+		t.Errorf("code of other email: got %t, %v", ok, err)
+	}
+
+	if ok, err := CheckVerifyCode(db, "a@example.com", code, issueTime); err != nil || !ok {
+		t.Errorf("correct code: got %t, %v", ok, err)
+	}
+	// the code is used up
+	if ok, err := CheckVerifyCode(db, "a@example.com", code, issueTime); err != nil || ok {
+		t.Errorf("used code: got %t, %v", ok, err)
+	}
+}
+
+func TestCheckVerifyCodeExpired(t *testing.T) {
+	db := newTestDB(t)
+	code, err := IssueVerifyCode(db, "a@example.com", 5*time.Minute, issueTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the code expires exactly ttl after it's issued
+	if ok, err := CheckVerifyCode(db, "a@example.com", code, issueTime+300); err != nil || ok {
+		t.Errorf("expired code: got %t, %v", ok, err)
+	}
+	if ok, err := CheckVerifyCode(db, "a@example.com", code, issueTime+299); err != nil || !ok {
+		t.Errorf("code before expired: got %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"golang.org/x/net/context"
+)
+
+const (
+	// pingWorkers is the max number of slaves pinged at the same time by `SlavePool.PingAll`.
+	pingWorkers = 8
+	// pingTimeout is the timeout of pinging a slave without a deadline or in PingAll.
+	pingTimeout = 5 * time.Second
+)
+
+// Ping calls the slave and returns the round-trip latency. The call is given at most
+// pingTimeout if ctx has no deadline, so a dead slave never hangs it.
+func (s *Slave) Ping(ctx context.Context) (time.Duration, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pingTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	if _, err := s.client().Ping(s.withToken(ctx), &empty.Empty{}); err != nil {
+		return 0, s.wrapError(err)
+	}
+	return time.Since(start), nil
+}
+
+// PingResult is the result of pinging a slave.
+type PingResult struct {
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// PingAll pings all slaves of the pool concurrently, updates their alive status and
+// returns the results by slave id. Each slave is given at most pingTimeout, so dead
+// slaves never hang the call.
+func (p *SlavePool) PingAll(ctx context.Context) map[string]PingResult {
+	var (
+		mu      sync.Mutex
+		results = make(map[string]PingResult)
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, pingWorkers)
+	)
+	for id, slave := range p.Slaves() {
+		wg.Add(1)
+		go func(id string, slave *Slave) {
+			defer wg.Done()
+
+			var result PingResult
+			select {
+			case sem <- struct{}{}:
+				pctx, cancel := context.WithTimeout(ctx, pingTimeout)
+				latency, err := slave.Ping(pctx)
+				cancel()
+				<-sem
+
+				result.Latency = latency
+				if err != nil {
+					result.Error = err.Error()
+				}
+				p.setAlive(id, err == nil)
+			case <-ctx.Done():
+				result.Error = ctx.Err().Error()
+			}
+
+			mu.Lock()
+			results[id] = result
+			mu.Unlock()
+		}(id, slave)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+	rpc "github.com/arkbriar/ssmgr/protocol"
+)
+
+// ErrNoSlaveAvailable is returned when there's no alive slave to allocate on.
+var ErrNoSlaveAvailable = errors.New("no slave available")
+
+// SlavePool holds the slaves by name and balances the allocations over the alive ones.
+type SlavePool struct {
+	mu     sync.RWMutex
+	slaves map[string]*Slave
+	// alive is the status of slaves on the last ping or stats query
+	alive map[string]bool
+}
+
+// NewSlavePool returns a pool of the slaves, which are taken as alive until they fail
+// a ping or a stats query.
+func NewSlavePool(slaves map[string]*Slave) *SlavePool {
+	p := &SlavePool{
+		slaves: make(map[string]*Slave, len(slaves)),
+		alive:  make(map[string]bool, len(slaves)),
+	}
+	for name, slave := range slaves {
+		p.slaves[name] = slave
+		p.alive[name] = true
+	}
+	return p
+}
+
+// Get returns the slave of name.
+func (p *SlavePool) Get(name string) (*Slave, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	slave, ok := p.slaves[name]
+	return slave, ok
+}
+
+// IDs returns the ids of all slaves in order.
+func (p *SlavePool) IDs() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ids := make([]string, 0, len(p.slaves))
+	for id := range p.slaves {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Alive returns the names of alive slaves in order.
+func (p *SlavePool) Alive() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	names := make([]string, 0, len(p.alive))
+	for name, alive := range p.alive {
+		if alive {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *SlavePool) setAlive(name string, alive bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.slaves[name]; ok {
+		p.alive[name] = alive
+	}
+}
+
+// Slaves returns a copy of the slaves by id, so they're called without holding the lock.
+func (p *SlavePool) Slaves() map[string]*Slave {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	slaves := make(map[string]*Slave, len(p.slaves))
+	for name, slave := range p.slaves {
+		slaves[name] = slave
+	}
+	return slaves
+}
+
+// GetStats queries the statistics of all slaves concurrently and returns them by slave
+// name, with the errors of failed slaves. Failed slaves are marked as down and succeeded
+// ones as alive.
+func (p *SlavePool) GetStats(ctx context.Context) (map[string]*rpc.Statistics, map[string]error) {
+	return p.getStats(ctx, p.Slaves())
+}
+
+func (p *SlavePool) getStats(ctx context.Context, slaves map[string]*Slave) (map[string]*rpc.Statistics, map[string]error) {
+	var (
+		mu    sync.Mutex
+		stats = make(map[string]*rpc.Statistics)
+		errs  = make(map[string]error)
+		wg    sync.WaitGroup
+	)
+	for name, slave := range slaves {
+		wg.Add(1)
+		go func(name string, slave *Slave) {
+			defer wg.Done()
+
+			s, err := slave.GetStats(ctx)
+			p.setAlive(name, err == nil)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[name] = err
+			} else {
+				stats[name] = s
+			}
+		}(name, slave)
+	}
+	wg.Wait()
+	return stats, errs
+}
+
+// leastLoaded returns the name of slave serving the fewest ports, ties are broken by
+// name so the choice is stable.
+func leastLoaded(stats map[string]*rpc.Statistics) (string, bool) {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	best, found := "", false
+	for _, name := range names {
+		if !found || len(stats[name].Flow) < len(stats[best].Flow) {
+			best, found = name, true
+		}
+	}
+	return best, found
+}
+
+// AllocateBalanced provisions a port for the user on the alive slave serving the fewest
+// ports, and returns the slave's name with the allocation. Slaves marked down by the
+// last ping or failing the stats query are skipped.
+func (p *SlavePool) AllocateBalanced(ctx context.Context, db *gorm.DB, userID string) (string, *orm.Allocation, error) {
+	alive := make(map[string]*Slave)
+	for _, name := range p.Alive() {
+		if slave, ok := p.Get(name); ok {
+			alive[name] = slave
+		}
+	}
+	stats, errs := p.getStats(ctx, alive)
+	for name, err := range errs {
+		logrus.Warnf("Skip slave %s on allocating: %s", name, err.Error())
+	}
+
+	name, ok := leastLoaded(stats)
+	if !ok {
+		return "", nil, ErrNoSlaveAvailable
+	}
+	slave, _ := p.Get(name)
+	alloc, err := Provision(db, slave, userID)
+	if err != nil {
+		return name, nil, err
+	}
+	return name, alloc, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+func TestAllocateBalanced(t *testing.T) {
+	db := newTestDB(t)
+	stubs := map[string]*fakeStub{"a": newFakeStub(), "b": newFakeStub(), "c": newFakeStub()}
+	slaves := make(map[string]*Slave)
+	for id, stub := range stubs {
+		slaves[id] = newFakeSlave(id, stub)
+	}
+	// a serves 2 ports, b serves 1 and c serves none
+	stubs["a"].ports[10098] = "x"
+	stubs["a"].ports[10099] = "x"
+	stubs["b"].ports[10099] = "x"
+	p := NewSlavePool(slaves)
+
+	for i, want := range []string{"c", "b", "c", "a", "b", "c"} {
+		userID := fmt.Sprintf("user%d", i)
+		if err := db.Create(&orm.User{ID: userID, Email: userID, Group: orm.DefaultGroup}).Error; err != nil {
+			t.Fatal(err)
+		}
+		name, alloc, err := p.AllocateBalanced(context.Background(), db, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != want {
+			t.Errorf("allocation %d: got slave %s, want %s", i, name, want)
+		}
+		if alloc.ServerID != name {
+			t.Errorf("allocation %d: got server %s, want %s", i, alloc.ServerID, name)
+		}
+	}
+}
+
+func TestAllocateBalancedSkipsDown(t *testing.T) {
+	db := newTestDB(t)
+	up, down := newFakeStub(), newFakeStub()
+	up.ports[10099] = "x"
+	p := NewSlavePool(map[string]*Slave{
+		"up":   newFakeSlave("up", up),
+		"down": newFakeSlave("down", down),
+	})
+	if err := db.Create(&orm.User{ID: "u", Email: "u", Group: orm.DefaultGroup}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// the down slave is marked by ping and never queried for allocation
+	down.setDown(true)
+	results := p.PingAll(context.Background())
+	if len(results["down"].Error) == 0 || len(results["up"].Error) != 0 {
+		t.Fatalf("unexpected ping results %+v", results)
+	}
+	if alive := p.Alive(); len(alive) != 1 || alive[0] != "up" {
+		t.Fatalf("got alive slaves %v, want [up]", alive)
+	}
+	name, _, err := p.AllocateBalanced(context.Background(), db, "u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "up" {
+		t.Errorf("got slave %s, want up", name)
+	}
+
+	// a slave failing the stats query is skipped as well
+	up.setDown(true)
+	if _, _, err := p.AllocateBalanced(context.Background(), db, "u"); err != ErrNoSlaveAvailable {
+		t.Errorf("got %v with all slaves down, want ErrNoSlaveAvailable", err)
+	}
+}
+
+func TestPoolGetStats(t *testing.T) {
+	a, b := newFakeStub(), newFakeStub()
+	a.ports[10000], a.flow[10000] = "x", 100
+	b.setDown(true)
+	p := NewSlavePool(map[string]*Slave{"a": newFakeSlave("a", a), "b": newFakeSlave("b", b)})
+
+	stats, errs := p.GetStats(context.Background())
+	if len(stats) != 1 || stats["a"].Flow[10000].Traffic != 100 {
+		t.Errorf("got stats %v", stats)
+	}
+	if len(errs) != 1 || errs["b"] == nil {
+		t.Errorf("got errors %v, want the one of b", errs)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"google.golang.org/grpc/codes"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUserDisabled  = errors.New("user is disabled")
+	ErrUserExpired   = errors.New("user is expired")
+	ErrQuotaExceeded = errors.New("user has used up the quota")
+)
+
+// checkProvisionable checks the user exists and is allowed to use more ports.
+func checkProvisionable(db *gorm.DB, userID string) error {
+	var user orm.User
+	if db.Where("id = ?", userID).First(&user).RecordNotFound() {
+		return ErrUserNotFound
+	}
+	if user.Disabled {
+		return ErrUserDisabled
+	}
+	if user.Expired > 0 && user.Expired < time.Now().Unix() {
+		return ErrUserExpired
+	}
+	if user.QuotaFlow > 0 {
+		var used struct{ Flow int64 }
+		err := db.Model(&orm.FlowRecord{}).Select("sum(flow) AS flow").
+			Where("user_id = ?", userID).Scan(&used).Error
+		if err != nil {
+			return err
+		}
+		if used.Flow >= user.QuotaFlow {
+			return ErrQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// reserveAllocation finds the allocation of the user on the slave, or reserves a free
+// port for it. It returns if the allocation is newly created.
+func reserveAllocation(db *gorm.DB, slave *Slave, userID string) (*orm.Allocation, bool, error) {
+	tx := db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, false, err
+	}
+
+	alloc := &orm.Allocation{UserID: userID, ServerID: slave.Config.ID}
+	created := tx.Where(alloc).First(alloc).RecordNotFound()
+	if created {
+		port, err := findEmptyPort(tx, slave.Config)
+		if err != nil {
+			tx.Rollback()
+			return nil, false, err
+		}
+		// password is left empty to be generated by the slave
+		alloc.Port = port
+		if err := tx.Create(alloc).Error; err != nil {
+			tx.Rollback()
+			return nil, false, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, false, err
+	}
+	return alloc, created, nil
+}
+
+// Provision allocates a port on the slave for the user after checking the user's quota
+// and expiry, and returns the allocation. The port is reserved in db before calling the
+// slave, so no transaction is held over the network. The reserved row is deleted again
+// if the slave fails to allocate the port, so the db never records a port the slave
+// doesn't serve. The existing allocation is returned if there's one.
+func Provision(db *gorm.DB, slave *Slave, userID string) (*orm.Allocation, error) {
+	if err := checkProvisionable(db, userID); err != nil {
+		return nil, err
+	}
+
+	alloc, created, err := reserveAllocation(db, slave, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// undo releases the newly reserved port on the slave and in db
+	undo := func(allocated bool) {
+		if !created {
+			return
+		}
+		if allocated {
+			slave.Free(alloc.Port)
+		}
+		err := db.Where(&orm.Allocation{
+			UserID:   userID,
+			ServerID: alloc.ServerID,
+			Port:     alloc.Port,
+		}).Delete(&orm.Allocation{}).Error
+		if err != nil {
+			slave.logger().Errorf("Failed to release port %d reserved for user %s: %s", alloc.Port, userID, err.Error())
+		}
+	}
+
+	password, err := slave.Allocate(alloc.Port, alloc.Password, userID)
+	if err != nil {
+		undo(false)
+		return nil, err
+	}
+	if password != alloc.Password {
+		alloc.Password = password
+		err := db.Model(&orm.Allocation{}).Where(&orm.Allocation{
+			UserID:   userID,
+			ServerID: alloc.ServerID,
+		}).Update("password", password).Error
+		if err != nil {
+			undo(true)
+			return nil, fmt.Errorf("failed to save allocation: %s", err.Error())
+		}
+	}
+
+	slave.logger().Infof("Provisioned port %d for user %s", alloc.Port, userID)
+
+	return alloc, nil
+}
+
+// Deprovision frees the port of the user on the slave and deletes the allocation. It's
+// idempotent: a port the slave doesn't have is taken as freed and the allocation is
+// still deleted. If the slave can't free the port, e.g. it's unreachable, the allocation
+// is kept and the error is returned so the teardown can be retried.
+func Deprovision(db *gorm.DB, slave *Slave, userID, serverID string) error {
+	var alloc orm.Allocation
+	err := db.Where(&orm.Allocation{UserID: userID, ServerID: serverID}).First(&alloc).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := slave.Free(alloc.Port); err != nil {
+		if rpcCode(err) != codes.NotFound {
+			return err
+		}
+		slave.logger().Warnf("Port %d of user %s is already freed", alloc.Port, userID)
+	}
+
+	err = db.Where(&orm.Allocation{UserID: userID, ServerID: serverID}).Delete(&orm.Allocation{}).Error
+	if err != nil {
+		return err
+	}
+
+	slave.logger().Infof("Deprovisioned port %d of user %s", alloc.Port, userID)
+
+	return nil
+}
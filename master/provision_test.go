@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+func TestProvision(t *testing.T) {
+	db := newTestDB(t)
+	stub := newFakeStub()
+	slave := newFakeSlave("s", stub)
+	if err := db.Create(&orm.User{ID: "u", Email: "u", Group: orm.DefaultGroup}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// the db must not be locked while the slave is called
+	stub.onAllocate = func(port int32) error {
+		done := make(chan error, 1)
+		go func() {
+			var count int
+			done <- db.Model(&orm.Allocation{}).Count(&count).Error
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(time.Second):
+			t.Error("db is locked during the allocate call")
+			return nil
+		}
+	}
+
+	alloc, err := Provision(db, slave, "u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alloc.Port != 10000 || alloc.Password != "generated" {
+		t.Errorf("got allocation %+v", alloc)
+	}
+	var saved orm.Allocation
+	db.Where(&orm.Allocation{UserID: "u", ServerID: "s"}).First(&saved)
+	if saved.Password != "generated" {
+		t.Errorf("got saved password %q, want the generated one", saved.Password)
+	}
+
+	// provisioning again returns the existing allocation
+	again, err := Provision(db, slave, "u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Port != alloc.Port {
+		t.Errorf("got port %d provisioning again, want %d", again.Port, alloc.Port)
+	}
+}
+
+func TestProvisionSlaveFailed(t *testing.T) {
+	db := newTestDB(t)
+	stub := newFakeStub()
+	stub.onAllocate = func(port int32) error { return errors.New("allocate failed") }
+	if err := db.Create(&orm.User{ID: "u", Email: "u", Group: orm.DefaultGroup}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Provision(db, newFakeSlave("s", stub), "u"); err == nil {
+		t.Fatal("provisioned with a failed slave")
+	}
+	var count int
+	db.Model(&orm.Allocation{}).Count(&count)
+	if count != 0 {
+		t.Errorf("got %d allocations after failure, want the reservation released", count)
+	}
+}
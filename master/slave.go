@@ -1,106 +1,871 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/golang/protobuf/ptypes/empty"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 
+	"github.com/arkbriar/ssmgr/internal/backoff"
 	"github.com/arkbriar/ssmgr/master/orm"
 	rpc "github.com/arkbriar/ssmgr/protocol"
 )
 
 var (
-	caFile = flag.String("ca", "", "Path of CA X.509(.pem) file (enable TLS when specified)")
+	caFile   = flag.String("ca", "", "Path of CA X.509(.pem) file (enable TLS when specified)")
+	certFile = flag.String("cert", "", "Path of client X.509(.pem) file for mutual TLS")
+	keyFile  = flag.String("key", "", "Path of client key file for mutual TLS")
 )
 
 type Slave struct {
 	stub rpc.SSMgrSlaveClient
 	ctx  context.Context
 
+	connMu   sync.Mutex
+	conn     *grpc.ClientConn
+	dialOpts []grpc.DialOption
+	// gen is increased on every new connection, so concurrent callers failing on the same
+	// connection redial it only once
+	gen uint64
+	// closed is set by Close, the slave is never connected again after it
+	closed bool
+
+	// traffic of ports on the last call of GetStatsDelta
+	deltaMu   sync.Mutex
+	deltaBase map[int32]int64
+
 	Config *SlaveConfig
 }
 
-var slaves map[string]*Slave
+// pool holds the slaves by their ids.
+var pool *SlavePool
+
+// allocateMethod is the encrypt method of all allocated ports.
+const allocateMethod = "aes-256-cfb"
 
 func InitSlaves() {
-	slaves = make(map[string]*Slave)
+	slaves := make(map[string]*Slave)
+
+	// never fall back to plaintext when TLS is asked for
+	tlsConfig, err := clientTLSConfig()
+	if err != nil {
+		logrus.Fatalf("Failed to construct the TLS config: %s", err.Error())
+	}
+	if tlsConfig == nil {
+		logrus.Warn("Connecting to slaves without TLS, tokens are sent in plaintext")
+	} else {
+		logrus.Info("Encrypting grpc channel with TLS")
+	}
 
 	for _, info := range config.Slaves {
-		address := fmt.Sprintf("%s:%d", info.Host, info.Port)
-		md := metadata.Pairs("token", info.Token)
-		ctx := metadata.NewContext(context.Background(), md)
+		slaves[info.ID] = newSlave(info, tlsConfig)
+	}
+
+	// dial slaves concurrently so unreachable ones cost one timeout in total
+	var wg sync.WaitGroup
+	for _, slave := range slaves {
+		wg.Add(1)
+		go func(slave *Slave) {
+			defer wg.Done()
+			if err := slave.Dial(); err != nil {
+				slave.logger().Warnf("Failed to connect: %s, retry in background", err.Error())
+				slave.dial()
+			}
+		}(slave)
+	}
+	wg.Wait()
+	pool = NewSlavePool(slaves)
+
+	for id, slave := range slaves {
+		go watchQuotaEvents(id, slave)
+	}
+}
+
+// newSlave returns the slave of info, it's connected with TLS if tlsConfig is not nil.
+func newSlave(info *SlaveConfig, tlsConfig *tls.Config) *Slave {
+	md := metadata.Pairs("token", info.Token)
+	ctx := metadata.NewContext(context.Background(), md)
+
+	opts := []grpc.DialOption{}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	opts = append(opts, grpc.WithUnaryInterceptor(unaryTraceInterceptor(slaveName(info), rpcLogLevel())))
+
+	return &Slave{
+		ctx:      ctx,
+		dialOpts: opts,
+		Config:   info,
+	}
+}
+
+// defaultDialTimeout is the timeout of `Slave.Dial` if config.DialTimeout is not set.
+const defaultDialTimeout = 10 * time.Second
+
+// Dial connects to the slave like `DialContext` within config.DialTimeout.
+func (s *Slave) Dial() error {
+	timeout := defaultDialTimeout
+	if config != nil && config.DialTimeout > 0 {
+		timeout = time.Duration(config.DialTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.DialContext(ctx)
+}
+
+// ErrSlaveClosed is returned when the slave is called or dialed after it's closed.
+var ErrSlaveClosed = errors.New("slave is closed")
+
+// newClient returns the stub of the connection.
+var newClient = rpc.NewSSMgrSlaveClient
+
+// DialContext connects to the slave and blocks until it's connected or ctx is done, so
+// an unreachable slave fails fast rather than on the first call. The previous connection
+// is closed if it succeeds.
+func (s *Slave) DialContext(ctx context.Context) error {
+	opts := append([]grpc.DialOption{grpc.WithBlock()}, s.dialOpts...)
+	conn, err := grpc.DialContext(ctx, s.Target(), opts...)
+	if err != nil {
+		return s.wrapError(err)
+	}
+
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	return s.swap(conn)
+}
+
+// Close closes the connection to the slave, it can't be dialed again. It's safe to call
+// Close multiple times or when the slave is not connected.
+func (s *Slave) Close() error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	conn := s.conn
+	s.conn = nil
+	return conn.Close()
+}
+
+// swap replaces the connection with conn and closes the previous one, conn is closed
+// instead if the slave is closed. It must be called with connMu held.
+func (s *Slave) swap(conn *grpc.ClientConn) error {
+	if s.closed {
+		conn.Close()
+		return ErrSlaveClosed
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = conn
+	s.stub = newClient(conn)
+	s.gen++
+	return nil
+}
+
+// dial connects to the slave in background, the previous connection is closed if any.
+func (s *Slave) dial() error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	return s.dialLocked()
+}
 
-		opts := []grpc.DialOption{}
-		if len(*caFile) != 0 {
-			creds, err := credentials.NewClientTLSFromFile(*caFile, "")
+func (s *Slave) dialLocked() error {
+	if s.closed {
+		return ErrSlaveClosed
+	}
+	// it doesn't block, so the lock is held for no longer than creating a connection
+	conn, err := grpc.Dial(s.Target(), s.dialOpts...)
+	if err != nil {
+		return err
+	}
+	return s.swap(conn)
+}
+
+// redial replaces the connection of generation gen, it's done if the connection is
+// already replaced by others.
+func (s *Slave) redial(gen uint64) error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if s.gen != gen {
+		return nil
+	}
+	return s.dialLocked()
+}
+
+// client returns the stub of current connection.
+func (s *Slave) client() rpc.SSMgrSlaveClient {
+	stub, _, _ := s.current()
+	return stub
+}
+
+// current returns the stub of current connection with its generation, and if the slave
+// is closed.
+func (s *Slave) current() (rpc.SSMgrSlaveClient, uint64, bool) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	return s.stub, s.gen, s.closed
+}
+
+// redialPolicy returns the max number of redials and the backoff between them.
+func redialPolicy() (int, *backoff.Backoff) {
+	retries, delay := 3, 500*time.Millisecond
+	if config != nil {
+		if config.RedialRetries != 0 {
+			retries = config.RedialRetries
+		}
+		if config.RedialDelay > 0 {
+			delay = time.Duration(config.RedialDelay) * time.Millisecond
+		}
+	}
+	return retries, &backoff.Backoff{Initial: delay, Jitter: 0.2}
+}
+
+// call invokes fn with the stub of the slave. When the slave is unavailable, e.g. it's
+// restarted or the network is broken, the connection is redialed with backoff and fn
+// is retried until it succeeds or the retries are used up. The callers failing on the
+// same connection redial it once, and a closed slave is never redialed.
+func (s *Slave) call(ctx context.Context, fn func(rpc.SSMgrSlaveClient) error) error {
+	retries, retry := redialPolicy()
+	for attempt := 0; ; attempt++ {
+		stub, gen, closed := s.current()
+		if closed {
+			return s.wrapError(ErrSlaveClosed)
+		}
+		err := fn(stub)
+		if grpc.Code(err) != codes.Unavailable || attempt >= retries {
+			return s.wrapError(err)
+		}
+
+		select {
+		case <-time.After(retry.Next()):
+		case <-ctx.Done():
+			return s.wrapError(err)
+		}
+		s.logger().Warnf("Slave unavailable, redialing (%d/%d): %s", attempt+1, retries, err.Error())
+		if err := s.redial(gen); err == ErrSlaveClosed {
+			return s.wrapError(err)
+		} else if err != nil {
+			s.logger().Warnf("Failed to redial: %s", err.Error())
+		}
+	}
+}
+
+// Target returns the address of the slave.
+func (s *Slave) Target() string {
+	return fmt.Sprintf("%s:%d", s.Config.Host, s.Config.Port)
+}
+
+// State returns the state of the connection to the slave, it's Shutdown when the
+// connection is closed or failed to be dialed.
+func (s *Slave) State() connectivity.State {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if s.conn == nil {
+		return connectivity.Shutdown
+	}
+	return s.conn.GetState()
+}
+
+// slaveName returns the name of the slave, or its ID when no name is configured.
+func slaveName(info *SlaveConfig) string {
+	if len(info.Name) != 0 {
+		return info.Name
+	}
+	return info.ID
+}
+
+// String returns the name of the slave, or its ID when no name is configured.
+func (s *Slave) String() string {
+	return slaveName(s.Config)
+}
+
+// logger returns a log entry tagged with the slave.
+func (s *Slave) logger() *logrus.Entry {
+	return logrus.WithField("slave", s.String())
+}
+
+// SlaveError is an error returned by a slave, prefixed with the slave so failures in a
+// cluster are attributable.
+type SlaveError struct {
+	Slave string
+	Err   error
+}
+
+func (e *SlaveError) Error() string {
+	return fmt.Sprintf("slave %s: %s", e.Slave, e.Err.Error())
+}
+
+func (e *SlaveError) Unwrap() error {
+	return e.Err
+}
+
+// rpcCode returns the grpc code of the error returned by a slave.
+func rpcCode(err error) codes.Code {
+	if e, ok := err.(*SlaveError); ok {
+		err = e.Err
+	}
+	return grpc.Code(err)
+}
+
+// wrapError prefixes the error with the slave, so failures in a cluster are attributable.
+func (s *Slave) wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SlaveError{Slave: s.String(), Err: err}
+}
+
+// withToken returns a context carrying the token of the slave.
+func (s *Slave) withToken(ctx context.Context) context.Context {
+	return metadata.NewContext(ctx, metadata.Pairs("token", s.Config.Token))
+}
+
+// WatchQuotaEvents subscribes the events of ports removed by the slave for using up their
+// quotas. The returned channel is closed when ctx is done or the stream is broken.
+func (s *Slave) WatchQuotaEvents(ctx context.Context) (<-chan *rpc.QuotaEvent, error) {
+	stream, err := s.client().QuotaEvents(s.withToken(ctx), &empty.Empty{})
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+
+	events := make(chan *rpc.QuotaEvent)
+	go func() {
+		defer close(events)
+		for {
+			e, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// StatsUpdate is delivered by `StreamStats`. Gap is set on the first update after the
+// stream is re-subscribed, the statistics during reconnection are missed and the
+// cumulative values may need to be reconciled.
+type StatsUpdate struct {
+	Stats *rpc.Statistics
+	Gap   bool
+}
+
+// StreamStats subscribes the statistics pushed by the slave every interval. The stream is
+// re-subscribed with backoff when it's broken, and the returned channel is closed only
+// when ctx is done.
+func (s *Slave) StreamStats(ctx context.Context, interval time.Duration) <-chan StatsUpdate {
+	updates := make(chan StatsUpdate)
+	go func() {
+		defer close(updates)
+
+		retry := backoff.Backoff{
+			Initial: time.Second,
+			Max:     interval,
+			Jitter:  0.2,
+		}
+		// gap is set once an update has been delivered and the stream is broken
+		received, gap := false, false
+		for {
+			stream, err := s.client().StreamStats(s.withToken(ctx), &rpc.StreamStatsRequest{
+				Interval: int64(interval / time.Second),
+			})
 			if err != nil {
-				logrus.Warnf("Faild to construct a TLS from the input certificate: %s", *caFile)
-				opts = append(opts, grpc.WithInsecure())
+				s.logger().Warnf("Failed to stream stats: %s", err.Error())
 			} else {
-				opts = append(opts, grpc.WithTransportCredentials(creds))
-				logrus.Info("Encrypting grpc channel with TLS")
+				for {
+					stats, err := stream.Recv()
+					if err != nil {
+						if ctx.Err() == nil {
+							s.logger().Warnf("Stats stream broken: %s", err.Error())
+						}
+						break
+					}
+					retry.Reset()
+					select {
+					case updates <- StatsUpdate{Stats: stats, Gap: gap}:
+						received, gap = true, false
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			gap = received
+
+			select {
+			case <-time.After(retry.Next()):
+			case <-ctx.Done():
+				return
 			}
+		}
+	}()
+	return updates
+}
+
+// watchQuotaEvents disables the users whose ports are removed by the slave, otherwise
+// the ports will be allocated again on next update. The failed or closed stream is
+// resubscribed with backoff.
+func watchQuotaEvents(serverID string, slave *Slave) {
+	retry := backoff.Backoff{
+		Initial: time.Second,
+		Max:     time.Duration(config.Interval) * time.Second,
+		Jitter:  0.2,
+	}
+	for {
+		events, err := slave.WatchQuotaEvents(context.Background())
+		if err != nil {
+			slave.logger().Warnf("Failed to watch quota events: %s", err.Error())
 		} else {
-			opts = append(opts, grpc.WithInsecure())
+			retry.Reset()
+			for e := range events {
+				slave.logger().Infof("User %s used up quota: %d/%d", e.UserId, e.UsedBytes, e.LimitBytes)
+				if len(e.UserId) != 0 {
+					RemoveUser(e.UserId)
+				}
+			}
+		}
+		time.Sleep(retry.Next())
+	}
+}
+
+// defaultAllocateTimeout is the timeout of an allocation call if config.AllocateTimeout
+// is not set.
+const defaultAllocateTimeout = 10 * time.Second
+
+// allocateContext returns the context of an allocation call, which times out in
+// config.AllocateTimeout so that a lost response is retried.
+func (s *Slave) allocateContext() (context.Context, context.CancelFunc) {
+	timeout := defaultAllocateTimeout
+	if config != nil && config.AllocateTimeout > 0 {
+		timeout = time.Duration(config.AllocateTimeout) * time.Millisecond
+	}
+	return context.WithTimeout(s.ctx, timeout)
+}
+
+// allocationTimedOut reports whether the allocation timed out, the slave may have
+// allocated the ports and allocating them again with the same passwords succeeds. The
+// ports with generated passwords can't be matched, they fail as AlreadyExists then.
+func allocationTimedOut(err error) bool {
+	return rpcCode(err) == codes.DeadlineExceeded
+}
+
+// Allocate allocates the port on the slave and returns the password in use, which is
+// generated by the slave when the given one is empty. The call timed out in
+// config.AllocateTimeout is retried once.
+func (s *Slave) Allocate(port int, password, userID string) (string, error) {
+	req := &rpc.AllocateRequest{
+		Port:     int32(port),
+		Password: password,
+		Method:   allocateMethod,
+		UserId:   userID,
+	}
+	var resp *rpc.AllocateResponse
+	allocate := func(stub rpc.SSMgrSlaveClient) (err error) {
+		ctx, cancel := s.allocateContext()
+		defer cancel()
+		resp, err = stub.Allocate(ctx, req)
+		return err
+	}
+	err := s.call(s.ctx, allocate)
+	if allocationTimedOut(err) && len(password) != 0 {
+		s.logger().Warnf("Allocating port %d timed out, retrying: %s", port, err.Error())
+		err = s.call(s.ctx, allocate)
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.GetPassword(), nil
+}
+
+// AllocateBatch allocates the ports on the slave in one call and returns the allocated
+// ones with passwords in use. In atomic mode either all ports are allocated or none,
+// otherwise the errors of failed ports are returned as well.
+func (s *Slave) AllocateBatch(reqs []*rpc.AllocateRequest, allOrNothing bool) ([]*rpc.AllocateResponse, map[int32]string, error) {
+	for _, req := range reqs {
+		if len(req.Method) == 0 {
+			req.Method = allocateMethod
+		}
+	}
+	var resp *rpc.AllocateBatchResponse
+	err := s.call(s.ctx, func(stub rpc.SSMgrSlaveClient) (err error) {
+		ctx, cancel := s.allocateContext()
+		defer cancel()
+		resp, err = stub.AllocateBatch(ctx, &rpc.AllocateBatchRequest{
+			Requests: reqs,
+			Atomic:   allOrNothing,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.GetAllocated(), resp.GetFailed(), nil
+}
+
+// defaultBatchSize is the number of ports allocated in one call by BatchAllocate, which
+// keeps the requests far below the max message size of grpc.
+const defaultBatchSize = 100
+
+// BatchError describes the ports failed to be allocated by BatchAllocate.
+type BatchError struct {
+	// Failed maps the index of batch to the errors of its failed ports.
+	Failed map[int]map[int32]string
+}
+
+func (e *BatchError) Error() string {
+	batches := make([]int, 0, len(e.Failed))
+	for i := range e.Failed {
+		batches = append(batches, i)
+	}
+	sort.Ints(batches)
+
+	var parts []string
+	for _, i := range batches {
+		ports := make([]int, 0, len(e.Failed[i]))
+		for port := range e.Failed[i] {
+			ports = append(ports, int(port))
+		}
+		sort.Ints(ports)
+		for _, port := range ports {
+			parts = append(parts, fmt.Sprintf("batch %d port %d: %s", i, port, e.Failed[i][int32(port)]))
+		}
+	}
+	return "failed to allocate " + strings.Join(parts, "; ")
+}
+
+// BatchAllocate allocates the ports on the slave in batches of batchSize ports, the
+// failures of a batch don't affect the others. The allocated ports are returned along
+// with a *BatchError describing the failed ones.
+func (s *Slave) BatchAllocate(batchSize int, reqs ...*rpc.AllocateRequest) ([]*rpc.AllocateResponse, error) {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	var allocated []*rpc.AllocateResponse
+	failed := make(map[int]map[int32]string)
+	for i := 0; i*batchSize < len(reqs); i++ {
+		end := (i + 1) * batchSize
+		if end > len(reqs) {
+			end = len(reqs)
+		}
+		batch := reqs[i*batchSize : end]
+
+		resps, errs, err := s.AllocateBatch(batch, false)
+		if allocationTimedOut(err) {
+			s.logger().Warnf("Allocating batch %d timed out, retrying: %s", i, err.Error())
+			resps, errs, err = s.AllocateBatch(batch, false)
 		}
-		conn, err := grpc.Dial(address, opts...)
 		if err != nil {
-			logrus.Warnf("Failed to dial %s", address)
+			errs = make(map[int32]string, len(batch))
+			for _, req := range batch {
+				errs[req.Port] = err.Error()
+			}
+		}
+		allocated = append(allocated, resps...)
+		if len(errs) > 0 {
+			failed[i] = errs
 		}
+	}
+
+	if len(failed) > 0 {
+		return allocated, &BatchError{Failed: failed}
+	}
+	return allocated, nil
+}
 
-		client := rpc.NewSSMgrSlaveClient(conn)
+// Free frees the port on the slave, draining its connections for at most
+// config.DrainTimeout seconds.
+func (s *Slave) Free(port int) error {
+	return s.call(s.ctx, func(stub rpc.SSMgrSlaveClient) error {
+		_, err := stub.Free(s.ctx, &rpc.FreeRequest{
+			Port:         int32(port),
+			DrainTimeout: config.DrainTimeout,
+		})
+		return err
+	})
+}
+
+// GetStats queries the statistics of all ports on the slave.
+func (s *Slave) GetStats(ctx context.Context) (*rpc.Statistics, error) {
+	var stats *rpc.Statistics
+	err := s.call(ctx, func(stub rpc.SSMgrSlaveClient) (err error) {
+		stats, err = stub.GetStats(s.withToken(ctx), &empty.Empty{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// GetStatsDelta queries the traffic of ports increased since the previous call. When the
+// traffic is lower than the previous one, the server is restarted and the whole traffic
+// is counted as increased. Concurrent calls are serialized, so each one is diffed against
+// the stats fetched before it.
+func (s *Slave) GetStatsDelta(ctx context.Context) (map[int32]int64, error) {
+	s.deltaMu.Lock()
+	defer s.deltaMu.Unlock()
 
-		slaves[info.ID] = &Slave{
-			stub:   client,
-			ctx:    ctx,
-			Config: info,
+	stats, err := s.GetStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	base := make(map[int32]int64, len(stats.Flow))
+	delta := make(map[int32]int64, len(stats.Flow))
+	for port, unit := range stats.Flow {
+		traffic := unit.GetTraffic()
+		if prev, ok := s.deltaBase[port]; ok && traffic >= prev {
+			delta[port] = traffic - prev
+		} else {
+			delta[port] = traffic
 		}
+		base[port] = traffic
 	}
+	s.deltaBase = base
+	return delta, nil
+}
+
+// GetStat queries the traffic of the port on the slave.
+func (s *Slave) GetStat(port int32) (int64, error) {
+	var unit *rpc.FlowUnit
+	err := s.call(s.ctx, func(stub rpc.SSMgrSlaveClient) (err error) {
+		unit, err = stub.GetStat(s.ctx, &rpc.StatRequest{Port: port})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return unit.GetTraffic(), nil
+}
+
+// SupportedMethods queries the encrypt methods supported by the slave.
+func (s *Slave) SupportedMethods() ([]*rpc.Method, error) {
+	var list *rpc.MethodList
+	err := s.call(s.ctx, func(stub rpc.SSMgrSlaveClient) (err error) {
+		list, err = stub.SupportedMethods(s.ctx, &empty.Empty{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list.GetMethods(), nil
 }
 
 func CleanInvalidAllocation() {
 	serverIDs := make([]string, 0)
-	for serverID, _ := range slaves {
-		serverIDs = append(serverIDs, serverID)
-	}
+	serverIDs = append(serverIDs, pool.IDs()...)
 
 	db.Where("server_id NOT IN (?)", serverIDs).Delete(&orm.Allocation{})
 }
 
 func Monitoring() {
-	for {
-		for id, slave := range slaves {
-			if err := updateStats(id, slave); err != nil {
-				logrus.Error("Update status error: ", err.Error())
+	interval := time.Duration(config.Interval) * time.Second
+
+	go func() {
+		for result := range PollStats(context.Background(), interval) {
+			if result.Err != nil {
+				logrus.Error("Update status error: ", result.Err.Error())
+				continue
 			}
+			updateStats(result.ServerID, result.Slave, result.Stats)
 		}
+	}()
+
+	for {
+		// keep the alive status of slaves fresh for the balanced allocations
+		pool.PingAll(context.Background())
 		if err := checkUserLimit(); err != nil {
 			logrus.Error("Check user limit error: ", err.Error())
 		}
-		time.Sleep(time.Duration(config.Interval) * time.Second)
+		time.Sleep(interval)
 	}
 }
 
-func updateStats(serverID string, slave *Slave) error {
+// StatResult is the statistics polled from a slave.
+type StatResult struct {
+	ServerID string
+	Slave    *Slave
+	Stats    *rpc.Statistics
+	Err      error
+}
+
+// PollStats polls the statistics of all slaves every interval and streams the results
+// through the returned channel, which is closed when ctx is done. The polls are spread
+// over the interval unless config.PollStagger is disabled, so the writes to db are
+// evened out, and at most config.PollConcurrency polls run at the same time. A slave is
+// skipped while its previous poll is running, so a hung slave doesn't pile up polls.
+func PollStats(ctx context.Context, interval time.Duration) <-chan StatResult {
+	results := make(chan StatResult)
+
+	ids := pool.IDs()
 
-	type portInfo struct {
-		Password string
-		UserID   string
+	concurrency := config.PollConcurrency
+	if concurrency <= 0 {
+		concurrency = len(ids)
 	}
+	sem := make(chan struct{}, concurrency)
+	// polling marks the slaves whose polls are running
+	polling := make([]int32, len(ids))
+
+	poll := func(i int, id string) {
+		// phase offset of the slave in the interval
+		if config.PollStagger == nil || *config.PollStagger {
+			select {
+			case <-time.After(interval * time.Duration(i) / time.Duration(len(ids))):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		slave, _ := pool.Get(id)
+		stats, err := slave.GetStats(ctx)
+		<-sem
+
+		select {
+		case results <- StatResult{ServerID: id, Slave: slave, Stats: stats, Err: err}:
+		case <-ctx.Done():
+		}
+	}
+
+	go func() {
+		defer close(results)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		for {
+			for i, id := range ids {
+				if !atomic.CompareAndSwapInt32(&polling[i], 0, 1) {
+					logrus.WithField("slave", id).Warn("Previous poll is still running, skipped")
+					continue
+				}
+				wg.Add(1)
+				go func(i int, id string) {
+					defer wg.Done()
+					defer atomic.StoreInt32(&polling[i], 0)
+					poll(i, id)
+				}(i, id)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return results
+}
+
+type portInfo struct {
+	Password string
+	UserID   string
+}
+
+// Counters of the drift detected and fixed by reconciliation since master starts.
+var (
+	driftDetected int64
+	driftFixed    int64
+)
+
+// reconcile allocates the ports which should be allocated and frees the ports which
+// should not exist on the slave. Nothing is changed in dry-run mode.
+func reconcile(serverID string, slave *Slave, portMap map[int]portInfo, expected, actual []int) {
+	shouldAlloc, shouldFree := diffPorts(expected, actual)
+	drift := len(shouldAlloc) + len(shouldFree)
+	if drift == 0 {
+		return
+	}
+	detected := atomic.AddInt64(&driftDetected, int64(drift))
+
+	entry := slave.logger().WithFields(logrus.Fields{
+		"missing":     shouldAlloc,
+		"unexpected":  shouldFree,
+		"drift_total": detected,
+	})
+	if config.ReconcileDryRun {
+		entry.Warn("Drift detected (dry run)")
+		return
+	}
+
+	fixed := 0
+	for _, port := range shouldAlloc {
+		info := portMap[port]
+		password, err := slave.Allocate(port, info.Password, info.UserID)
+		if rpcCode(err) == codes.AlreadyExists {
+			entry.Errorf("Port %d is taken on the slave with different credentials", port)
+			continue
+		}
+		if err != nil {
+			entry.Errorf("Failed to allocate port: %s", err.Error())
+			continue
+		}
+		if password != info.Password {
+			savePassword(info.UserID, serverID, password)
+		}
+		fixed++
+	}
+
+	for _, port := range shouldFree {
+		if err := slave.Free(port); err != nil {
+			entry.Errorf("Failed to free port: %s", err.Error())
+			continue
+		}
+		fixed++
+	}
+
+	entry.WithFields(logrus.Fields{
+		"fixed":       fixed,
+		"fixed_total": atomic.AddInt64(&driftFixed, int64(fixed)),
+	}).Info("Drift reconciled")
+}
+
+// updateStats reconciles the ports of the slave and updates the flow records according
+// to the statistics polled from it.
+func updateStats(serverID string, slave *Slave, stats *rpc.Statistics) {
 	portMap := make(map[int]portInfo)
 
 	// Expected & actual ports allocation status
 	var expected, actual []int
 
-	var allocs []orm.Allocation
-	db.Where("server_id = ?", serverID).Find(&allocs)
+	allocs, err := orm.AllocationsByServer(db, serverID)
+	if err != nil {
+		slave.logger().Errorf("Failed to query allocations: %s", err.Error())
+		return
+	}
 	for _, alloc := range allocs {
 		expected = append(expected, alloc.Port)
 		portMap[alloc.Port] = portInfo{
@@ -109,94 +874,48 @@ func updateStats(serverID string, slave *Slave) error {
 		}
 	}
 
-	stats, err := slave.stub.GetStats(slave.ctx, &empty.Empty{})
-	if err != nil {
-		return err
-	}
 	for port, _ := range stats.Flow {
 		actual = append(actual, int(port))
 	}
 
 	// In most cases expected ports should be same with actual ports.
-	// If not, allocate the ports which should be allocated, and free ports which should not exist.
-
-	shouldAlloc, shouldFree := diffPorts(expected, actual)
+	// If not, reconcile the differences.
 
-	for _, port := range shouldAlloc {
-		_, err = slave.stub.Allocate(slave.ctx, &rpc.AllocateRequest{
-			Port:     int32(port),
-			Password: portMap[port].Password,
-			Method:   "aes-256-cfb", // const
-		})
-		if err != nil {
-			logrus.Errorf("Failed to allocate port: %s", err.Error())
-		}
-	}
-
-	for _, port := range shouldFree {
-		_, err = slave.stub.Free(slave.ctx, &rpc.FreeRequest{
-			Port: int32(port),
-		})
-		if err != nil {
-			logrus.Errorf("Failed to allocate port: %s", err.Error())
-		}
-	}
+	reconcile(serverID, slave, portMap, expected, actual)
 
 	// Update flow records according to statistics
 
+	flows := make([]orm.PortFlow, 0, len(stats.Flow))
 	for port, stat := range stats.Flow {
 		if _, ok := portMap[int(port)]; !ok {
 			continue // skip shouldFree
 		}
-		var record orm.FlowRecord
-		db.Where(&orm.FlowRecord{
-			UserID:    portMap[int(port)].UserID,
-			ServerID:  serverID,
-			StartTime: stat.StartTime,
-		}).FirstOrCreate(&record)
+		observeUsage(slave.String(), port, stat.CpuPercent, stat.RssBytes)
 
-		// db.Save(&record) not works as expected due to gorm's bug
-
-		db.Model(&orm.FlowRecord{}).Where(&orm.FlowRecord{
-			UserID:    portMap[int(port)].UserID,
-			ServerID:  serverID,
+		flows = append(flows, orm.PortFlow{
+			Port:      port,
 			StartTime: stat.StartTime,
-		}).Update("flow", stat.Traffic)
+			Flow:      stat.Traffic,
+		})
+	}
+	skipped, err := orm.RecordFlow(db, serverID, flows, allocs)
+	if err != nil {
+		slave.logger().Errorf("Failed to record flow: %s", err.Error())
+	}
+	if len(skipped) > 0 {
+		slave.logger().Warnf("Flow of ports not allocated is skipped: %v", skipped)
 	}
-
-	return nil
 }
 
 func checkUserLimit() error {
-	const SQL = `SELECT user_id, quota_flow, sum(flow) AS current_flow, expired
-FROM users JOIN flow_record ON users.id = flow_record.user_id
-WHERE disabled = 0
-GROUP BY user_id`
-
-	rows, err := db.Raw(SQL).Rows()
+	disabled, err := orm.EnforceQuotas(db, time.Now().Unix())
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-
-	shouldDisable := make([]string, 0)
-	for rows.Next() {
-		var (
-			userID      string
-			quotaFlow   int64
-			currentFlow int64
-			expired     int64
-		)
-		rows.Scan(&userID, &quotaFlow, &currentFlow, &expired)
-
-		if currentFlow >= quotaFlow || expired <= time.Now().Unix() {
-			logrus.Infof("User expired or reached limit: %s", userID)
-			shouldDisable = append(shouldDisable, userID)
-		}
-	}
 
-	if len(shouldDisable) > 0 {
-		RemoveUser(shouldDisable...)
+	if len(disabled) > 0 {
+		logrus.Infof("Users expired or reached limit: %v", disabled)
+		go removeUserAllocation(disabled...)
 	}
 	return nil
 }
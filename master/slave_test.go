@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+	rpc "github.com/arkbriar/ssmgr/protocol"
+)
+
+// fakeStub serves the calls of a slave from memory, the methods not overridden panic.
+type fakeStub struct {
+	rpc.SSMgrSlaveClient
+
+	// onAllocate is called on Allocate before the port is allocated
+	onAllocate func(port int32) error
+
+	mu      sync.Mutex
+	down    bool
+	ports   map[int32]string
+	flow    map[int32]int64
+	methods map[int32]string
+}
+
+func newFakeStub() *fakeStub {
+	return &fakeStub{
+		ports:   make(map[int32]string),
+		flow:    make(map[int32]int64),
+		methods: make(map[int32]string),
+	}
+}
+
+func (f *fakeStub) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakeStub) check() error {
+	if f.down {
+		return grpc.Errorf(codes.DeadlineExceeded, "slave is down")
+	}
+	return nil
+}
+
+func (f *fakeStub) Ping(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*empty.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return &empty.Empty{}, nil
+}
+
+func (f *fakeStub) Allocate(ctx context.Context, in *rpc.AllocateRequest, opts ...grpc.CallOption) (*rpc.AllocateResponse, error) {
+	if f.onAllocate != nil {
+		if err := f.onAllocate(in.Port); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	password := in.Password
+	if len(password) == 0 {
+		password = "generated"
+	}
+	f.ports[in.Port] = password
+	return &rpc.AllocateResponse{Port: in.Port, Password: password}, nil
+}
+
+func (f *fakeStub) Free(ctx context.Context, in *rpc.FreeRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	if _, ok := f.ports[in.Port]; !ok {
+		return nil, grpc.Errorf(codes.NotFound, "port %d not found", in.Port)
+	}
+	delete(f.ports, in.Port)
+	return &empty.Empty{}, nil
+}
+
+func (f *fakeStub) GetStats(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*rpc.Statistics, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	stats := &rpc.Statistics{Flow: make(map[int32]*rpc.FlowUnit)}
+	for port := range f.ports {
+		stats.Flow[port] = &rpc.FlowUnit{Traffic: f.flow[port], Method: f.methods[port]}
+	}
+	return stats, nil
+}
+
+// newFakeSlave returns a slave served by stub.
+func newFakeSlave(id string, stub rpc.SSMgrSlaveClient) *Slave {
+	return &Slave{
+		stub:     stub,
+		ctx:      context.Background(),
+		dialOpts: []grpc.DialOption{grpc.WithInsecure()},
+		Config:   &SlaveConfig{ID: id, Host: "127.0.0.1", Port: 6001, PortMin: 10000, PortMax: 10100},
+	}
+}
+
+// newTestDB returns a migrated in-memory sqlite database with the default group.
+func newTestDB(t *testing.T) *gorm.DB {
+	db := orm.New("sqlite3", ":memory:")
+	db.DB().SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if err := db.Create(&orm.Group{Name: orm.DefaultGroup}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// unavailableStub fails Ping as Unavailable once all callers of the barrier arrive, so
+// they fail on the same connection.
+type unavailableStub struct {
+	rpc.SSMgrSlaveClient
+	barrier sync.WaitGroup
+}
+
+func (f *unavailableStub) Ping(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*empty.Empty, error) {
+	f.barrier.Done()
+	f.barrier.Wait()
+	return nil, grpc.Errorf(codes.Unavailable, "connection refused")
+}
+
+// withRedials makes redialed connections served by stub, and returns the count of them.
+func withRedials(t *testing.T, stub rpc.SSMgrSlaveClient) func() int {
+	defer func(c *Config) { t.Cleanup(func() { config = c }) }(config)
+	config = &Config{RedialDelay: 1}
+
+	var mu sync.Mutex
+	count := 0
+	orig := newClient
+	newClient = func(*grpc.ClientConn) rpc.SSMgrSlaveClient {
+		mu.Lock()
+		defer mu.Unlock()
+		count++
+		return stub
+	}
+	t.Cleanup(func() { newClient = orig })
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return count
+	}
+}
+
+func TestCallRedialsOnce(t *testing.T) {
+	redials := withRedials(t, newFakeStub())
+
+	const callers = 10
+	stub := &unavailableStub{}
+	stub.barrier.Add(callers)
+	slave := newFakeSlave("s1", stub)
+	defer slave.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- slave.call(context.Background(), func(c rpc.SSMgrSlaveClient) error {
+				_, err := c.Ping(context.Background(), &empty.Empty{})
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("call failed after redialing: %s", err)
+		}
+	}
+	if n := redials(); n != 1 {
+		t.Errorf("redialed %d times by concurrent callers, want once", n)
+	}
+}
+
+func TestCallAfterClose(t *testing.T) {
+	redials := withRedials(t, newFakeStub())
+
+	stub := &unavailableStub{}
+	stub.barrier.Add(1)
+	slave := newFakeSlave("s1", stub)
+
+	calls := 0
+	err := slave.call(context.Background(), func(c rpc.SSMgrSlaveClient) error {
+		calls++
+		if calls == 1 {
+			// closed while the call is failing
+			slave.Close()
+			_, err := c.Ping(context.Background(), &empty.Empty{})
+			return err
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrSlaveClosed) {
+		t.Errorf("got %v calling a closed slave, want ErrSlaveClosed", err)
+	}
+	if n := redials(); n != 0 {
+		t.Errorf("closed slave is redialed %d times", n)
+	}
+	if err := slave.dial(); err != ErrSlaveClosed {
+		t.Errorf("got %v dialing a closed slave, want ErrSlaveClosed", err)
+	}
+	if state := slave.State(); state != connectivity.Shutdown {
+		t.Errorf("got state %s of closed slave, want Shutdown", state)
+	}
+}
+
+// growingStub serves a port whose traffic grows by 10 on every query, the odd queries
+// are answered late.
+type growingStub struct {
+	rpc.SSMgrSlaveClient
+
+	mu      sync.Mutex
+	queries int64
+}
+
+func (f *growingStub) GetStats(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*rpc.Statistics, error) {
+	f.mu.Lock()
+	f.queries++
+	n := f.queries
+	f.mu.Unlock()
+
+	if n%2 == 1 {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return &rpc.Statistics{Flow: map[int32]*rpc.FlowUnit{10000: {Traffic: n * 10}}}, nil
+}
+
+func TestGetStatsDeltaConcurrent(t *testing.T) {
+	stub := &growingStub{}
+	slave := newFakeSlave("s1", stub)
+
+	var (
+		mu    sync.Mutex
+		total int64
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			delta, err := slave.GetStatsDelta(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			total += delta[10000]
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// every byte is counted exactly once
+	if want := stub.queries * 10; total != want {
+		t.Errorf("got total delta %d, want %d", total, want)
+	}
+}
+
+// timeoutStub allocates the ports but hangs the first call of each until it times out,
+// like a slave whose response is lost.
+type timeoutStub struct {
+	*fakeStub
+	calls map[int32]int
+}
+
+// lose waits for the deadline of ctx if it's the first call of port.
+func (f *timeoutStub) lose(ctx context.Context, port int32) error {
+	f.calls[port]++
+	if f.calls[port] > 1 {
+		return nil
+	}
+	<-ctx.Done()
+	return grpc.Errorf(codes.DeadlineExceeded, ctx.Err().Error())
+}
+
+func (f *timeoutStub) Allocate(ctx context.Context, in *rpc.AllocateRequest, opts ...grpc.CallOption) (*rpc.AllocateResponse, error) {
+	resp, err := f.fakeStub.Allocate(ctx, in, opts...)
+	if err := f.lose(ctx, in.Port); err != nil {
+		return nil, err
+	}
+	return resp, err
+}
+
+// AllocateBatch counts the calls by the first port of batch.
+func (f *timeoutStub) AllocateBatch(ctx context.Context, in *rpc.AllocateBatchRequest, opts ...grpc.CallOption) (*rpc.AllocateBatchResponse, error) {
+	resp := &rpc.AllocateBatchResponse{}
+	for _, req := range in.Requests {
+		allocated, err := f.fakeStub.Allocate(ctx, req, opts...)
+		if err != nil {
+			return nil, err
+		}
+		resp.Allocated = append(resp.Allocated, allocated)
+	}
+	if err := f.lose(ctx, in.Requests[0].Port); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// withAllocateTimeout makes the allocations time out quickly.
+func withAllocateTimeout(t *testing.T) {
+	defer func(c *Config) { t.Cleanup(func() { config = c }) }(config)
+	config = &Config{AllocateTimeout: 20}
+}
+
+func TestAllocateRetriesTimeout(t *testing.T) {
+	withAllocateTimeout(t)
+	stub := &timeoutStub{fakeStub: newFakeStub(), calls: make(map[int32]int)}
+	slave := newFakeSlave("s1", stub)
+
+	password, err := slave.Allocate(10000, "password", "u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "password" || stub.calls[10000] != 2 {
+		t.Errorf("got password %q in %d calls, want password in 2", password, stub.calls[10000])
+	}
+
+	// the generated password can't be matched by a retry
+	if _, err := slave.Allocate(10001, "", "u"); rpcCode(err) != codes.DeadlineExceeded {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+	if stub.calls[10001] != 1 {
+		t.Errorf("allocation with generated password is retried")
+	}
+}
+
+func TestBatchAllocateRetriesTimeout(t *testing.T) {
+	withAllocateTimeout(t)
+	stub := &timeoutStub{fakeStub: newFakeStub(), calls: make(map[int32]int)}
+	slave := newFakeSlave("s1", stub)
+
+	var reqs []*rpc.AllocateRequest
+	for port := int32(10000); port < 10004; port++ {
+		reqs = append(reqs, &rpc.AllocateRequest{Port: port, Password: "password", UserId: "u"})
+	}
+	allocated, err := slave.BatchAllocate(2, reqs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocated) != 4 || stub.calls[10000] != 2 || stub.calls[10002] != 2 {
+		t.Errorf("got %d ports allocated in calls %v, want 4 in 2 calls of each batch", len(allocated), stub.calls)
+	}
+}
+
+// hangingStub blocks GetStats until ctx is done, and records the calls running at most.
+type hangingStub struct {
+	rpc.SSMgrSlaveClient
+
+	mu      sync.Mutex
+	running int
+	peak    int
+}
+
+func (f *hangingStub) GetStats(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*rpc.Statistics, error) {
+	f.mu.Lock()
+	f.running++
+	if f.running > f.peak {
+		f.peak = f.running
+	}
+	f.mu.Unlock()
+
+	<-ctx.Done()
+
+	f.mu.Lock()
+	f.running--
+	f.mu.Unlock()
+	return nil, ctx.Err()
+}
+
+func TestPollStatsSkipsRunning(t *testing.T) {
+	defer func(c *Config, p *SlavePool) { config, pool = c, p }(config, pool)
+	config = &Config{}
+	hung := &hangingStub{}
+	pool = NewSlavePool(map[string]*Slave{
+		"a": newFakeSlave("a", hung),
+		"b": newFakeSlave("b", newFakeStub()),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	polled := 0
+	for result := range PollStats(ctx, 20*time.Millisecond) {
+		if result.ServerID == "b" && result.Err == nil {
+			polled++
+		}
+	}
+
+	if polled < 3 {
+		t.Errorf("got %d polls of the healthy slave, want it polled every interval", polled)
+	}
+	if hung.peak != 1 {
+		t.Errorf("got %d polls of the hung slave running at the same time, want 1", hung.peak)
+	}
+}
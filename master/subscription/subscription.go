@@ -0,0 +1,82 @@
+// Package subscription encodes the servers of a user into the subscription formats of
+// shadowsocks clients, i.e. `ss://` URIs (SIP002) and SIP008 JSON documents.
+package subscription
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Server is a shadowsocks server allocated to a user.
+type Server struct {
+	// ID identifies the server in SIP008 documents, it should be stable across updates.
+	ID       string
+	Remarks  string
+	Host     string
+	Port     int
+	Password string
+	Method   string
+}
+
+// URI returns the SIP002 `ss://` URI of the server, the user info is the url-safe base64
+// of "method:password" and the remarks is set as the fragment.
+func URI(s Server) string {
+	userinfo := base64.RawURLEncoding.EncodeToString([]byte(s.Method + ":" + s.Password))
+	u := url.URL{
+		Scheme:   "ss",
+		User:     url.User(userinfo),
+		Host:     net.JoinHostPort(s.Host, strconv.Itoa(s.Port)),
+		Fragment: s.Remarks,
+	}
+	return u.String()
+}
+
+// URIs returns the base64 encoded `ss://` URIs of servers separated by new lines, which
+// is the subscription format accepted by most clients.
+func URIs(servers []Server) string {
+	lines := make([]string, 0, len(servers))
+	for _, s := range servers {
+		lines = append(lines, URI(s))
+	}
+	return base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n")))
+}
+
+// sip008Version is the version of SIP008 documents.
+const sip008Version = 1
+
+type sip008Server struct {
+	ID         string `json:"id"`
+	Remarks    string `json:"remarks"`
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+}
+
+type sip008Document struct {
+	Version int             `json:"version"`
+	Servers []*sip008Server `json:"servers"`
+}
+
+// SIP008 returns the SIP008 JSON document of servers.
+func SIP008(servers []Server) ([]byte, error) {
+	doc := sip008Document{
+		Version: sip008Version,
+		Servers: make([]*sip008Server, 0, len(servers)),
+	}
+	for _, s := range servers {
+		doc.Servers = append(doc.Servers, &sip008Server{
+			ID:         s.ID,
+			Remarks:    s.Remarks,
+			Server:     s.Host,
+			ServerPort: s.Port,
+			Password:   s.Password,
+			Method:     s.Method,
+		})
+	}
+	return json.Marshal(&doc)
+}
@@ -0,0 +1,96 @@
+package subscription
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestURI(t *testing.T) {
+	tests := []struct {
+		server Server
+		uri    string
+	}{
+		// the example of SIP002
+		{
+			Server{Remarks: "Example1", Host: "192.168.100.1", Port: 8888, Password: "test", Method: "aes-128-gcm"},
+			"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1",
+		},
+		// url-safe base64 without padding, and the remarks escaped
+		{
+			Server{Remarks: "Tokyo 1", Host: "example.com", Port: 443, Password: "pa/ss+w0rd?", Method: "chacha20-ietf-poly1305"},
+			"ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYS9zcyt3MHJkPw@example.com:443#Tokyo%201",
+		},
+		{
+			Server{Host: "2001:db8::1", Port: 8388, Password: "pass", Method: "aes-256-gcm"},
+			"ss://YWVzLTI1Ni1nY206cGFzcw@[2001:db8::1]:8388",
+		},
+	}
+	for _, tt := range tests {
+		if got := URI(tt.server); got != tt.uri {
+			t.Errorf("got %s, want %s", got, tt.uri)
+		}
+	}
+}
+
+func TestURIs(t *testing.T) {
+	servers := []Server{
+		{Remarks: "Example1", Host: "192.168.100.1", Port: 8888, Password: "test", Method: "aes-128-gcm"},
+		{Host: "2001:db8::1", Port: 8388, Password: "pass", Method: "aes-256-gcm"},
+	}
+	want := "c3M6Ly9ZV1Z6TFRFeU9DMW5ZMjA2ZEdWemRBQDE5Mi4xNjguMTAwLjE6ODg4OCNFeGFtcGxlMQpzczovL1lXVnpMVEkxTmkxblkyMDZjR0Z6Y3dAWzIwMDE6ZGI4OjoxXTo4Mzg4"
+	if got := URIs(servers); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestSIP008(t *testing.T) {
+	servers := []Server{
+		{ID: "27b8a625-4f4b-4428-9f0f-8a2317db7c79", Remarks: "Server 1", Host: "example.com", Port: 8388,
+			Password: "test", Method: "aes-128-gcm"},
+		{ID: "7842c068-c667-41f2-8f7d-04feece3cb67", Remarks: "Server 2", Host: "10.0.0.1", Port: 8389,
+			Password: "pa\"ss", Method: "chacha20-ietf-poly1305"},
+	}
+	want := `{
+	"version": 1,
+	"servers": [
+		{
+			"id": "27b8a625-4f4b-4428-9f0f-8a2317db7c79",
+			"remarks": "Server 1",
+			"server": "example.com",
+			"server_port": 8388,
+			"password": "test",
+			"method": "aes-128-gcm"
+		},
+		{
+			"id": "7842c068-c667-41f2-8f7d-04feece3cb67",
+			"remarks": "Server 2",
+			"server": "10.0.0.1",
+			"server_port": 8389,
+			"password": "pa\"ss",
+			"method": "chacha20-ietf-poly1305"
+		}
+	]
+}`
+
+	got, err := SIP008(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, compact.Bytes()) {
+		t.Errorf("got %s, want %s", got, compact.Bytes())
+	}
+
+	// an empty list of servers rather than null
+	got, err = SIP008(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"version":1,"servers":[]}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
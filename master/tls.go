@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// clientTLSConfig builds the TLS config of the connections to slaves from flags, it's nil
+// when TLS is not enabled. The client certificate is presented to slaves requiring
+// mutual TLS.
+func clientTLSConfig() (*tls.Config, error) {
+	if len(*caFile) == 0 {
+		if len(*certFile) != 0 || len(*keyFile) != 0 {
+			return nil, errors.New("client certificate is given without the CA of slaves")
+		}
+		return nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(*caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + *caFile)
+	}
+	cfg := &tls.Config{RootCAs: pool}
+
+	if len(*certFile) != 0 || len(*keyFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testCert is a certificate with its key, signed by the parent or self-signed.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// writeFiles writes the certificate and key in pem to dir, and returns their paths.
+func (c *testCert) writeFiles(t *testing.T, dir, name string) (string, string) {
+	certFile, keyFile := path.Join(dir, name+".pem"), path.Join(dir, name+".key")
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// serveTLS starts a grpc server requiring client certificates signed by ca, and returns
+// its port.
+func serveTLS(t *testing.T, ca, server *testCert) int {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(cfg)))
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().(*net.TCPAddr).Port
+}
+
+func TestDialMutualTLS(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+	config = &Config{}
+	defer func(ca, cert, key string) {
+		*caFile, *certFile, *keyFile = ca, cert, key
+	}(*caFile, *certFile, *keyFile)
+
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "slave"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "master"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	port := serveTLS(t, ca, server)
+
+	dir := t.TempDir()
+	*caFile, _ = ca.writeFiles(t, dir, "ca")
+	*certFile, *keyFile = client.writeFiles(t, dir, "client")
+
+	dial := func() error {
+		tlsConfig, err := clientTLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		slave := newSlave(&SlaveConfig{ID: "s1", Host: "127.0.0.1", Port: port}, tlsConfig)
+		defer slave.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return slave.DialContext(ctx)
+	}
+
+	if err := dial(); err != nil {
+		t.Errorf("handshake with client certificate failed: %s", err)
+	}
+
+	// the slave rejects masters without a certificate
+	*certFile, *keyFile = "", ""
+	if err := dial(); err == nil {
+		t.Error("handshake without client certificate succeeded")
+	}
+}
+
+func TestClientTLSConfigInvalid(t *testing.T) {
+	defer func(ca, cert, key string) {
+		*caFile, *certFile, *keyFile = ca, cert, key
+	}(*caFile, *certFile, *keyFile)
+
+	dir := t.TempDir()
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	caPem, caKey := ca.writeFiles(t, dir, "ca")
+	garbage := path.Join(dir, "garbage.pem")
+	if err := ioutil.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		ca, cert, key string
+	}{
+		{"missing ca", path.Join(dir, "missing.pem"), "", ""},
+		{"ca without certificate", garbage, "", ""},
+		{"mismatched key pair", caPem, caPem, garbage},
+		{"certificate without key", caPem, caPem, ""},
+		{"certificate without ca", "", caPem, caKey},
+	}
+	for _, tt := range tests {
+		*caFile, *certFile, *keyFile = tt.ca, tt.cert, tt.key
+		if cfg, err := clientTLSConfig(); err == nil {
+			t.Errorf("%s: got config %v, want error", tt.name, cfg)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+// topologyTimeout is the timeout of collecting the topology of a slave.
+const topologyTimeout = 10 * time.Second
+
+// ServiceTopology describes a ss-server running on a slave.
+type ServiceTopology struct {
+	Port      int32  `json:"port"`
+	UserID    string `json:"user_id"`
+	Method    string `json:"method"`
+	Traffic   int64  `json:"traffic"`
+	StartTime int64  `json:"start_time"`
+}
+
+// SlaveTopology describes a slave and the services it runs.
+type SlaveTopology struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Address   string            `json:"address"`
+	Reachable bool              `json:"reachable"`
+	Latency   time.Duration     `json:"latency"`
+	Error     string            `json:"error,omitempty"`
+	PortMin   int               `json:"port_min"`
+	PortMax   int               `json:"port_max"`
+	Services  []ServiceTopology `json:"services"`
+}
+
+// ClusterTopology describes all the slaves and their services.
+type ClusterTopology struct {
+	Slaves []*SlaveTopology `json:"slaves"`
+	At     time.Time        `json:"at"`
+}
+
+// slaveTopology pings the slave and lists its services with the current stats.
+func slaveTopology(ctx context.Context, slave *Slave, users map[int]string) *SlaveTopology {
+	t := &SlaveTopology{
+		ID:       slave.Config.ID,
+		Name:     slave.String(),
+		Address:  slave.Target(),
+		PortMin:  slave.Config.PortMin,
+		PortMax:  slave.Config.PortMax,
+		Services: make([]ServiceTopology, 0),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, topologyTimeout)
+	defer cancel()
+
+	latency, err := slave.Ping(ctx)
+	if err != nil {
+		t.Error = err.Error()
+		return t
+	}
+	t.Reachable, t.Latency = true, latency
+
+	stats, err := slave.GetStats(ctx)
+	if err != nil {
+		t.Error = err.Error()
+		return t
+	}
+	for port, unit := range stats.Flow {
+		t.Services = append(t.Services, ServiceTopology{
+			Port:      port,
+			UserID:    users[int(port)],
+			Method:    unit.GetMethod(),
+			Traffic:   unit.GetTraffic(),
+			StartTime: unit.GetStartTime(),
+		})
+	}
+	sort.Slice(t.Services, func(i, j int) bool {
+		return t.Services[i].Port < t.Services[j].Port
+	})
+	return t
+}
+
+// Topology collects every slave of the pool with the services it runs and their current
+// stats, the users of services are looked up in db and the unreachable slaves are marked.
+// The slaves are queried concurrently with at most pingWorkers at the same time.
+func (p *SlavePool) Topology(ctx context.Context, db *gorm.DB) (ClusterTopology, error) {
+	var allocs []orm.Allocation
+	if err := db.Find(&allocs).Error; err != nil {
+		return ClusterTopology{}, err
+	}
+	// users of ports on each slave
+	users := make(map[string]map[int]string)
+	for _, alloc := range allocs {
+		if users[alloc.ServerID] == nil {
+			users[alloc.ServerID] = make(map[int]string)
+		}
+		users[alloc.ServerID][alloc.Port] = alloc.UserID
+	}
+
+	slaves := p.Slaves()
+	topology := ClusterTopology{
+		Slaves: make([]*SlaveTopology, 0, len(slaves)),
+		At:     time.Now(),
+	}
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, pingWorkers)
+	)
+	for id, slave := range slaves {
+		wg.Add(1)
+		go func(id string, slave *Slave) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			t := slaveTopology(ctx, slave, users[id])
+			<-sem
+
+			mu.Lock()
+			topology.Slaves = append(topology.Slaves, t)
+			mu.Unlock()
+		}(id, slave)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return ClusterTopology{}, err
+	}
+	sort.Slice(topology.Slaves, func(i, j int) bool {
+		return topology.Slaves[i].ID < topology.Slaves[j].ID
+	})
+	return topology, nil
+}
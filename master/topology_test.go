@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+func TestSlaveTopology(t *testing.T) {
+	stub := newFakeStub()
+	stub.ports[10001], stub.methods[10001], stub.flow[10001] = "x", "chacha20-ietf-poly1305", 10
+	stub.ports[10000], stub.methods[10000] = "x", "aes-256-gcm"
+
+	topo := slaveTopology(context.Background(), newFakeSlave("s", stub), map[int]string{10000: "u"})
+	if !topo.Reachable {
+		t.Fatalf("slave is unreachable: %s", topo.Error)
+	}
+	want := []ServiceTopology{
+		{Port: 10000, UserID: "u", Method: "aes-256-gcm"},
+		{Port: 10001, Method: "chacha20-ietf-poly1305", Traffic: 10},
+	}
+	if len(topo.Services) != len(want) {
+		t.Fatalf("got services %+v, want %+v", topo.Services, want)
+	}
+	for i := range want {
+		if topo.Services[i] != want[i] {
+			t.Errorf("service %d: got %+v, want %+v", i, topo.Services[i], want[i])
+		}
+	}
+}
+
+func TestPoolTopology(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.Create(&orm.Allocation{UserID: "u", ServerID: "b", Port: 10000}).Error; err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := newFakeStub(), newFakeStub(), newFakeStub()
+	a.setDown(true)
+	b.ports[10000], b.methods[10000], b.flow[10000] = "x", "aes-256-gcm", 100
+	p := NewSlavePool(map[string]*Slave{
+		"c": newFakeSlave("c", c),
+		"a": newFakeSlave("a", a),
+		"b": newFakeSlave("b", b),
+	})
+
+	topo, err := p.Topology(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, s := range topo.Slaves {
+		ids = append(ids, s.ID)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got slaves %v, want %v", ids, want)
+	}
+
+	if down := topo.Slaves[0]; down.Reachable || len(down.Error) == 0 || len(down.Services) != 0 {
+		t.Errorf("got down slave %+v, want it unreachable with the error", down)
+	}
+	want := []ServiceTopology{{Port: 10000, UserID: "u", Method: "aes-256-gcm", Traffic: 100}}
+	if up := topo.Slaves[1]; !up.Reachable || !reflect.DeepEqual(up.Services, want) {
+		t.Errorf("got slave %+v, want services %+v", up, want)
+	}
+	if empty := topo.Slaves[2]; !empty.Reachable || empty.Services == nil {
+		t.Errorf("got slave %+v, want it reachable with empty services", empty)
+	}
+}
@@ -6,10 +6,11 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
 	"github.com/satori/go.uuid"
 
 	"github.com/arkbriar/ssmgr/master/orm"
-	rpc "github.com/arkbriar/ssmgr/protocol"
+	"github.com/arkbriar/ssmgr/master/subscription"
 )
 
 func CreateUser(email string) *orm.User {
@@ -36,7 +37,7 @@ func CreateUser(email string) *orm.User {
 
 func ChangeUserGroup(userID, groupID string) error {
 	var user orm.User
-	db.First(&user)
+	db.Where("id = ?", userID).First(&user)
 	if user.ID == "" {
 		return fmt.Errorf("User not found: %s", userID)
 	}
@@ -44,9 +45,12 @@ func ChangeUserGroup(userID, groupID string) error {
 	if group == nil {
 		return fmt.Errorf("Group not found: %s", groupID)
 	}
-	user.Group = groupID
-	user.Expired = time.Unix(user.Time, 0).Add(time.Duration(defaultGroup.Config.Limit.Time) * time.Hour).Unix()
-	user.QuotaFlow = group.Config.Limit.Flow * 1024 * 1024
+	if err := db.Model(&orm.User{}).Where("id = ?", userID).Update("group", groupID).Error; err != nil {
+		return err
+	}
+	if err := orm.ApplyGroupDefaults(db, userID); err != nil {
+		return err
+	}
 	// Let the daemon routine check whether to remove user (set disable = 1)
 
 	go func() {
@@ -54,8 +58,7 @@ func ChangeUserGroup(userID, groupID string) error {
 		allocateForUser(userID, groupID)
 	}()
 
-	err := db.Debug().Save(&user).Error
-	return err
+	return nil
 }
 
 func RemoveUser(userIDs ...string) {
@@ -113,8 +116,8 @@ func allocateForUser(userID, groupID string) {
 }
 
 func allocateServerToUser(userID, serverID string) error {
-	slave := slaves[serverID]
-	if slave == nil {
+	slave, ok := pool.Get(serverID)
+	if !ok {
 		return fmt.Errorf("Server '%s' not found", serverID)
 	}
 	port, password, err := findOrInitAllocation(userID, serverID)
@@ -124,19 +127,30 @@ func allocateServerToUser(userID, serverID string) error {
 
 	logrus.Debugf("Allocate for user %s on server %s: Port %d, Password: %s",
 		userID, serverID, port, password)
-	_, err = slave.stub.Allocate(slave.ctx, &rpc.AllocateRequest{
-		Port:     int32(port),
-		Password: password,
-		Method:   "aes-256-cfb", // const
-	})
+	generated, err := slave.Allocate(port, password, userID)
 	if err != nil {
 		return fmt.Errorf("Failed to allocate port: %s", err.Error())
 	}
+	if generated != password {
+		savePassword(userID, serverID, generated)
+	}
 	return nil
 }
 
+// savePassword persists the password generated by slave.
+func savePassword(userID, serverID, password string) {
+	db.Model(&orm.Allocation{}).Where(&orm.Allocation{
+		UserID:   userID,
+		ServerID: serverID,
+	}).Update("password", password)
+}
+
 func findOrInitAllocation(userID, serverID string) (int, string, error) {
-	serverConfig := slaves[serverID].Config
+	slave, ok := pool.Get(serverID)
+	if !ok {
+		return 0, "", fmt.Errorf("Server '%s' not found", serverID)
+	}
+	serverConfig := slave.Config
 
 	var allocation orm.Allocation
 	db.Where(&orm.Allocation{
@@ -147,48 +161,71 @@ func findOrInitAllocation(userID, serverID string) (int, string, error) {
 	if allocation.Port == 0 {
 		// Not record is found in allocation table.
 		// Search for an empty port and write into allocation table.
-		var allocated []orm.Allocation
-		db.Where(&orm.Allocation{
-			ServerID: serverID,
-		}).Find(&allocated)
-
-		ports := make([]bool, 65536)
-		for _, alloc := range allocated {
-			ports[alloc.Port] = true
-		}
-
-		var empty int
-		for i := serverConfig.PortMin; i <= serverConfig.PortMax; i++ {
-			if ports[i] == false {
-				empty = i
-				break
-			}
-		}
-
-		if empty == 0 {
+		empty, err := findEmptyPort(db, serverConfig)
+		if err != nil {
 			// TODO: this error should be told to user or manager
-			return 0, "", fmt.Errorf("no port is available in %s", serverID)
+			return 0, "", err
 		}
 
+		// password is left empty to be generated by the slave
 		allocation.Port = empty
-		allocation.Password = RandomPassword()
 		db.Save(&allocation)
 	}
 
 	return allocation.Port, allocation.Password, nil
 }
 
+// findEmptyPort finds a port in the port range of the slave that's not allocated to anyone.
+func findEmptyPort(db *gorm.DB, serverConfig *SlaveConfig) (int, error) {
+	var allocated []orm.Allocation
+	db.Where(&orm.Allocation{
+		ServerID: serverConfig.ID,
+	}).Find(&allocated)
+
+	ports := make([]bool, 65536)
+	for _, alloc := range allocated {
+		ports[alloc.Port] = true
+	}
+
+	for i := serverConfig.PortMin; i <= serverConfig.PortMax; i++ {
+		if ports[i] == false {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no port is available in %s", serverConfig.ID)
+}
+
 func FreeAllocation(serverID string, port int) error {
-	slave := slaves[serverID]
-	if slave == nil {
+	slave, ok := pool.Get(serverID)
+	if !ok {
 		return fmt.Errorf("Server '%s' not found", serverID)
 	}
 
-	_, err := slave.stub.Free(slave.ctx, &rpc.FreeRequest{
-		Port: int32(port),
-	})
+	return slave.Free(port)
+}
+
+// userSubscription returns the servers allocated to the user for subscription, the
+// allocations on slaves not configured are skipped.
+func userSubscription(userID string) ([]subscription.Server, error) {
+	allocs, err := orm.AllocationsByUser(db, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+
+	servers := make([]subscription.Server, 0, len(allocs))
+	for _, alloc := range allocs {
+		slave, ok := pool.Get(alloc.ServerID)
+		if !ok {
+			continue
+		}
+		servers = append(servers, subscription.Server{
+			ID:       alloc.ServerID,
+			Remarks:  slave.String(),
+			Host:     slave.Config.Host,
+			Port:     alloc.Port,
+			Password: alloc.Password,
+			Method:   allocateMethod,
+		})
+	}
+	return servers, nil
 }
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"strings"
 	"time"
@@ -13,8 +12,10 @@ import (
 	"github.com/asaskevich/govalidator"
 	"github.com/kataras/go-mailer"
 	"github.com/kataras/iris"
+	"golang.org/x/net/context"
 
 	"github.com/arkbriar/ssmgr/master/orm"
+	"github.com/arkbriar/ssmgr/master/subscription"
 )
 
 const verifyCodeExpire = 300
@@ -45,6 +46,8 @@ func NewApp(webroot string) *iris.Framework {
 	app.Post("/flow", handleFlow)
 	app.Post("/group", handleGroup)
 	app.Put("/user", handleUserPut)
+	app.Post("/topology", handleTopology)
+	app.Post("/subscription", handleSubscription)
 
 	app.Get("/*path", func(ctx *iris.Context) {
 		path := ctx.Param("path")
@@ -78,16 +81,15 @@ func handleEmail(ctx *iris.Context) {
 	}
 
 	// Prevent send to one email addr for too many times
-	var sentCount int
-	timeFrom := time.Now().Add(-verifyCodeExpire * time.Second).Unix()
-	db.Model(&orm.VerifyCode{}).Where("email = ? AND time > ?", request.Email, timeFrom).Count(&sentCount)
-	if sentCount >= 3 {
+	vcode, err := orm.IssueVerifyCode(db, request.Email, verifyCodeExpire*time.Second, time.Now().Unix())
+	if err == orm.ErrVerifyCodeTooFrequent {
 		ctx.SetStatusCode(iris.StatusForbidden)
 		ctx.WriteString("sent too many times")
 		return
 	}
-
-	vcode := fmt.Sprintf("%06d", rand.Int31n(1000000))
+	if err != nil {
+		panic(err.Error())
+	}
 	logrus.Infof("Send verify code to %s: %s", request.Email, vcode)
 
 	content := fmt.Sprintf("Your verify code is %s.\n", vcode)
@@ -98,12 +100,6 @@ func handleEmail(ctx *iris.Context) {
 		}
 	}()
 
-	db.Save(&orm.VerifyCode{
-		Email: request.Email,
-		Code:  vcode,
-		Time:  time.Now().Unix(),
-	})
-
 	ctx.WriteString("success")
 }
 
@@ -121,10 +117,11 @@ func handleCode(ctx *iris.Context) {
 		return
 	}
 
-	var records []orm.VerifyCode
-	timeFrom := time.Now().Add(-verifyCodeExpire * time.Second).Unix()
-	db.Where("email = ? AND code = ? AND time > ?", request.Email, request.Code, timeFrom).Find(&records)
-	if len(records) == 0 {
+	ok, err := orm.CheckVerifyCode(db, request.Email, request.Code, time.Now().Unix())
+	if err != nil {
+		panic(err.Error())
+	}
+	if !ok {
 		ctx.SetStatusCode(iris.StatusForbidden)
 		ctx.WriteString("login failed")
 		return
@@ -165,11 +162,13 @@ func handleAccount(ctx *iris.Context) {
 
 	var (
 		user    orm.User
-		allocs  []orm.Allocation
 		flowSum []struct{ Flow int64 }
 	)
 	db.Where("id = ?", request.UserID).First(&user)
-	db.Where("user_id = ?", request.UserID).Find(&allocs)
+	allocs, err := orm.AllocationsByUser(db, request.UserID)
+	if err != nil {
+		logrus.Errorf("Failed to query allocations of user %s: %s", request.UserID, err.Error())
+	}
 	db.Raw("SELECT sum(flow) AS flow FROM flow_record WHERE user_id = ?", request.UserID).Scan(&flowSum)
 
 	type serverInfo struct {
@@ -181,8 +180,8 @@ func handleAccount(ctx *iris.Context) {
 	servers := make([]*serverInfo, 0, len(allocs))
 
 	for _, alloc := range allocs {
-		slave := slaves[alloc.ServerID]
-		if slave == nil {
+		slave, ok := pool.Get(alloc.ServerID)
+		if !ok {
 			logrus.Warnf("Server '%s' does not exist", alloc.ServerID)
 			continue
 		}
@@ -215,7 +214,7 @@ func handleAccount(ctx *iris.Context) {
 		Expired:     user.Expired * 1000,
 		Disabled:    user.Disabled,
 		Servers:     servers,
-		Method:      "aes-256-cfb",
+		Method:      allocateMethod,
 	})
 }
 
@@ -403,3 +402,59 @@ func handleUserPut(ctx *iris.Context) {
 		return
 	}
 }
+
+func handleSubscription(ctx *iris.Context) {
+	var request struct {
+		UserID string `json:"address" valid:"length(32|32)"`
+		// "sip008" or "ss", ss by default
+		Format string `json:"format"`
+	}
+	if err := ctx.ReadJSON(&request); err != nil {
+		panic(err.Error())
+	}
+	if _, err := govalidator.ValidateStruct(&request); err != nil {
+		ctx.WriteString(err.Error())
+		return
+	}
+
+	isLogin := ctx.Session().GetString("user_id") == request.UserID
+	if !isLogin && !isAdmin(ctx) {
+		ctx.SetStatusCode(iris.StatusForbidden)
+		ctx.WriteString("please login first")
+		return
+	}
+
+	servers, err := userSubscription(request.UserID)
+	if err != nil {
+		panic(err)
+	}
+
+	switch request.Format {
+	case "sip008":
+		doc, err := subscription.SIP008(servers)
+		if err != nil {
+			panic(err)
+		}
+		ctx.SetHeader("Content-Type", "application/json")
+		ctx.Write(doc)
+	case "", "ss":
+		ctx.WriteString(subscription.URIs(servers))
+	default:
+		ctx.SetStatusCode(iris.StatusBadRequest)
+		ctx.WriteString("unknown format")
+	}
+}
+
+func handleTopology(ctx *iris.Context) {
+	if !isAdmin(ctx) {
+		ctx.SetStatusCode(iris.StatusUnauthorized)
+		ctx.WriteString("please login first")
+		return
+	}
+
+	topology, err := pool.Topology(context.Background(), db)
+	if err != nil {
+		panic(err)
+	}
+	ctx.JSON(iris.StatusOK, topology)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	ss "github.com/arkbriar/ssmgr/slave/shadowsocks"
+	"github.com/arkbriar/ssmgr/slave/shadowsocks/metrics"
+)
+
+// serveMetrics serves the prometheus metrics of servers on addr in background.
+func serveMetrics(addr string, mgr ss.Manager) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector(mgr))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go func() {
+		log.Infof("Serving metrics on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("Failed to serve metrics: %s", err.Error())
+		}
+	}()
+}
@@ -2,7 +2,8 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,8 +11,11 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	cfg "github.com/arkbriar/ssmgr/config"
 	proto "github.com/arkbriar/ssmgr/protocol"
 	slave "github.com/arkbriar/ssmgr/slave"
 	ss "github.com/arkbriar/ssmgr/slave/shadowsocks"
@@ -24,56 +28,41 @@ var (
 	verbose = flag.Bool("v", false, "Verbose mode")
 )
 
+// monitorInterval is the interval of checking dead servers.
+const monitorInterval = 5 * time.Second
+
 func validPort(p int) bool {
 	return p > 0 && p < 65536
 }
 
-type slaveConfig struct {
-	Port    int    `json:"port,omitemtpy"`
-	MgrPort int    `json:"manager_port,omitempty"`
-	Token   string `json:"token"`
-	TLS     *struct {
-		CertFile string `json:"cert_file"`
-		KeyFile  string `json:"key_file"`
-	} `json:"tls,omitempty"`
-}
+type slaveConfig = cfg.Slave
 
-// Global configuration object
-var conf *slaveConfig
-
-func parseConfig(filename string) (*slaveConfig, error) {
-	d, err := ioutil.ReadFile(filename)
+// serverTLSConfig builds the TLS config of rpc server, client certificates are required
+// if the client CA is configured.
+func serverTLSConfig(c *slaveConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
 	if err != nil {
 		return nil, err
 	}
-	c := &slaveConfig{Port: 8001, MgrPort: 6001}
-	if err := json.Unmarshal(d, c); err != nil {
-		return nil, err
-	}
-	return c, nil
-}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
 
-func checkConfig(c *slaveConfig) error {
-	if len(c.Token) == 0 {
-		return errors.New("invalid token")
+	if len(c.TLS.ClientCAFile) != 0 {
+		pem, err := ioutil.ReadFile(c.TLS.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.TLS.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-	return nil
+	return cfg, nil
 }
 
-func init() {
-	flag.Parse()
-	if c, err := parseConfig(*config); err != nil {
-		log.Fatal(err)
-	} else {
-		conf = c
-	}
-	if err := checkConfig(conf); err != nil {
-		log.Fatal(err)
-	}
-	if *verbose {
-		log.SetLevel(log.DebugLevel)
-	}
-}
+// Global configuration object
+var conf *slaveConfig
 
 func run(ctx context.Context) error {
 	select {
@@ -82,15 +71,41 @@ func run(ctx context.Context) error {
 	default:
 	}
 
-	mgr := ss.NewManager(conf.MgrPort)
+	opts := []ss.Option{
+		ss.WithDefaultTimeout(conf.Timeout),
+		ss.WithDefaultNameServer(conf.DNS),
+		ss.WithMaxPortsPerUser(conf.UserPorts),
+		ss.WithStaleThreshold(time.Duration(conf.StaleAfter)*time.Second, conf.RestartStale),
+		ss.WithBinary(conf.Binary),
+		ss.WithDataPath(conf.DataPath),
+		ss.WithConnectionCount(conf.CountConnections),
+		ss.WithAdminToken(conf.AdminToken),
+	}
+	if conf.PortMin > 0 && conf.PortMax > 0 {
+		opts = append(opts, ss.WithPortRange(conf.PortMin, conf.PortMax))
+	}
+	mgr := ss.NewManagerWithAddr(conf.MgrAddr, conf.MgrPort, opts...)
 	if err := mgr.Listen(context.Background()); err != nil {
 		return err
 	}
 
-	token := conf.Token
+	// rpc calls are logged at debug level by default
+	rpcLogLevel, err := log.ParseLevel(conf.RPCLog)
+	if err != nil {
+		rpcLogLevel = log.DebugLevel
+	}
+
+	// the token is mapped to the default namespace
+	tokens := map[string]string{conf.Token: ""}
+	for token, ns := range conf.Tenants {
+		tokens[token] = ns
+	}
 	serverOpts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(slave.UnaryAuthInterceptor(token)),
-		grpc.StreamInterceptor(slave.StreamAuthInterceptor(token)),
+		grpc.UnaryInterceptor(slave.ChainUnaryInterceptors(
+			slave.UnaryLoggingInterceptor(rpcLogLevel),
+			slave.UnaryNamespaceInterceptor(tokens),
+		)),
+		grpc.StreamInterceptor(slave.StreamNamespaceInterceptor(tokens)),
 	}
 
 	// enable grpc channel with credentials
@@ -98,15 +113,18 @@ func run(ctx context.Context) error {
 	if conf.TLS != nil {
 		log.Info("Encrypting grpc channel with TLS")
 
-		cred, err := credentials.NewServerTLSFromFile(conf.TLS.CertFile, conf.TLS.KeyFile)
+		cfg, err := serverTLSConfig(conf)
 		if err != nil {
 			return err
 		}
-		serverOpts = append(serverOpts, grpc.Creds(cred))
+		if cfg.ClientAuth == tls.RequireAndVerifyClientCert {
+			log.Info("Verifying client certificates of masters")
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(cfg)))
 	}
 
 	s := grpc.NewServer(serverOpts...)
-	proto.RegisterSSMgrSlaveServer(s, slave.NewSSMgrSlaveServer(token, mgr))
+	proto.RegisterSSMgrSlaveServer(s, slave.NewSSMgrSlaveServer(conf.Token, mgr))
 
 	// listen and do the restoration
 
@@ -114,10 +132,37 @@ func run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	// fail early rather than on every allocation
+	if err := mgr.CheckWritable(); err != nil {
+		return err
+	}
+	if err := mgr.SelfCheck(); err != nil {
+		return err
+	}
 	err = mgr.Restore()
 	if err != nil {
 		log.Warn(err)
 	}
+	mgr.StartMonitor(ctx, monitorInterval)
+
+	// start admin http server, which serves health of slave
+
+	var serving int32
+	mgr.RegisterHealthCheck("grpc", func() error {
+		if atomic.LoadInt32(&serving) == 0 {
+			return errors.New("grpc server is not serving")
+		}
+		return nil
+	})
+	if len(conf.AdminAddr) != 0 {
+		if err := mgr.ServeHTTP(conf.AdminAddr); err != nil {
+			return err
+		}
+	}
+
+	if len(conf.MetricsAddr) != 0 {
+		serveMetrics(conf.MetricsAddr, mgr)
+	}
 
 	// start rpc server
 
@@ -125,12 +170,17 @@ func run(ctx context.Context) error {
 	go func() {
 		log.Infof("Starting server on 0.0.0.0:%d", conf.Port)
 
+		atomic.StoreInt32(&serving, 1)
 		errc <- s.Serve(conn)
+		atomic.StoreInt32(&serving, 0)
 	}()
 	select {
 	case <-ctx.Done():
 		s.GracefulStop()
 		mgr.CleanUp()
+		if err := mgr.Close(); err != nil {
+			log.Warn(err)
+		}
 
 		log.Info("Graceful shutdown")
 
@@ -141,6 +191,16 @@ func run(ctx context.Context) error {
 }
 
 func main() {
+	flag.Parse()
+	if c, err := cfg.LoadSlave(*config); err != nil {
+		log.Fatal(err)
+	} else {
+		conf = c
+	}
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	go func() {
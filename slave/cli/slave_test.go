@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by the parent or self-signed.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// writeFiles writes the certificate and key in pem to dir, and returns their paths.
+func (c *testCert) writeFiles(t *testing.T, dir, name string) (string, string) {
+	certFile, keyFile := path.Join(dir, name+".pem"), path.Join(dir, name+".key")
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// tlsConfigOf builds the TLS config of rpc server from the tls field of config json.
+func tlsConfigOf(t *testing.T, tlsJSON string) (*tls.Config, error) {
+	c := &slaveConfig{}
+	if err := json.Unmarshal([]byte(`{"token": "t", "tls": `+tlsJSON+`}`), c); err != nil {
+		t.Fatal(err)
+	}
+	return serverTLSConfig(c)
+}
+
+// serveTLS accepts the connections with cfg and writes "ok" to those passing the
+// handshake, and returns the address.
+func serveTLS(t *testing.T, cfg *tls.Config) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if err := conn.(*tls.Conn).Handshake(); err == nil {
+				conn.Write([]byte("ok"))
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "slave"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "master"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	dir := t.TempDir()
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	certFile, keyFile := server.writeFiles(t, dir, "server")
+	cfg, err := tlsConfigOf(t, `{"cert_file": "`+certFile+`", "key_file": "`+keyFile+`", "client_ca_file": "`+caFile+`"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, cfg)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certs ...tls.Certificate) error {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: certs})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// the client certificate is verified after the handshake of client in TLS 1.3
+		_, err = ioutil.ReadAll(conn)
+		return err
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{client.cert.Raw}, PrivateKey: client.key}
+	if err := dial(cert); err != nil {
+		t.Errorf("handshake with client certificate failed: %s", err)
+	}
+	if err := dial(); err == nil {
+		t.Error("handshake without client certificate succeeded")
+	}
+
+	// invalid files fail the config
+	for _, tlsJSON := range []string{
+		`{"cert_file": "` + path.Join(dir, "missing.pem") + `", "key_file": "` + keyFile + `"}`,
+		`{"cert_file": "` + certFile + `", "key_file": "` + keyFile + `", "client_ca_file": "` + keyFile + `"}`,
+	} {
+		if _, err := tlsConfigOf(t, tlsJSON); err == nil {
+			t.Errorf("%s: got no error", tlsJSON)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package slave
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Namespaces isolate the servers allocated by different masters sharing a slave, each
+// master is given its own token which is mapped to a namespace.
+
+type namespaceKey struct{}
+
+// namespaceOf returns the namespace of the authorized call.
+func namespaceOf(ctx context.Context) string {
+	ns, _ := ctx.Value(namespaceKey{}).(string)
+	return ns
+}
+
+// authorizeNamespace returns the namespace of the token in metadata.
+func authorizeNamespace(ctx context.Context, tokens map[string]string) (string, error) {
+	md, ok := metadata.FromContext(ctx)
+	if !ok {
+		return "", errors.New("empty metadata")
+	}
+	if len(md["token"]) > 0 {
+		if ns, ok := tokens[md["token"][0]]; ok {
+			return ns, nil
+		}
+	}
+	return "", errors.New("access denied")
+}
+
+// namespacedStream overrides the context of stream with the one carrying namespace.
+type namespacedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *namespacedStream) Context() context.Context {
+	return s.ctx
+}
+
+// StreamNamespaceInterceptor returns an interceptor to do authorization for grpc stream
+// call, tokens maps the accepted tokens to their namespaces.
+func StreamNamespaceInterceptor(tokens map[string]string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ns, err := authorizeNamespace(stream.Context(), tokens)
+		if err != nil {
+			return err
+		}
+		ctx := context.WithValue(stream.Context(), namespaceKey{}, ns)
+		return handler(srv, &namespacedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// UnaryNamespaceInterceptor returns an interceptor to do authorization for grpc unary
+// call, tokens maps the accepted tokens to their namespaces.
+func UnaryNamespaceInterceptor(tokens map[string]string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ns, err := authorizeNamespace(ctx, tokens)
+		if err != nil {
+			return nil, err
+		}
+		return handler(context.WithValue(ctx, namespaceKey{}, ns), req)
+	}
+}
@@ -2,13 +2,16 @@ package slave
 
 import (
 	"errors"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/arkbriar/ssmgr/internal/trace"
 	proto "github.com/arkbriar/ssmgr/protocol"
 	ss "github.com/arkbriar/ssmgr/slave/shadowsocks"
 	google_protobuf "github.com/golang/protobuf/ptypes/empty"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -57,34 +60,245 @@ func UnaryAuthInterceptor(token string) grpc.UnaryServerInterceptor {
 	}
 }
 
-func (s *server) Allocate(ctx context.Context, r *proto.AllocateRequest) (*google_protobuf.Empty, error) {
+// UnaryLoggingInterceptor returns an interceptor which logs the method, duration and
+// outcome of each grpc unary call with the request id sent by master.
+func UnaryLoggingInterceptor(level log.Level) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+
+		entry := log.WithFields(log.Fields{
+			"method":     info.FullMethod,
+			"request_id": trace.FromContext(ctx),
+			"duration":   time.Since(start),
+			"code":       grpc.Code(err),
+		})
+		if err != nil {
+			entry.Warnf("RPC failed: %s", err)
+		} else {
+			trace.Log(entry, level, "RPC done")
+		}
+		return resp, err
+	}
+}
+
+// ChainUnaryInterceptors composes the interceptors into one, the first is the outermost.
+func ChainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
+// newServer creates the server to allocate, a password is generated when it's not given.
+func newServer(ctx context.Context, r *proto.AllocateRequest) (*ss.Server, error) {
 	server := &ss.Server{
-		Host:     "0.0.0.0",
-		Port:     r.GetPort(),
-		Password: r.GetPassword(),
-		Method:   r.GetMethod(),
-		Timeout:  60,
+		Host:      "0.0.0.0",
+		Port:      r.GetPort(),
+		Password:  r.GetPassword(),
+		Method:    r.GetMethod(),
+		UserID:    r.GetUserId(),
+		Quota:     r.GetQuota(),
+		Namespace: namespaceOf(ctx),
+	}
+
+	if len(server.Password) == 0 {
+		password, err := ss.RandomPassword()
+		if err != nil {
+			return nil, err
+		}
+		server.Password = password
 	}
+	return server, nil
+}
 
+// add adds the server, a free port is chosen if the port is 0.
+func (s *server) add(ctx context.Context, server *ss.Server) error {
+	if server.Port != 0 {
+		return s.mgr.AddContext(ctx, server)
+	}
+
+	port, err := s.mgr.AllocateInRange(server)
+	if errors.Is(err, ss.ErrNoPortAvailable) {
+		return grpc.Errorf(codes.ResourceExhausted, "no port available in the port range")
+	}
+	if err != nil {
+		return err
+	}
+	server.Port = port
+	return nil
+}
+
+// allocated returns the server allocated by the same request before, so the request
+// retried by master succeeds. A request without password never matches, as the password
+// generated for it is unknown to master.
+func (s *server) allocated(ctx context.Context, r *proto.AllocateRequest) (*ss.Server, bool) {
+	if r.GetPort() == 0 || len(r.GetPassword()) == 0 {
+		return nil, false
+	}
+	old, err := s.mgr.GetServer(r.GetPort())
+	if err != nil || old.Namespace != namespaceOf(ctx) {
+		return nil, false
+	}
+	if old.Password != r.GetPassword() || old.Method != r.GetMethod() || old.UserID != r.GetUserId() {
+		return nil, false
+	}
+	return old, true
+}
+
+// allocate adds the server of the request, it succeeds if the same server exists. The
+// port taken with different credentials is reported as AlreadyExists.
+func (s *server) allocate(ctx context.Context, r *proto.AllocateRequest, server *ss.Server) (*ss.Server, error) {
+	err := s.add(ctx, server)
+	if errors.Is(err, ss.ErrServerExists) {
+		if old, ok := s.allocated(ctx, r); ok {
+			log.Debugf("Server on port %d is already allocated", r.GetPort())
+			return old, nil
+		}
+		return nil, grpc.Errorf(codes.AlreadyExists, "port %d is allocated with different credentials", r.GetPort())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// allocateAtomic adds all the servers of the requests or none of them. The servers
+// allocated by the same requests before are kept and returned as well.
+func (s *server) allocateAtomic(ctx context.Context, reqs []*proto.AllocateRequest, servers []*ss.Server) ([]*ss.Server, error) {
+	var added []*ss.Server
+	for i, server := range servers {
+		if old, ok := s.allocated(ctx, reqs[i]); ok {
+			log.Debugf("Server on port %d is already allocated", old.Port)
+			servers[i] = old
+			continue
+		}
+		added = append(added, server)
+	}
+	err := s.mgr.AddAtomic(added...)
+	if errors.Is(err, ss.ErrServerExists) {
+		return nil, grpc.Errorf(codes.AlreadyExists, "%s", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+func (s *server) Allocate(ctx context.Context, r *proto.AllocateRequest) (*proto.AllocateResponse, error) {
 	log.Debugf("Recv allocate request: %v", r)
 
-	return &google_protobuf.Empty{}, s.mgr.Add(server)
+	server, err := newServer(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	if server, err = s.allocate(ctx, r, server); err != nil {
+		return nil, err
+	}
+	return &proto.AllocateResponse{
+		Port:     server.Port,
+		Password: server.Password,
+	}, nil
+}
+
+func (s *server) AllocateBatch(ctx context.Context, r *proto.AllocateBatchRequest) (*proto.AllocateBatchResponse, error) {
+	log.Debugf("Recv allocate batch request: %v", r)
+
+	servers := make([]*ss.Server, 0, len(r.GetRequests()))
+	for _, req := range r.GetRequests() {
+		server, err := newServer(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	resp := &proto.AllocateBatchResponse{
+		Failed: make(map[int32]string),
+	}
+	if r.GetAtomic() {
+		var err error
+		if servers, err = s.allocateAtomic(ctx, r.GetRequests(), servers); err != nil {
+			return nil, err
+		}
+	}
+	for i, server := range servers {
+		if !r.GetAtomic() {
+			var err error
+			if server, err = s.allocate(ctx, r.GetRequests()[i], server); err != nil {
+				resp.Failed[servers[i].Port] = err.Error()
+				continue
+			}
+		}
+		resp.Allocated = append(resp.Allocated, &proto.AllocateResponse{
+			Port:     server.Port,
+			Password: server.Password,
+		})
+	}
+	return resp, nil
 }
 
 func (s *server) Free(ctx context.Context, r *proto.FreeRequest) (*google_protobuf.Empty, error) {
 	log.Debugf("Recv free request: %v", r)
 
-	return &google_protobuf.Empty{}, s.mgr.Remove(r.GetPort())
+	if _, err := s.getServer(ctx, r.GetPort()); err != nil {
+		return nil, err
+	}
+	drainTimeout := time.Duration(r.GetDrainTimeout()) * time.Second
+	return &google_protobuf.Empty{}, s.mgr.RemoveWithDrain(r.GetPort(), drainTimeout)
 }
 
-func (s *server) GetStats(ctx context.Context, _ *google_protobuf.Empty) (*proto.Statistics, error) {
-	log.Debugf("Recv get stat request")
+// getServer gets the server of port in the namespace of call, servers in other namespaces
+// are invisible.
+func (s *server) getServer(ctx context.Context, port int32) (*ss.Server, error) {
+	server, err := s.mgr.GetServer(port)
+	if errors.Is(err, ss.ErrServerNotFound) || (err == nil && server.Namespace != namespaceOf(ctx)) {
+		return nil, grpc.Errorf(codes.NotFound, "server on port %d not found", port)
+	}
+	return server, err
+}
+
+// unixNano returns t in unix nano, or 0 if t is zero.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
 
+// startTime returns the start time of server in unix nano, or 0 if it's never started.
+func startTime(server *ss.Server) int64 {
+	if server.Extra == nil {
+		return 0
+	}
+	return server.Extra.StartTime.UnixNano()
+}
+
+// statistics collects the statistics of all servers in the namespace of call.
+func (s *server) statistics(ctx context.Context) *proto.Statistics {
 	flow := make(map[int32]*proto.FlowUnit)
 	for port, server := range s.mgr.ListServers() {
+		if server.Namespace != namespaceOf(ctx) {
+			continue
+		}
+		stat := server.GetStat()
+		cpu, rss := server.ResourceUsage()
 		flow[port] = &proto.FlowUnit{
-			Traffic:   server.GetStat().Traffic,
-			StartTime: server.Extra.StartTime.UnixNano(),
+			Traffic:     stat.Traffic,
+			StartTime:   startTime(server),
+			LastStatAt:  unixNano(stat.UpdatedAt),
+			CpuPercent:  cpu,
+			RssBytes:    rss,
+			Rx:          stat.Rx,
+			Tx:          stat.Tx,
+			Connections: int64(stat.Connections),
+			Method:      server.Method,
 		}
 	}
 
@@ -92,5 +306,104 @@ func (s *server) GetStats(ctx context.Context, _ *google_protobuf.Empty) (*proto
 
 	return &proto.Statistics{
 		Flow: flow,
+	}
+}
+
+func (s *server) GetStats(ctx context.Context, _ *google_protobuf.Empty) (*proto.Statistics, error) {
+	log.Debugf("Recv get stat request")
+
+	return s.statistics(ctx), nil
+}
+
+func (s *server) GetStat(ctx context.Context, r *proto.StatRequest) (*proto.FlowUnit, error) {
+	log.Debugf("Recv get stat request: %v", r)
+
+	server, err := s.getServer(ctx, r.GetPort())
+	if err != nil {
+		return nil, err
+	}
+	stat := server.GetStat()
+	cpu, rss := server.ResourceUsage()
+	return &proto.FlowUnit{
+		Traffic:     stat.Traffic,
+		StartTime:   startTime(server),
+		LastStatAt:  unixNano(stat.UpdatedAt),
+		CpuPercent:  cpu,
+		RssBytes:    rss,
+		Rx:          stat.Rx,
+		Tx:          stat.Tx,
+		Connections: int64(stat.Connections),
+		Method:      server.Method,
 	}, nil
 }
+
+func (s *server) StreamStats(r *proto.StreamStatsRequest, stream proto.SSMgrSlave_StreamStatsServer) error {
+	log.Debugf("Recv stream stats request: %v", r)
+
+	interval := time.Duration(r.GetInterval()) * time.Second
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := stream.Send(s.statistics(stream.Context())); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *server) Ping(ctx context.Context, _ *google_protobuf.Empty) (*google_protobuf.Empty, error) {
+	return &google_protobuf.Empty{}, nil
+}
+
+func (s *server) SupportedMethods(ctx context.Context, _ *google_protobuf.Empty) (*proto.MethodList, error) {
+	log.Debugf("Recv supported methods request")
+
+	methods := make([]*proto.Method, 0)
+	for _, m := range s.mgr.SupportedMethods() {
+		methods = append(methods, &proto.Method{
+			Name:       m.Name,
+			Aead:       m.AEAD,
+			Deprecated: m.Deprecated,
+		})
+	}
+
+	return &proto.MethodList{
+		Methods: methods,
+	}, nil
+}
+
+func (s *server) QuotaEvents(_ *google_protobuf.Empty, stream proto.SSMgrSlave_QuotaEventsServer) error {
+	log.Debugf("Recv quota events request")
+
+	events, cancel := s.mgr.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-events:
+			if e.Type != ss.EventQuotaExceeded || e.Namespace != namespaceOf(stream.Context()) {
+				continue
+			}
+			err := stream.Send(&proto.QuotaEvent{
+				UserId:     e.UserID,
+				Port:       e.Port,
+				UsedBytes:  e.UsedBytes,
+				LimitBytes: e.LimitBytes,
+				At:         e.At.UnixNano(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package slave
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/arkbriar/ssmgr/protocol"
+	ss "github.com/arkbriar/ssmgr/slave/shadowsocks"
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// fakeHandle is a ss-server run by fakeSupervisor.
+type fakeHandle struct{}
+
+func (h *fakeHandle) Pid() int {
+	return -1
+}
+
+// fakeSupervisor runs no processes, every ss-server it starts is alive until stopped.
+type fakeSupervisor struct {
+	// stopDelay slows down Stop
+	stopDelay time.Duration
+
+	mu    sync.Mutex
+	alive map[ss.Handle]bool
+}
+
+func (sup *fakeSupervisor) Start(s *ss.Server) (ss.Handle, error) {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	h := &fakeHandle{}
+	sup.alive[h] = true
+	return h, nil
+}
+
+func (sup *fakeSupervisor) Stop(h ss.Handle) error {
+	time.Sleep(sup.stopDelay)
+
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	delete(sup.alive, h)
+	return nil
+}
+
+func (sup *fakeSupervisor) Alive(h ss.Handle) bool {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	return sup.alive[h]
+}
+
+func (sup *fakeSupervisor) Recover(runPath string) (ss.Handle, error) {
+	return nil, ss.ErrServerNotFound
+}
+
+// newTestServer returns a server managing ss-servers run by a fake supervisor, which
+// takes stopDelay to stop one.
+func newTestServer(t *testing.T, stopDelay time.Duration) *server {
+	mgr, err := ss.NewManagerWithPath(t.TempDir(), 0,
+		ss.WithBinary("true"),
+		ss.WithSupervisor(&fakeSupervisor{stopDelay: stopDelay, alive: make(map[ss.Handle]bool)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mgr.Close() })
+	return &server{mgr: mgr}
+}
+
+func allocateRequest(port int32, password string) *proto.AllocateRequest {
+	return &proto.AllocateRequest{
+		Port:     port,
+		Password: password,
+		Method:   "aes-256-gcm",
+		UserId:   "u",
+	}
+}
+
+func TestAllocateTwice(t *testing.T) {
+	s := newTestServer(t, 0)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		resp, err := s.Allocate(ctx, allocateRequest(10001, "password"))
+		if err != nil {
+			t.Fatalf("allocate #%d: %s", i+1, err)
+		}
+		if resp.GetPort() != 10001 || resp.GetPassword() != "password" {
+			t.Errorf("allocate #%d: got %v", i+1, resp)
+		}
+	}
+
+	// the port taken with different credentials is a collision
+	for _, password := range []string{"otherpassword", ""} {
+		_, err := s.Allocate(ctx, allocateRequest(10001, password))
+		if grpc.Code(err) != codes.AlreadyExists {
+			t.Errorf("got %v allocating with password %q, want AlreadyExists", err, password)
+		}
+	}
+}
+
+func TestAllocateBatchTwice(t *testing.T) {
+	s := newTestServer(t, 0)
+	ctx := context.Background()
+
+	for _, atomic := range []bool{true, false} {
+		reqs := []*proto.AllocateRequest{
+			allocateRequest(10001, "password"),
+			allocateRequest(10002, "password"),
+		}
+		for i := 0; i < 2; i++ {
+			resp, err := s.AllocateBatch(ctx, &proto.AllocateBatchRequest{Requests: reqs, Atomic: atomic})
+			if err != nil {
+				t.Fatalf("atomic %t, allocate #%d: %s", atomic, i+1, err)
+			}
+			if len(resp.GetAllocated()) != 2 || len(resp.GetFailed()) != 0 {
+				t.Errorf("atomic %t, allocate #%d: got %v", atomic, i+1, resp)
+			}
+		}
+	}
+
+	// the allocated ports are kept along with the new one
+	resp, err := s.AllocateBatch(ctx, &proto.AllocateBatchRequest{
+		Requests: []*proto.AllocateRequest{allocateRequest(10001, "password"), allocateRequest(10003, "password")},
+		Atomic:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetAllocated()) != 2 || len(s.mgr.ListServers()) != 3 {
+		t.Errorf("got %v and %d servers, want 2 allocated of 3", resp, len(s.mgr.ListServers()))
+	}
+
+	// a collision fails the atomic batch without adding the new port
+	_, err = s.AllocateBatch(ctx, &proto.AllocateBatchRequest{
+		Requests: []*proto.AllocateRequest{allocateRequest(10004, "password"), allocateRequest(10001, "otherpassword")},
+		Atomic:   true,
+	})
+	if grpc.Code(err) != codes.AlreadyExists {
+		t.Errorf("got %v, want AlreadyExists", err)
+	}
+	if _, err := s.mgr.GetServer(10004); err == nil {
+		t.Error("port of the failed atomic batch is allocated")
+	}
+}
+
+func TestGetStatsDuringUpdate(t *testing.T) {
+	s := newTestServer(t, 20*time.Millisecond)
+	ctx := context.Background()
+	if _, err := s.Allocate(ctx, allocateRequest(10001, "password")); err != nil {
+		t.Fatal(err)
+	}
+	before, err := s.GetStats(ctx, &google_protobuf.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := before.GetFlow()[10001].GetStartTime()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			server, _ := newServer(ctx, allocateRequest(10001, fmt.Sprintf("password%d", i)))
+			if err := s.mgr.Update(10001, server); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	// the old server is stopped but still listed while it's replaced
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		stats, err := s.GetStats(ctx, &google_protobuf.Empty{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stats.GetFlow()[10001].GetStartTime(); got != startTime {
+			t.Fatalf("got start time %d during update, want %d", got, startTime)
+		}
+	}
+}
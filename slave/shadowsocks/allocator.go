@@ -0,0 +1,64 @@
+package shadowsocks
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+)
+
+// ErrNoPortAvailable is returned when all ports in range are in use.
+var ErrNoPortAvailable = errors.New("no port available")
+
+// PortAllocator chooses a free port in [min, max] for the user, inUse reports whether a
+// port is taken.
+type PortAllocator interface {
+	Allocate(userID string, min, max int32, inUse func(int32) bool) (int32, error)
+}
+
+// SequentialAllocator chooses the lowest free port.
+type SequentialAllocator struct{}
+
+// Allocate implements the `PortAllocator` interface.
+func (SequentialAllocator) Allocate(_ string, min, max int32, inUse func(int32) bool) (int32, error) {
+	return probe(min, min, max, inUse)
+}
+
+// RandomAllocator chooses a random free port.
+type RandomAllocator struct{}
+
+// Allocate implements the `PortAllocator` interface.
+func (RandomAllocator) Allocate(_ string, min, max int32, inUse func(int32) bool) (int32, error) {
+	if max < min {
+		return 0, ErrNoPortAvailable
+	}
+	return probe(min+rand.Int31n(max-min+1), min, max, inUse)
+}
+
+// HashAllocator maps the user id into the range, so a user always gets the same port as
+// long as it's free. Collisions are resolved by linear probing.
+type HashAllocator struct{}
+
+// Allocate implements the `PortAllocator` interface.
+func (HashAllocator) Allocate(userID string, min, max int32, inUse func(int32) bool) (int32, error) {
+	if max < min {
+		return 0, ErrNoPortAvailable
+	}
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return probe(min+int32(h.Sum32()%uint32(max-min+1)), min, max, inUse)
+}
+
+// probe finds the first free port from start, wrapping around at max.
+func probe(start, min, max int32, inUse func(int32) bool) (int32, error) {
+	if max < min {
+		return 0, ErrNoPortAvailable
+	}
+	size := int64(max) - int64(min) + 1
+	for i := int64(0); i < size; i++ {
+		port := int32(int64(min) + (int64(start-min)+i)%size)
+		if !inUse(port) {
+			return port, nil
+		}
+	}
+	return 0, ErrNoPortAvailable
+}
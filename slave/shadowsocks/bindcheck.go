@@ -0,0 +1,81 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// bindCheckInterval is the interval of probing whether the server has bound its port.
+const bindCheckInterval = 100 * time.Millisecond
+
+// probeAddress returns the address to probe the port of server, the wildcard host is
+// probed on loopback.
+func (s *Server) probeAddress() string {
+	host := s.Host
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		if ip.To4() != nil {
+			host = "127.0.0.1"
+		} else {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(s.Port)))
+}
+
+// PortInUseError is returned when the port of a server is taken by a process not
+// managed, e.g. a leftover ss-server or another service.
+type PortInUseError struct {
+	Network string
+	Addr    string
+	Err     error
+}
+
+func (e *PortInUseError) Error() string {
+	return fmt.Sprintf("%s: %s %s, %s", ErrPortInUse, e.Network, e.Addr, e.Err)
+}
+
+// Is reports whether the target is ErrPortInUse.
+func (e *PortInUseError) Is(target error) bool {
+	return target == ErrPortInUse
+}
+
+// checkPortFree binds the tcp and udp ports the server would listen on and returns
+// ErrPortInUse if any of them is taken, e.g. by a foreign process.
+func (s *Server) checkPortFree() error {
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(int(s.Port)))
+
+	if s.opts.UDPRelay != UDPRelayOnly {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return &PortInUseError{Network: "tcp", Addr: addr, Err: err}
+		}
+		l.Close()
+	}
+	if s.opts.UDPRelay != UDPRelayNone {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return &PortInUseError{Network: "udp", Addr: addr, Err: err}
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// waitBound waits at most timeout for the server to accept tcp connections on its port.
+func (s *Server) waitBound(timeout time.Duration) error {
+	addr := s.probeAddress()
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, bindCheckInterval)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("ss-server does not listen on %s in %s", addr, timeout)
+		}
+		time.Sleep(bindCheckInterval)
+	}
+}
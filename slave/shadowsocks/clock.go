@@ -0,0 +1,18 @@
+package shadowsocks
+
+import "time"
+
+// Clock provides the current time. Servers and stats are timestamped through it, so
+// time-dependent logic can be driven by a fake clock in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// RealClock is the default clock backed by `time.Now`.
+var RealClock Clock = realClock{}
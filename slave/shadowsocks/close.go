@@ -0,0 +1,67 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+)
+
+func (mgr *manager) isClosed() bool {
+	select {
+	case <-mgr.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// untilClosed returns a context which is done when ctx is done or the manager is closed.
+func (mgr *manager) untilClosed(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-mgr.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx
+}
+
+func (mgr *manager) Close() error {
+	var errs []error
+	mgr.closeOnce.Do(func() {
+		// stop the stat listeners and the monitors
+		close(mgr.closed)
+
+		// the servers being stopped are left to their updates or removals
+		mgr.serverMu.Lock()
+		servers := make(map[int32]*Server, len(mgr.servers))
+		for port, s := range mgr.servers {
+			if _, ok := mgr.stopping[port]; ok {
+				continue
+			}
+			delete(mgr.servers, port)
+			servers[port] = s
+		}
+		mgr.serverMu.Unlock()
+
+		for port, s := range servers {
+			if err := s.Stop(); err != nil {
+				errs = append(errs, fmt.Errorf("stop server(%d): %s", port, err))
+				continue
+			}
+			mgr.removeRunPath(s.runPath)
+		}
+
+		mgr.logger.Infof("Manager closed")
+	})
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return fmt.Errorf("%s, and %d more errors: %v", errs[0], len(errs)-1, errs[1:])
+	}
+}
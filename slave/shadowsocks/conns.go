@@ -0,0 +1,69 @@
+package shadowsocks
+
+import (
+	"context"
+	"time"
+)
+
+// connsInterval is the interval of counting the connections of servers.
+const connsInterval = watchInterval
+
+// connCounter counts the established connections on a port, it's replaced in tests.
+var connCounter = countEstablished
+
+// WithConnectionCount counts the established connections of each server periodically,
+// which are reported in `Stat.Connections`. It's disabled by default since it scans the
+// connection tables of the system.
+func WithConnectionCount(enable bool) Option {
+	return func(mgr *manager) {
+		mgr.countConns = enable
+	}
+}
+
+// sampleConnections counts the established connections of the server.
+func (s *Server) sampleConnections() error {
+	n, err := connCounter(s.Port)
+	if err != nil {
+		return err
+	}
+	s.conns.Store(n)
+	return nil
+}
+
+// connections returns the last counted connections of the server, 0 if never counted.
+func (s *Server) connections() int {
+	n, _ := s.conns.Load().(int)
+	return n
+}
+
+// watchConnections counts the connections of servers every connsInterval until ctx is
+// done.
+func (mgr *manager) watchConnections(ctx context.Context) {
+	ticker := time.NewTicker(connsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mgr.countConnections()
+		}
+	}
+}
+
+// countConnections counts the connections of all servers.
+func (mgr *manager) countConnections() {
+	mgr.serverMu.RLock()
+	servers := make([]*Server, 0, len(mgr.servers))
+	for _, s := range mgr.servers {
+		servers = append(servers, s)
+	}
+	mgr.serverMu.RUnlock()
+
+	for _, s := range servers {
+		if err := s.sampleConnections(); err != nil {
+			mgr.logger.Debugf("Can not count connections of server(%d), %s", s.Port, err)
+		}
+	}
+}
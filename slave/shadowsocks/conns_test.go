@@ -0,0 +1,46 @@
+package shadowsocks
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCountConnections(t *testing.T) {
+	counts := map[int32]int{20001: 3, 20002: 7}
+	defer func(c func(port int32) (int, error)) { connCounter = c }(connCounter)
+	connCounter = func(port int32) (int, error) {
+		n, ok := counts[port]
+		if !ok {
+			return 0, errors.New("no such port")
+		}
+		return n, nil
+	}
+
+	mgr := newTestManager(t, newFakeSupervisor())
+	for _, port := range []int32{20001, 20002, 20003} {
+		if err := mgr.Add(testServer(port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mgr.countConnections()
+	for port, want := range map[int32]int{20001: 3, 20002: 7, 20003: 0} {
+		s, err := mgr.GetServer(port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.GetStat().Connections; got != want {
+			t.Errorf("got %d connections on port %d, want %d", got, port, want)
+		}
+	}
+
+	// the last count is kept until the next one
+	counts[20001] = 1
+	if s, _ := mgr.GetServer(20001); s.GetStat().Connections != 3 {
+		t.Errorf("got %d connections before counting again, want 3", s.GetStat().Connections)
+	}
+	mgr.countConnections()
+	if s, _ := mgr.GetServer(20001); s.GetStat().Connections != 1 {
+		t.Errorf("got %d connections after counting again, want 1", s.GetStat().Connections)
+	}
+}
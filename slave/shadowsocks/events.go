@@ -0,0 +1,81 @@
+package shadowsocks
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the type of events emitted by the manager.
+type EventType int
+
+const (
+	// EventQuotaExceeded is emitted when a server is removed for using up its quota.
+	EventQuotaExceeded EventType = iota
+	// EventUpgraded is emitted when a server is restarted by `UpgradeAll`.
+	EventUpgraded
+	// EventStale is emitted when an alive server sends no stats for the stale threshold.
+	EventStale
+)
+
+// Event represents something happened to a managed server.
+type Event struct {
+	Type      EventType
+	Port      int32
+	UserID    string
+	Namespace string
+	At        time.Time
+	// UsedBytes and LimitBytes are set for quota events.
+	UsedBytes  int64
+	LimitBytes int64
+	// Done and Total are set for upgrade events to report the progress.
+	Done  int
+	Total int
+	// Err is set when the action on the server failed.
+	Err error
+}
+
+const eventBufferSize = 64
+
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+	// logger logs the dropped events
+	logger Logger
+}
+
+func (h *eventHub) subscribe() (<-chan Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs == nil {
+		h.subs = make(map[chan Event]struct{})
+	}
+	ch := make(chan Event, eventBufferSize)
+	h.subs[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+
+			delete(h.subs, ch)
+			close(ch)
+		})
+	}
+}
+
+// publish sends the event to all subscribers, it never blocks and drops the event for
+// subscribers that can not keep up.
+func (h *eventHub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			h.logger.Warnf("Event subscriber is full, event(%d) of server(%d) dropped", e.Type, e.Port)
+		}
+	}
+}
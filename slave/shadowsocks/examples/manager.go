@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"os"
 	"os/signal"
 	"time"
@@ -21,7 +22,7 @@ func addServers(mgr ss.Manager, ports ...int32) {
 		s.Port = port
 		err := mgr.Add(s)
 		if err != nil {
-			if err == ss.ErrServerExists {
+			if errors.Is(err, ss.ErrServerExists) {
 				log.Warnf("Server(%d) already exists", port)
 			} else {
 				log.Panicf("Can not create a new ss server, %s", err)
@@ -0,0 +1,29 @@
+package shadowsocks
+
+// ListFilter selects the servers listed by `ListServersFiltered`, the zero value selects
+// all servers.
+type ListFilter struct {
+	// Alive selects the alive servers if it's true and the dead ones if it's false.
+	Alive *bool
+	// MinTraffic selects the servers with at least MinTraffic bytes of traffic.
+	MinTraffic int64
+	// PortMin and PortMax select the servers on ports in [PortMin, PortMax], 0 means
+	// unbounded.
+	PortMin, PortMax int32
+}
+
+func (f *ListFilter) match(s *Server) bool {
+	if f.PortMin > 0 && s.Port < f.PortMin {
+		return false
+	}
+	if f.PortMax > 0 && s.Port > f.PortMax {
+		return false
+	}
+	if f.MinTraffic > 0 && s.GetStat().Traffic < f.MinTraffic {
+		return false
+	}
+	if f.Alive != nil && s.Alive() != *f.Alive {
+		return false
+	}
+	return true
+}
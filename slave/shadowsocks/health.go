@@ -0,0 +1,125 @@
+package shadowsocks
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// HealthReport represents the health of the manager and the slave process.
+type HealthReport struct {
+	Healthy bool `json:"healthy"`
+	// Listening is true when the udp listener for stats is bound.
+	Listening bool `json:"listening"`
+	// DataDirWritable is true when the data dir of servers is writable.
+	DataDirWritable bool `json:"data_dir_writable"`
+	// BinaryFound is true when ss-server is found.
+	BinaryFound bool `json:"binary_found"`
+	// MonitorsAlive is true when all the watch daemons of servers are running.
+	MonitorsAlive bool `json:"monitors_alive"`
+	// LastStatAt is the time last stat packet is received, zero if never.
+	LastStatAt time.Time `json:"last_stat_at"`
+	Servers    int       `json:"servers"`
+	// Errors of the registered health checks, keyed by name.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// checkWritable checks if files can be created in dir.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0744); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".health")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (mgr *manager) CheckWritable() error {
+	if err := checkWritable(mgr.path); err != nil {
+		return &ProvisioningError{Path: mgr.path, Err: err}
+	}
+	return nil
+}
+
+func (mgr *manager) SupportedMethods() []MethodInfo {
+	ms := availableMethods(mgr.binary, mgr.logger)
+	c := make([]MethodInfo, len(ms))
+	copy(c, ms)
+	return c
+}
+
+func (mgr *manager) SelfCheck() error {
+	if err := mgr.checkBinary(); err != nil {
+		return err
+	}
+
+	names := parseMethods(binaryHelp(mgr.binary))
+	if len(names) == 0 {
+		mgr.logger.Warnf("Can not discover the encrypt methods of %s, skip checking them", mgr.binary)
+		return nil
+	}
+	supported := make(map[string]bool, len(names))
+	for _, name := range names {
+		supported[name] = true
+	}
+	var missing []string
+	for _, m := range methods {
+		if !supported[m.Name] {
+			missing = append(missing, m.Name)
+		}
+	}
+	if len(missing) != 0 {
+		mgr.logger.Warnf("Encrypt methods %s are not supported by %s", strings.Join(missing, ", "), mgr.binary)
+	}
+	return nil
+}
+
+func (mgr *manager) RegisterHealthCheck(name string, check func() error) {
+	mgr.healthMu.Lock()
+	defer mgr.healthMu.Unlock()
+
+	if mgr.healthChecks == nil {
+		mgr.healthChecks = make(map[string]func() error)
+	}
+	mgr.healthChecks[name] = check
+}
+
+func (mgr *manager) Health() HealthReport {
+	r := HealthReport{
+		Listening:       mgr.isListening(),
+		DataDirWritable: checkWritable(mgr.path) == nil,
+		MonitorsAlive:   true,
+		LastStatAt:      mgr.lastStatAt(),
+	}
+	if _, err := exec.LookPath(mgr.binary); err == nil {
+		r.BinaryFound = true
+	}
+
+	mgr.serverMu.RLock()
+	r.Servers = len(mgr.servers)
+	for _, s := range mgr.servers {
+		if !s.watchDaemonRunning() {
+			r.MonitorsAlive = false
+		}
+	}
+	mgr.serverMu.RUnlock()
+
+	mgr.healthMu.Lock()
+	for name, check := range mgr.healthChecks {
+		if err := check(); err != nil {
+			if r.Errors == nil {
+				r.Errors = make(map[string]string)
+			}
+			r.Errors[name] = err.Error()
+		}
+	}
+	mgr.healthMu.Unlock()
+
+	r.Healthy = r.Listening && r.DataDirWritable && r.BinaryFound && r.MonitorsAlive && len(r.Errors) == 0
+	return r
+}
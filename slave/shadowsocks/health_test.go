@@ -0,0 +1,33 @@
+package shadowsocks
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSelfCheck(t *testing.T) {
+	var names []string
+	for _, m := range methods {
+		if m.Name != "aes-192-cfb" {
+			names = append(names, m.Name)
+		}
+	}
+	bin := fakeBinary(t, "    -m <encrypt_method>        Encrypt method: "+strings.Join(names, ", ")+".")
+
+	logger := &captureLogger{}
+	mgr := newTestManager(t, newFakeSupervisor(), WithBinary(bin), WithLogger(logger))
+	if err := mgr.SelfCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.contains("warn", "Encrypt methods aes-192-cfb are not supported") {
+		t.Errorf("no warning of the unsupported method in %q", logger.lines)
+	}
+}
+
+func TestSelfCheckMissingBinary(t *testing.T) {
+	mgr := newTestManager(t, newFakeSupervisor(), WithBinary(path.Join(t.TempDir(), "ss-server")))
+	if err := mgr.SelfCheck(); err == nil {
+		t.Error("missing binary is checked")
+	}
+}
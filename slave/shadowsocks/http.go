@@ -0,0 +1,178 @@
+package shadowsocks
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (mgr *manager) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		mgr.logger.Warnln("Encode response error:", err)
+	}
+}
+
+func (mgr *manager) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report := mgr.Health()
+	if report.Healthy {
+		mgr.writeJSON(w, http.StatusOK, report)
+	} else {
+		mgr.writeJSON(w, http.StatusServiceUnavailable, report)
+	}
+}
+
+// handleLog streams the log of server as server-sent events, the port is given by the
+// query, e.g. `/log?port=8001`.
+func (mgr *manager) handleLog(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil {
+		http.Error(w, "invalid port", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// stop tailing when the client goes away
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	lines, err := mgr.TailLog(int32(port), ctx)
+	if errors.Is(err, ErrServerNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for line := range lines {
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", line); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// serverView is a server listed by the admin http api, the password is omitted unless
+// the secrets are requested with the admin token.
+type serverView struct {
+	Port      int32     `json:"port"`
+	Host      string    `json:"host"`
+	Method    string    `json:"method"`
+	Password  string    `json:"password,omitempty"`
+	UserID    string    `json:"user_id,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Alive     bool      `json:"alive"`
+	StartTime time.Time `json:"start_time"`
+	Stat      Stat      `json:"stat"`
+}
+
+func newServerView(s *Server, secrets bool) *serverView {
+	v := &serverView{
+		Port:      s.Port,
+		Host:      s.Host,
+		Method:    s.Method,
+		UserID:    s.UserID,
+		Namespace: s.Namespace,
+		Alive:     s.Alive(),
+		Stat:      s.GetStat(),
+	}
+	if s.Extra != nil {
+		v.StartTime = s.Extra.StartTime
+	}
+	if secrets {
+		v.Password = s.Password
+	}
+	return v
+}
+
+// authorized checks the admin token in the `Authorization: Bearer <token>` header.
+func (mgr *manager) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return len(mgr.adminToken) != 0 && subtle.ConstantTimeCompare([]byte(token), []byte(mgr.adminToken)) == 1
+}
+
+// handleServers lists the servers sorted by port on `/servers`, or gets the server on
+// `/servers/{port}`. The passwords are included by `?secrets=true` with the admin token.
+func (mgr *manager) handleServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// passwords are served only with the admin token
+	secrets := r.URL.Query().Get("secrets") == "true"
+	if secrets && !mgr.authorized(r) {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+
+	arg := strings.Trim(strings.TrimPrefix(r.URL.Path, "/servers"), "/")
+	if len(arg) == 0 {
+		servers := mgr.ListServersFiltered(ListFilter{})
+		views := make([]*serverView, 0, len(servers))
+		for _, s := range servers {
+			views = append(views, newServerView(s, secrets))
+		}
+		mgr.writeJSON(w, http.StatusOK, views)
+		return
+	}
+
+	port, err := strconv.Atoi(arg)
+	if err != nil {
+		http.Error(w, "invalid port", http.StatusBadRequest)
+		return
+	}
+	s, err := mgr.GetServer(int32(port))
+	if errors.Is(err, ErrServerNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mgr.writeJSON(w, http.StatusOK, newServerView(s, secrets))
+}
+
+func (mgr *manager) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", mgr.handleHealthz)
+	mux.HandleFunc("/log", mgr.handleLog)
+	mux.HandleFunc("/servers", mgr.handleServers)
+	mux.HandleFunc("/servers/", mgr.handleServers)
+	return mux
+}
+
+func (mgr *manager) ServeHTTP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := http.Serve(l, mgr.adminHandler()); err != nil {
+			mgr.logger.Warnf("Admin http server stopped, %s", err)
+		}
+	}()
+
+	mgr.logger.Debugf("Serving admin http api on %s", addr)
+
+	return nil
+}
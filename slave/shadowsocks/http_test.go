@@ -0,0 +1,102 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getServers requests the admin http api of mgr, and decodes the response into v if
+// it succeeds.
+func getServers(t *testing.T, mgr *manager, method, target, token string, v interface{}) int {
+	r := httptest.NewRequest(method, target, nil)
+	if len(token) != 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	mgr.adminHandler().ServeHTTP(w, r)
+
+	if w.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %s", method, target, err)
+		}
+	}
+	return w.Code
+}
+
+func TestHandleServers(t *testing.T) {
+	mgr := newTestManager(t, newFakeSupervisor(), WithAdminToken("admin"))
+	for _, port := range []int32{20002, 20001} {
+		if err := mgr.Add(testServer(port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var list []serverView
+	if code := getServers(t, mgr, "GET", "/servers", "", &list); code != http.StatusOK {
+		t.Fatalf("got status %d listing servers", code)
+	}
+	if len(list) != 2 || list[0].Port != 20001 || list[1].Port != 20002 {
+		t.Errorf("got servers %+v, want 20001 and 20002", list)
+	}
+	for _, v := range list {
+		if len(v.Password) != 0 || !v.Alive || v.Method != "aes-256-cfb" {
+			t.Errorf("got server %+v", v)
+		}
+	}
+
+	var view serverView
+	if code := getServers(t, mgr, "GET", "/servers/20002", "", &view); code != http.StatusOK {
+		t.Fatalf("got status %d getting server", code)
+	}
+	if view.Port != 20002 || len(view.Password) != 0 {
+		t.Errorf("got server %+v", view)
+	}
+
+	tests := []struct {
+		method, target string
+		code           int
+	}{
+		{"GET", "/servers/20003", http.StatusNotFound},
+		{"GET", "/servers/abc", http.StatusBadRequest},
+		{"POST", "/servers", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if code := getServers(t, mgr, tt.method, tt.target, "", nil); code != tt.code {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.target, code, tt.code)
+		}
+	}
+}
+
+func TestHandleServersSecrets(t *testing.T) {
+	mgr := newTestManager(t, newFakeSupervisor(), WithAdminToken("admin"))
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if code := getServers(t, mgr, "GET", "/servers?secrets=true", token, nil); code != http.StatusForbidden {
+			t.Errorf("got status %d with token %q, want forbidden", code, token)
+		}
+	}
+
+	var list []serverView
+	if code := getServers(t, mgr, "GET", "/servers?secrets=true", "admin", &list); code != http.StatusOK {
+		t.Fatalf("got status %d with admin token", code)
+	}
+	if len(list) != 1 || list[0].Password != "password" {
+		t.Errorf("got servers %+v, want the password", list)
+	}
+	var view serverView
+	getServers(t, mgr, "GET", "/servers/20001?secrets=true", "admin", &view)
+	if view.Password != "password" {
+		t.Errorf("got server %+v, want the password", view)
+	}
+
+	// secrets are never served without the admin token configured
+	mgr.adminToken = ""
+	if code := getServers(t, mgr, "GET", "/servers?secrets=true", "", nil); code != http.StatusForbidden {
+		t.Errorf("got status %d without admin token, want forbidden", code)
+	}
+}
@@ -0,0 +1,78 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// PathLayout returns the run path of a server relative to the data dir.
+type PathLayout func(port int32, userID string) string
+
+// PortLayout places servers in `<dataDir>/<port>/`, it's the default layout.
+func PortLayout(port int32, _ string) string {
+	return fmt.Sprint(port)
+}
+
+// UserLayout groups servers by user in `<dataDir>/<userID>/<port>/`, servers without a
+// user are placed in `<dataDir>/_/<port>/`.
+func UserLayout(port int32, userID string) string {
+	if len(userID) == 0 {
+		userID = "_"
+	}
+	return path.Join(userID, fmt.Sprint(port))
+}
+
+// runPath returns the run path of the server in layout.
+func (mgr *manager) runPath(s *Server) string {
+	return path.Join(mgr.path, mgr.layout(s.Port, s.UserID))
+}
+
+// removeRunPath removes the run path and its parents left empty in data dir.
+func (mgr *manager) removeRunPath(runPath string) {
+	os.RemoveAll(runPath)
+	for dir := path.Dir(runPath); len(dir) > len(mgr.path); dir = path.Dir(dir) {
+		// fails when dir is not empty
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// findServerPaths walks the data dir and returns the dirs containing a server config.
+func (mgr *manager) findServerPaths() ([]string, error) {
+	var paths []string
+	err := filepath.Walk(mgr.path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || p == mgr.path {
+			return err
+		}
+		if _, err := os.Stat(path.Join(p, "ss_server.conf")); err == nil {
+			paths = append(paths, p)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// migrate moves the run path of the server into the layout and returns the new one.
+func (mgr *manager) migrate(s *Server, serverPath string) (string, error) {
+	target := mgr.runPath(s)
+	if path.Clean(serverPath) == target {
+		return serverPath, nil
+	}
+	if _, err := os.Stat(target); err == nil {
+		return "", fmt.Errorf("%s already exists", target)
+	}
+	if err := os.MkdirAll(path.Dir(target), 0744); err != nil {
+		return "", err
+	}
+	if err := os.Rename(serverPath, target); err != nil {
+		return "", err
+	}
+	mgr.removeRunPath(serverPath) // remove the empty parents
+
+	mgr.logger.Infof("Migrate server(%d) from %s to %s", s.Port, serverPath, target)
+	return target, nil
+}
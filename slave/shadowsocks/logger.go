@@ -0,0 +1,35 @@
+package shadowsocks
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// Logger is the subset of logrus methods used by manager and servers, both
+// *logrus.Logger and *logrus.Entry satisfy it.
+type Logger interface {
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warn(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Warnln(args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// WithLogger routes the logs of manager and its servers to l, e.g. an entry with fields
+// identifying the node. The standard logger of logrus is used by default.
+func WithLogger(l Logger) Option {
+	return func(mgr *manager) {
+		if l != nil {
+			mgr.logger = l
+		}
+	}
+}
+
+// log returns the logger of the server, the standard one if it's not managed.
+func (s *Server) log() Logger {
+	if s.logger == nil {
+		return log.StandardLogger()
+	}
+	return s.logger
+}
@@ -0,0 +1,91 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureLogger records the logs in memory.
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) log(level, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+": "+msg)
+}
+
+func (l *captureLogger) Debug(args ...interface{}) { l.log("debug", fmt.Sprint(args...)) }
+func (l *captureLogger) Debugf(format string, args ...interface{}) {
+	l.log("debug", fmt.Sprintf(format, args...))
+}
+func (l *captureLogger) Infof(format string, args ...interface{}) {
+	l.log("info", fmt.Sprintf(format, args...))
+}
+func (l *captureLogger) Warn(args ...interface{}) { l.log("warn", fmt.Sprint(args...)) }
+func (l *captureLogger) Warnf(format string, args ...interface{}) {
+	l.log("warn", fmt.Sprintf(format, args...))
+}
+func (l *captureLogger) Warnln(args ...interface{}) { l.log("warn", fmt.Sprintln(args...)) }
+func (l *captureLogger) Errorf(format string, args ...interface{}) {
+	l.log("error", fmt.Sprintf(format, args...))
+}
+
+// contains checks if any log has the prefix of level and contains s.
+func (l *captureLogger) contains(level, s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, level+": ") && strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoggerOfProbe(t *testing.T) {
+	logger := &captureLogger{}
+	mgr := newTestManager(t, newFakeSupervisor(), WithLogger(logger), WithBinary(fakeBinary(t, "")))
+
+	mgr.SupportedMethods()
+	if !logger.contains("warn", "Can not discover the encrypt methods") {
+		t.Errorf("probe warning is not logged by the manager's logger, got %q", logger.lines)
+	}
+}
+
+func TestLoggerOfEvents(t *testing.T) {
+	logger := &captureLogger{}
+	mgr := newTestManager(t, newFakeSupervisor(), WithLogger(logger))
+
+	_, cancel := mgr.Subscribe()
+	defer cancel()
+	for i := 0; i <= eventBufferSize; i++ {
+		mgr.events.publish(Event{Type: EventStale, Port: 20001})
+	}
+	if !logger.contains("warn", "Event subscriber is full") {
+		t.Errorf("dropped event is not logged by the manager's logger, got %q", logger.lines)
+	}
+}
+
+func TestLoggerOfStop(t *testing.T) {
+	logger := &captureLogger{}
+	sup := newFakeSupervisor()
+	mgr := newTestManager(t, sup, WithLogger(logger))
+
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+	sup.mu.Lock()
+	sup.failStop = true
+	sup.mu.Unlock()
+	if err := mgr.Remove(20001); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.contains("debug", "Stop ss-server") {
+		t.Errorf("stop error is not logged by the manager's logger, got %q", logger.lines)
+	}
+}
@@ -3,17 +3,21 @@ package shadowsocks
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"os/exec"
 	"path"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/arkbriar/ssmgr/internal/backoff"
 )
 
 // Errors of `Manager`
@@ -21,133 +25,680 @@ var (
 	ErrServerNotFound = errors.New("server not found")
 	ErrInvalidServer  = errors.New("invalid server")
 	ErrServerExists   = errors.New("server already exists")
+	ErrServerBusy     = errors.New("server is being updated or removed")
+	ErrUserPortLimit  = errors.New("user port limit reached")
+	ErrManagerClosed  = errors.New("manager is closed")
+	ErrPortInUse      = errors.New("port is in use by another process")
+	// ErrNamespaceConflict is returned when the port is held by another namespace.
+	ErrNamespaceConflict = errors.New("port is held by another namespace")
+
+	ErrProvisioningFailed = errors.New("provisioning failed")
 )
 
+// ProvisioningError records the path failed to be created or written when provisioning
+// a server, e.g. the data dir is read-only or the disk is full.
+type ProvisioningError struct {
+	Path string
+	Err  error
+}
+
+func (e *ProvisioningError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrProvisioningFailed, e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ProvisioningError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is ErrProvisioningFailed.
+func (e *ProvisioningError) Is(target error) bool {
+	return target == ErrProvisioningFailed
+}
+
+// ServerError records the operation and the port of server that failed.
+type ServerError struct {
+	Port int32
+	Op   string
+	Err  error
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s server(%d): %s", e.Op, e.Port, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
+
+// serverError wraps the error of op on the server of port into a `ServerError`.
+func serverError(op string, port int32, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ServerError); ok {
+		return err
+	}
+	return &ServerError{Port: port, Op: op, Err: err}
+}
+
 // Manager is an interface provides a few methods to manager shadowsocks
 // servers.
 type Manager interface {
-	// Listen listens udp connection on 127.0.0.1:{udpPort} and handles the stats update
+	// Listen listens udp connection on {listenAddr}:{udpPort} and handles the stats update
 	// sent from ss-server.
 	Listen(ctx context.Context) error
 	// Add adds a ss-server with given arguments.
 	Add(s *Server) error
+	// AddContext adds a ss-server like `Add`, but gives up when ctx is done before the
+	// server is fully started. The started process and the created files are cleaned up.
+	AddContext(ctx context.Context, s *Server) error
+	// PlanAdd validates the server like `Add` and returns the command line and the content
+	// of config file it would start with, but nothing is written or started.
+	PlanAdd(s *Server) (cmdline string, configJSON []byte, err error)
+	// AllocateInRange adds the ss-server on a port chosen by the port allocator within the
+	// port range, and returns the port.
+	AllocateInRange(s *Server) (int32, error)
+	// UserPortCount returns the number of ports held by the user.
+	UserPortCount(userID string) int
+	// PortForUser returns the port the user would get from `AllocateInRange` now.
+	PortForUser(userID string) (int32, error)
+	// Update restarts the ss-server on port with the new password, method and options,
+	// the traffic and start time are carried over so the stats are continuous.
+	Update(port int32, s *Server) error
+	// AddAtomic adds all the ss-servers or none of them, the added ones are removed when
+	// any of them fails.
+	AddAtomic(servers ...*Server) error
 	// Remove kills the ss-server if found.
 	Remove(port int32) error
+	// RemoveWithDrain stops accepting new connections of the ss-server, waits at most
+	// drainTimeout for the established ones to finish and then kills it.
+	RemoveWithDrain(port int32, drainTimeout time.Duration) error
+	// RemovePorts kills the ss-servers on ports under a single lock, the failure of one
+	// doesn't stop the others. The errors are returned by port.
+	RemovePorts(ports ...int32) map[int32]error
+	// RemoveAll kills all the ss-servers like `RemovePorts` and returns the errors.
+	RemoveAll() []error
 	// ListServers list the active ss-servers.
 	ListServers() map[int32]*Server
+	// ListServersFiltered lists clones of the active ss-servers matching the filter,
+	// sorted by port.
+	ListServersFiltered(filter ListFilter) []*Server
+	// RangeServers calls fn with each active ss-server under the read lock of servers,
+	// it avoids the clones of `ListServers`. fn must not modify the server or call
+	// the methods of manager changing servers.
+	RangeServers(fn func(s *Server))
+	// Restarts returns the number of dead servers restarted by the monitor.
+	Restarts() int64
 	// GetServer gets a clone of `Server` struct of given port.
 	GetServer(port int32) (*Server, error)
+	// TailLog follows the log of the server on port like `tail -f` and streams the new
+	// lines until ctx is done. The log is reopened when it's rotated.
+	TailLog(port int32, ctx context.Context) (<-chan string, error)
+	// Subscribe returns a channel receiving the events of managed servers and a function
+	// to cancel the subscription.
+	Subscribe() (<-chan Event, func())
+	// Health reports the health of the manager and the slave process.
+	Health() HealthReport
+	// RegisterHealthCheck registers an extra check reported by `Health`.
+	RegisterHealthCheck(name string, check func() error)
+	// ServeHTTP serves the admin http api on given address in background.
+	ServeHTTP(addr string) error
+	// UpgradeAll restarts all servers with bounded concurrency to pick up the upgraded
+	// ss-server binary, the connections of each server are drained for at most
+	// drainTimeout. The progress is emitted as `EventUpgraded` events.
+	UpgradeAll(drainTimeout time.Duration) error
+	// SupportedMethods returns all the encrypt methods supported by the ss-server binary,
+	// or the built-in list if they can not be discovered.
+	SupportedMethods() []MethodInfo
+	// CheckWritable verifies the data dir is creatable and writable.
+	CheckWritable() error
+	// SelfCheck verifies the ss-server binary exists and warns about the built-in encrypt
+	// methods it doesn't support, e.g. the names differ between ss-libev and ss-rust.
+	SelfCheck() error
 	// Restore all stopped servers, this must be called before any other actions.
 	Restore() error
-	// CleanUp removes all servers and files.
+	// ReapDuplicates kills the ss-server processes started from managed path but not
+	// tracked by manager, e.g. leftovers of a prior run serving the same port.
+	ReapDuplicates() error
+	// CleanUp removes all servers and files, and the root qdiscs created for shaping.
 	CleanUp()
+	// StartMonitor checks the servers every interval in background until ctx is done or
+	// the manager is closed, and restarts the dead ones. A server failing to restart is
+	// retried with backoff and removed after too many consecutive failures.
+	StartMonitor(ctx context.Context, interval time.Duration)
+	// Close stops all servers and the stat listeners, servers can't be added after it.
+	Close() error
 }
 
 // Implementation of `Manager` interface.
 type manager struct {
 	serverMu sync.RWMutex
 	servers  map[int32]*Server
+	// starting holds the servers being started, their ports are reserved meanwhile
+	starting map[int32]*Server
+	// stopping holds the servers being stopped by an update or removal, they're not
+	// revived and their ports are reserved meanwhile
+	stopping map[int32]*Server
 	path     string
 	udpPort  int
+	tcpStats bool
+	clock    Clock
+	events   eventHub
+
+	upgradeConcurrency int
+	statSinks          []StatSink
+	statPorts          []int  // extra udp ports receiving stats
+	listenAddr         string // host of the stat listeners
+	binary             string // path of ss-server binary
+	logger             Logger
+
+	maxPortsPerUser int
+	layout          PathLayout
+	supervisor      Supervisor
+	pidRetry        pidFileRetry
+	bindCheck       time.Duration
+	startGrace      time.Duration
+	countConns      bool
+	adminToken      string
+
+	// Consecutive failures of reviving a server before it's removed, 0 means never.
+	maxReviveFailures int
+	restarts          int64 // number of servers restarted by monitor, accessed atomically
+
+	// Servers alive but without stats for staleAfter are stale, 0 disables the check.
+	staleAfter   time.Duration
+	staleRestart bool
+
+	// Range and allocator of the ports chosen by manager.
+	portMin, portMax int32
+	portAllocator    PortAllocator
+
+	// Defaults of the servers added without them.
+	defaultTimeout    int
+	defaultNameServer string
+
+	listening int32        // number of stat sockets listening, accessed atomically
+	lastStat  atomic.Value // time.Time
+
+	healthMu     sync.Mutex
+	healthChecks map[string]func() error
+
+	// closed is closed when the manager is closed
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Option configures the manager created by `NewManager`.
+type Option func(*manager)
+
+// WithClock sets the clock used to timestamp servers and stats.
+func WithClock(c Clock) Option {
+	return func(mgr *manager) {
+		mgr.clock = c
+	}
+}
+
+// WithDefaultTimeout sets the timeout in seconds used by the servers added without one.
+func WithDefaultTimeout(timeout int) Option {
+	return func(mgr *manager) {
+		mgr.defaultTimeout = timeout
+	}
+}
+
+// WithDefaultNameServer sets the nameserver used by the servers added without one.
+func WithDefaultNameServer(ns string) Option {
+	return func(mgr *manager) {
+		mgr.defaultNameServer = ns
+	}
+}
+
+// WithUpgradeConcurrency sets the max number of servers restarted at the same time by
+// `UpgradeAll`, which is 1 by default.
+func WithUpgradeConcurrency(n int) Option {
+	return func(mgr *manager) {
+		mgr.upgradeConcurrency = n
+	}
+}
+
+// WithStatSinks adds the sinks receiving the stats of servers.
+func WithStatSinks(sinks ...StatSink) Option {
+	return func(mgr *manager) {
+		mgr.statSinks = append(mgr.statSinks, sinks...)
+	}
+}
+
+// WithPortRange sets the range of the ports chosen by manager, [10000, 20000] by default.
+func WithPortRange(min, max int32) Option {
+	return func(mgr *manager) {
+		mgr.portMin, mgr.portMax = min, max
+	}
+}
+
+// WithPortAllocator sets the allocator choosing ports, which is `SequentialAllocator`
+// by default.
+func WithPortAllocator(a PortAllocator) Option {
+	return func(mgr *manager) {
+		mgr.portAllocator = a
+	}
+}
+
+// WithMaxPortsPerUser limits the number of ports a user can hold, 0 means unlimited.
+func WithMaxPortsPerUser(n int) Option {
+	return func(mgr *manager) {
+		mgr.maxPortsPerUser = n
+	}
+}
+
+// WithDataPath sets the data dir storing the files of servers, which is $HOME/.ssmgr by
+// default.
+func WithDataPath(dataPath string) Option {
+	return func(mgr *manager) {
+		mgr.path = dataPath
+	}
+}
+
+// defaultDataPath returns $HOME/.ssmgr, or a dir in the temp dir if $HOME is not set,
+// e.g. in containers.
+func defaultDataPath(logger Logger) string {
+	home := os.Getenv("HOME")
+	if len(home) == 0 {
+		dataPath := path.Join(os.TempDir(), "ssmgr")
+		logger.Warnf("$HOME is not set, store the files of servers in %s", dataPath)
+		return dataPath
+	}
+	return path.Join(home, ".ssmgr")
+}
+
+// WithAdminToken sets the token required to get the passwords of servers from the admin
+// http api, the passwords are never served if it's empty.
+func WithAdminToken(token string) Option {
+	return func(mgr *manager) {
+		mgr.adminToken = token
+	}
+}
+
+// WithPathLayout sets the layout of server dirs in data dir, which is `PortLayout` by
+// default. Servers in other layouts are migrated on `Restore`.
+func WithPathLayout(layout PathLayout) Option {
+	return func(mgr *manager) {
+		mgr.layout = layout
+	}
+}
+
+// WithStatPorts adds the udp ports receiving stats besides the one given to `NewManager`,
+// servers are distributed over them so that stats of busy slaves are received by a pool
+// of sockets.
+func WithStatPorts(ports ...int) Option {
+	return func(mgr *manager) {
+		mgr.statPorts = append(mgr.statPorts, ports...)
+	}
+}
+
+// WithTCPStats listens on the tcp port of the same number as well, for the ss-server
+// builds sending stats over tcp. Stats are received over udp only when the tcp port
+// can not be listened.
+func WithTCPStats() Option {
+	return func(mgr *manager) {
+		mgr.tcpStats = true
+	}
+}
+
+// WithSupervisor sets the supervisor running ss-servers, which is `ExecSupervisor` by
+// default.
+func WithSupervisor(sup Supervisor) Option {
+	return func(mgr *manager) {
+		mgr.supervisor = sup
+	}
+}
+
+// WithPidFileRetry sets the attempts and interval of reading and writing pidfiles, which
+// are 5 times and 100ms by default.
+func WithPidFileRetry(attempts int, interval time.Duration) Option {
+	return func(mgr *manager) {
+		mgr.pidRetry = pidFileRetry{attempts: attempts, interval: interval}
+	}
+}
+
+// WithBindCheck verifies that a started ss-server listens on its port within timeout,
+// otherwise it's stopped and the start fails.
+func WithBindCheck(timeout time.Duration) Option {
+	return func(mgr *manager) {
+		mgr.bindCheck = timeout
+	}
+}
+
+// WithStartGrace sets how long a started ss-server is watched before it's considered
+// ready, an exit within it fails the start with the tail of its log. It's 500ms by default.
+func WithStartGrace(d time.Duration) Option {
+	return func(mgr *manager) {
+		mgr.startGrace = d
+	}
+}
+
+// WithStaleThreshold flags the alive servers that send no stats within window as stale
+// and emits `EventStale`, the stale servers are restarted if restart is true.
+func WithStaleThreshold(window time.Duration, restart bool) Option {
+	return func(mgr *manager) {
+		mgr.staleAfter = window
+		mgr.staleRestart = restart
+	}
+}
+
+// WithListenAddr sets the host the stats are received on, e.g. "::1" on ipv6 only hosts.
+func WithListenAddr(addr string) Option {
+	return func(mgr *manager) {
+		mgr.listenAddr = addr
+	}
+}
+
+// WithMaxReviveFailures sets the consecutive failures of restarting a dead server before
+// the monitor gives up and removes it, 0 means never.
+func WithMaxReviveFailures(n int) Option {
+	return func(mgr *manager) {
+		mgr.maxReviveFailures = n
+	}
+}
+
+// WithBinary runs the servers with the ss-server binary at path, e.g. a vendored one.
+func WithBinary(path string) Option {
+	return func(mgr *manager) {
+		mgr.binary = path
+	}
+}
+
+// NewManagerWithAddr returns a new manager receiving the stats on addr:udpPort.
+func NewManagerWithAddr(addr string, udpPort int, opts ...Option) Manager {
+	return NewManager(udpPort, append([]Option{WithListenAddr(addr)}, opts...)...)
+}
+
+// NewManagerWithPath returns a new manager storing the files of servers in dataPath, an
+// error is returned if it's not writable.
+func NewManagerWithPath(dataPath string, udpPort int, opts ...Option) (Manager, error) {
+	mgr := NewManager(udpPort, append([]Option{WithDataPath(dataPath)}, opts...)...)
+	if err := mgr.CheckWritable(); err != nil {
+		return nil, err
+	}
+	return mgr, nil
 }
 
 // NewManager returns a new manager, udpPort is origin shadowsocks manager api port, receiving
 // 'stat' command from ss-servers
-func NewManager(udpPort int) Manager {
+func NewManager(udpPort int, opts ...Option) Manager {
 	mgr := &manager{
-		servers: make(map[int32]*Server),
-		path:    path.Join(os.Getenv("HOME"), ".ssmgr"),
-		udpPort: udpPort,
+		servers:  make(map[int32]*Server),
+		starting: make(map[int32]*Server),
+		stopping: make(map[int32]*Server),
+		udpPort:  udpPort,
+		clock:    RealClock,
+		closed:   make(chan struct{}),
+
+		upgradeConcurrency: 1,
+		listenAddr:         "127.0.0.1",
+		binary:             defaultBinary,
+		maxReviveFailures:  defaultMaxReviveFailures,
+		defaultTimeout:     60,
+		portMin:            10000,
+		portMax:            20000,
+		portAllocator:      SequentialAllocator{},
+		layout:             PortLayout,
+		supervisor:         ExecSupervisor{},
+		pidRetry:           defaultPidFileRetry,
+		startGrace:         earlyExitWindow,
+		logger:             log.StandardLogger(),
+	}
+	for _, opt := range opts {
+		opt(mgr)
 	}
+	if len(mgr.path) == 0 {
+		mgr.path = defaultDataPath(mgr.logger)
+	}
+	mgr.events.logger = mgr.logger
 	return mgr
 }
 
 func (mgr *manager) handleStat(data []byte) {
-	cmd := string(data[:4])
-	if string(data[:4]) != "stat" {
-		log.Warnf("Unrecognized command %s, dropped", cmd)
+	port, stat, err := ParseStatPacket(data)
+	if err != nil {
+		mgr.logger.Warnf("Invalid packet %q dropped, %s", data, err)
 		return
 	}
 
-	var stat map[string]int64
+	// update statistic
+	mgr.serverMu.RLock()
+	defer mgr.serverMu.RUnlock()
 
-	body := bytes.TrimSpace(data[5:])
-	err := json.Unmarshal(body, &stat)
-	if err != nil {
-		log.Warnln("Unmarshal error:", err)
+	s, ok := mgr.servers[port]
+	if !ok {
+		mgr.logger.Warnf("Server on port %d not found!", port)
 		return
 	}
+	now := mgr.clock.Now()
+	stat = stat.add(s.statBase())
+	stat.UpdatedAt = now
+	s.updateStat(stat.withRate(s.GetStat()))
+	mgr.lastStat.Store(now)
+	for _, sink := range mgr.statSinks {
+		sink.Record(s.Port, s.GetStat())
+	}
+	mgr.enforceQuota(s, stat.Traffic)
+}
+
+// safeHandleStat handles the stat and recovers from any panic, so a malformed packet
+// never stops the stat ingestion.
+func (mgr *manager) safeHandleStat(data []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			mgr.logger.Errorf("Panic when handling packet %q: %v", data, r)
+		}
+	}()
+	mgr.handleStat(data)
+}
 
-	port, traffic := -1, int64(-1)
-	for portS, trafficS := range stat {
-		port, _ = strconv.Atoi(portS)
-		traffic = trafficS
-		break
+func (mgr *manager) lastStatAt() time.Time {
+	t := mgr.lastStat.Load()
+	if t != nil {
+		return t.(time.Time)
 	}
-	if port < 0 || traffic < 0 {
-		log.Warnf("Invalid stat!")
+	return time.Time{}
+}
+
+func (mgr *manager) isListening() bool {
+	return int(atomic.LoadInt32(&mgr.listening)) == len(mgr.statListenPorts())
+}
+
+// enforceQuota removes the server once it has used up its quota.
+func (mgr *manager) enforceQuota(s *Server, traffic int64) {
+	if s.Quota <= 0 || traffic < s.Quota {
 		return
 	}
 
-	// update statistic
-	mgr.serverMu.RLock()
-	defer mgr.serverMu.RUnlock()
+	go func() {
+		// the server may be removed by a previous stat
+		if err := mgr.Remove(s.Port); err != nil {
+			return
+		}
 
-	s, ok := mgr.servers[int32(port)]
-	if !ok {
-		log.Warnf("Server on port %d not found!", port)
-		return
+		mgr.logger.Infof("Server(%d) used up its quota (%d/%d), removed", s.Port, traffic, s.Quota)
+
+		mgr.events.publish(Event{
+			Type:       EventQuotaExceeded,
+			Port:       s.Port,
+			UserID:     s.UserID,
+			Namespace:  s.Namespace,
+			At:         mgr.clock.Now(),
+			UsedBytes:  traffic,
+			LimitBytes: s.Quota,
+		})
+	}()
+}
+
+func (mgr *manager) Subscribe() (<-chan Event, func()) {
+	return mgr.events.subscribe()
+}
+
+// lookupIP resolves the host of stat listeners, it's replaced in tests.
+var lookupIP = net.LookupIP
+
+// statNetwork returns the network of stat listeners, which is udp6 or tcp6 if they
+// listen on an ipv6 address or a host resolved to ipv6 addresses only.
+func (mgr *manager) statNetwork(network string) string {
+	host := strings.Trim(mgr.listenAddr, "[]")
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = lookupIP(host); err != nil || len(ips) == 0 {
+			return network
+		}
 	}
-	s.updateStat(Stat{Traffic: traffic})
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return network
+		}
+	}
+	return network + "6"
+}
+
+// statAddress returns the address of stat listener on port.
+func (mgr *manager) statAddress(port int) string {
+	return net.JoinHostPort(strings.Trim(mgr.listenAddr, "[]"), strconv.Itoa(port))
+}
+
+// statListenPorts returns all the udp ports receiving stats.
+func (mgr *manager) statListenPorts() []int {
+	return append([]int{mgr.udpPort}, mgr.statPorts...)
+}
+
+// managerAddressOf returns the address which the server of port sends stats to.
+func (mgr *manager) managerAddressOf(port int32) string {
+	ports := mgr.statListenPorts()
+	return mgr.statAddress(ports[int(port)%len(ports)])
 }
 
 func (mgr *manager) managerAddress() string {
-	return fmt.Sprintf("127.0.0.1:%d", mgr.udpPort)
+	return mgr.statAddress(mgr.udpPort)
 }
 
-func (mgr *manager) Listen(ctx context.Context) error {
-	port := mgr.udpPort
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", port))
-	if err != nil {
-		return err
+// Backoff of retrying the failed reads of stat sockets.
+const (
+	readRetryInterval    = 10 * time.Millisecond
+	maxReadRetryInterval = time.Second
+)
+
+// serveUDP handles the stats received by conn until ctx is done.
+func (mgr *manager) serveUDP(ctx context.Context, conn *net.UDPConn) {
+	atomic.AddInt32(&mgr.listening, 1)
+	defer atomic.AddInt32(&mgr.listening, -1)
+	defer conn.Close()
+
+	// unblock the read when ctx is done
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	retry := backoff.Backoff{
+		Initial: readRetryInterval,
+		Max:     maxReadRetryInterval,
+		Jitter:  0.2,
 	}
+	// one more byte than the max, so an oversized packet isn't truncated into a valid one
+	buf := make([]byte, maxStatPacketSize+1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if errors.Is(err, net.ErrClosed) {
+					mgr.logger.Errorf("Stop receiving stats on %s, %s", conn.LocalAddr(), err)
+					return
+				}
+				wait := retry.Next()
+				mgr.logger.Warnf("Can not receive stats, %s. Retry in %s", err, wait)
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			retry.Reset()
+			if n < 1 {
+				continue
+			}
+			data := trimPacket(buf[:n])
+
+			mgr.logger.Debugf("Receving packet from %s: %s", from, data)
+
+			mgr.safeHandleStat(data)
+		}
+	}
+}
 
+// trimPacket strips the trailing '\0' appended by ss-server, which is not sent by all
+// versions of it, and the surrounding blanks.
+func trimPacket(packet []byte) []byte {
+	if n := len(packet); n > 0 && packet[n-1] == 0 {
+		packet = packet[:n-1]
+	}
+	return bytes.Trim(packet, "\x00\r\n")
+}
+
+func (mgr *manager) Listen(ctx context.Context) error {
 	select {
 	case <-ctx.Done():
 		return errors.New("canceled")
 	default:
 	}
-
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return err
+	if mgr.isClosed() {
+		return ErrManagerClosed
 	}
+	ctx = mgr.untilClosed(ctx)
 
-	go func() {
-		defer conn.Close()
-
-		buf := make([]byte, 1024)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				n, from, err := conn.ReadFromUDP(buf)
-				if err != nil {
-					log.Warnln(err)
-					continue
-				}
-				data := bytes.Trim(buf[:n-1], "\x00\r\n")
-
-				log.Debugf("Receving packet from %s: %s", from, data)
-
-				mgr.handleStat(data)
+	ports := mgr.statListenPorts()
+	conns := make([]*net.UDPConn, 0, len(ports))
+	for _, port := range ports {
+		network := mgr.statNetwork("udp")
+		addr, err := net.ResolveUDPAddr(network, mgr.statAddress(port))
+		if err == nil {
+			var conn *net.UDPConn
+			conn, err = net.ListenUDP(network, addr)
+			if err == nil {
+				conns = append(conns, conn)
+				continue
 			}
 		}
-	}()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return err
+	}
 
-	log.Debugf("Listening on 127.0.0.1:%d", port)
+	for i, conn := range conns {
+		go mgr.serveUDP(ctx, conn)
+		mgr.logger.Debugf("Listening on %s", mgr.statAddress(ports[i]))
+	}
 
+	if mgr.tcpStats {
+		if err := mgr.listenTCP(ctx); err != nil {
+			mgr.logger.Warnf("Can not receive stats over tcp, fall back to udp, %s", err)
+		}
+	}
+	if mgr.staleAfter > 0 {
+		go mgr.watchStale(ctx)
+	}
+	if usageSupported {
+		go mgr.watchUsage(ctx)
+	}
+	if mgr.countConns {
+		go mgr.watchConnections(ctx)
+	}
 	return nil
 }
 
@@ -158,64 +709,542 @@ func (mgr *manager) addAlive(s *Server) error {
 	if _, ok := mgr.servers[s.Port]; ok {
 		return ErrServerExists
 	}
+	if _, ok := mgr.starting[s.Port]; ok {
+		return ErrServerExists
+	}
+	if _, ok := mgr.stopping[s.Port]; ok {
+		return ErrServerExists
+	}
 	mgr.servers[s.Port] = s
 	return nil
 }
 
 func (mgr *manager) prepareServer(s *Server) *Server {
-	runPath := path.Join(mgr.path, fmt.Sprint(s.Port))
+	runPath := mgr.runPath(s)
 	s = s.clone().WithDefaults().WithRunPath(runPath).WithPidFile(
 		path.Join(runPath, "ss_server.pid"),
-	).WithManagerAddress(mgr.managerAddress())
+	).WithManagerAddress(mgr.managerAddressOf(s.Port))
+	// managed servers are revived by the monitor only, a watch daemon would race with it
+	s.watchDaemon.enable = false
+	s.clock = mgr.clock
+	s.sup = mgr.supervisor
+	s.pidRetry = mgr.pidRetry
+	s.bindCheck = mgr.bindCheck
+	s.startGrace = mgr.startGrace
+	s.binary = mgr.binary
+	s.logger = mgr.logger
+	return s
+}
+
+// applyDefaults returns a clone of the server with zero-valued fields filled by the
+// defaults of manager.
+func (mgr *manager) applyDefaults(s *Server) *Server {
+	s = s.clone()
+	s.binary = mgr.binary
+	if s.Timeout == 0 {
+		s.Timeout = mgr.defaultTimeout
+	}
+	if len(s.opts.NameServer) == 0 {
+		s.opts.NameServer = mgr.defaultNameServer
+	}
 	return s
 }
 
+// checkBinary checks the ss-server binary exists and is executable.
+func (mgr *manager) checkBinary() error {
+	if _, err := exec.LookPath(mgr.binary); err != nil {
+		return fmt.Errorf("can not run ss-server binary %q, %s", mgr.binary, err)
+	}
+	return nil
+}
+
 func (mgr *manager) Add(s *Server) error {
-	if !s.valid() {
-		return ErrInvalidServer
+	return mgr.AddContext(context.Background(), s)
+}
+
+func (mgr *manager) AddContext(ctx context.Context, s *Server) error {
+	return serverError("add", s.Port, mgr.addContext(ctx, s))
+}
+
+// validateServer checks the server and that its port is not reserved by manager.
+func (mgr *manager) validateServer(s *Server) error {
+	if err := s.Validate(); err != nil {
+		return err
 	}
+	for _, port := range mgr.statListenPorts() {
+		if int(s.Port) == port {
+			return &InvalidServerError{Problems: []string{fmt.Sprintf("port %d is reserved for stats", port)}}
+		}
+	}
+	return nil
+}
+
+func (mgr *manager) PlanAdd(s *Server) (string, []byte, error) {
+	cmdline, conf, err := mgr.planAdd(s)
+	return cmdline, conf, serverError("plan", s.Port, err)
+}
 
+func (mgr *manager) planAdd(s *Server) (string, []byte, error) {
+	if err := mgr.checkBinary(); err != nil {
+		return "", nil, err
+	}
+
+	s = mgr.applyDefaults(s)
+	if err := mgr.validateServer(s); err != nil {
+		return "", nil, err
+	}
 	s = mgr.prepareServer(s)
+	if err := s.opts.validate(s.binaryPath()); err != nil {
+		return "", nil, err
+	}
+
+	conf, err := s.marshalConf()
+	if err != nil {
+		return "", nil, err
+	}
+	return s.Command(), conf, nil
+}
+
+func (mgr *manager) addContext(ctx context.Context, s *Server) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if mgr.isClosed() {
+		return ErrManagerClosed
+	}
+	if err := mgr.checkBinary(); err != nil {
+		return err
+	}
+
+	s = mgr.applyDefaults(s)
+	if err := mgr.validateServer(s); err != nil {
+		return err
+	}
+
+	s = mgr.prepareServer(s)
+	_, statErr := os.Stat(s.runPath)
+	created := os.IsNotExist(statErr)
 	if err := os.MkdirAll(s.runPath, 0744); err != nil {
+		if created {
+			mgr.removeRunPath(s.runPath)
+		}
+		return &ProvisioningError{Path: s.runPath, Err: err}
+	}
+
+	mgr.serverMu.Lock()
+	err := ctx.Err()
+	if err == nil && mgr.isClosed() {
+		err = ErrManagerClosed
+	}
+	if err == nil {
+		err = mgr.reserve(s)
+	}
+	mgr.serverMu.Unlock()
+
+	if err == nil {
+		err = mgr.start(ctx, s)
+	}
+	if err != nil {
+		// don't leave residue of a failed server in data dir
+		if created {
+			mgr.removeRunPath(s.runPath)
+		}
+		return err
+	}
+
+	mgr.logger.Infof("Add server(%s)", s)
+
+	return nil
+}
+
+func (mgr *manager) Update(port int32, s *Server) error {
+	return serverError("update", port, mgr.update(port, s))
+}
+
+func (mgr *manager) update(port int32, s *Server) error {
+	if err := mgr.checkBinary(); err != nil {
+		return err
+	}
+	old, s, extra, err := mgr.beginUpdate(port, s)
+	if err != nil {
 		return err
 	}
+	defer mgr.release(port)
 
+	if err := os.MkdirAll(s.runPath, 0744); err != nil {
+		return &ProvisioningError{Path: s.runPath, Err: err}
+	}
+	oldExtra := old.Extra
+	if err := old.Stop(); err != nil {
+		mgr.logger.Warn(err)
+	}
+	s.rtMu.Lock()
+	err = s.resume(extra)
+	s.rtMu.Unlock()
+	current := s
+	if err != nil {
+		// bring the old one back
+		if oldExtra == nil {
+			oldExtra = &serverExtra{StartTime: old.now()}
+		}
+		old.rtMu.Lock()
+		restartErr := old.resume(oldExtra)
+		old.rtMu.Unlock()
+		if restartErr != nil {
+			mgr.logger.Warnf("Can not restart server(%d) after failed update, %s", port, restartErr)
+		}
+		current = old
+	}
+
+	// the manager may be closed meanwhile, which leaves the server to be stopped here
+	mgr.serverMu.Lock()
+	closed := mgr.isClosed()
+	if closed {
+		delete(mgr.servers, port)
+	} else {
+		mgr.servers[port] = current
+	}
+	mgr.serverMu.Unlock()
+	if closed {
+		if err := current.Stop(); err != nil {
+			mgr.logger.Warn(err)
+		}
+		mgr.removeRunPath(current.runPath)
+		return ErrManagerClosed
+	}
+	if err != nil {
+		return err
+	}
+
+	mgr.logger.Infof("Update server(%s)", s)
+
+	return nil
+}
+
+// beginUpdate validates the update of server on port and prepares the new one, the old
+// one is marked as stopping until `release`.
+func (mgr *manager) beginUpdate(port int32, s *Server) (*Server, *Server, *serverExtra, error) {
 	mgr.serverMu.Lock()
 	defer mgr.serverMu.Unlock()
 
-	if _, ok := mgr.servers[s.Port]; ok {
+	old, ok := mgr.servers[port]
+	if !ok {
+		return nil, nil, nil, ErrServerNotFound
+	}
+	if _, ok := mgr.stopping[port]; ok {
+		return nil, nil, nil, ErrServerBusy
+	}
+
+	s = mgr.applyDefaults(s)
+	s.Port = port
+	if len(s.UserID) == 0 {
+		s.UserID = old.UserID
+	}
+	if s.UserID != old.UserID {
+		return nil, nil, nil, &InvalidServerError{Problems: []string{"user of server can not be updated"}}
+	}
+	s.Namespace = old.Namespace
+	if err := mgr.validateServer(s); err != nil {
+		return nil, nil, nil, err
+	}
+
+	s = mgr.prepareServer(s)
+	extra := &serverExtra{StartTime: s.now()}
+	if old.Extra != nil {
+		extra.StartTime = old.Extra.StartTime
+	}
+	stat := old.GetStat()
+	extra.TrafficBase, extra.RxBase, extra.TxBase = stat.Traffic, stat.Rx, stat.Tx
+	s.updateStat(stat)
+
+	mgr.stopping[port] = old
+	return old, s, extra, nil
+}
+
+// release unmarks the stopping servers of ports.
+func (mgr *manager) release(ports ...int32) {
+	mgr.serverMu.Lock()
+	defer mgr.serverMu.Unlock()
+
+	for _, port := range ports {
+		delete(mgr.stopping, port)
+	}
+}
+
+func (mgr *manager) UserPortCount(userID string) int {
+	mgr.serverMu.RLock()
+	defer mgr.serverMu.RUnlock()
+
+	return mgr.userPortCount(userID)
+}
+
+// userPortCount counts the ports of user, the caller must hold serverMu.
+func (mgr *manager) userPortCount(userID string) int {
+	count := 0
+	for _, s := range mgr.servers {
+		if s.UserID == userID {
+			count++
+		}
+	}
+	for _, s := range mgr.starting {
+		if s.UserID == userID {
+			count++
+		}
+	}
+	return count
+}
+
+func (mgr *manager) PortForUser(userID string) (int32, error) {
+	mgr.serverMu.RLock()
+	defer mgr.serverMu.RUnlock()
+
+	return mgr.portAllocator.Allocate(userID, mgr.portMin, mgr.portMax, func(port int32) bool {
+		_, ok := mgr.servers[port]
+		if !ok {
+			_, ok = mgr.starting[port]
+		}
+		if !ok {
+			_, ok = mgr.stopping[port]
+		}
+		return ok
+	})
+}
+
+// maxAllocateAttempts limits the retries when the chosen port is taken concurrently.
+const maxAllocateAttempts = 3
+
+func (mgr *manager) AllocateInRange(s *Server) (int32, error) {
+	for i := 0; ; i++ {
+		port, err := mgr.PortForUser(s.UserID)
+		if err != nil {
+			return 0, err
+		}
+		c := s.clone()
+		c.Port = port
+		err = mgr.Add(c)
+		if errors.Is(err, ErrServerExists) && i+1 < maxAllocateAttempts {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return port, nil
+	}
+}
+
+// reserve checks the server can be added and reserves its port, so it's started without
+// holding serverMu. The caller must hold serverMu.
+func (mgr *manager) reserve(s *Server) error {
+	old, ok := mgr.servers[s.Port]
+	if !ok {
+		old, ok = mgr.starting[s.Port]
+	}
+	if !ok {
+		old, ok = mgr.stopping[s.Port]
+	}
+	if ok {
+		if old.Namespace != s.Namespace {
+			return ErrNamespaceConflict
+		}
 		return ErrServerExists
 	}
-	if err := s.Start(); err != nil {
+	if mgr.maxPortsPerUser > 0 && len(s.UserID) != 0 && mgr.userPortCount(s.UserID) >= mgr.maxPortsPerUser {
+		return ErrUserPortLimit
+	}
+	if err := s.checkPortFree(); err != nil {
 		return err
 	}
-	mgr.servers[s.Port] = s
+	mgr.starting[s.Port] = s
+	return nil
+}
 
-	log.Infof("Add server(%s)", s)
+// start starts the reserved server and adds it into servers. It's stopped again if ctx
+// is done or the manager is closed meanwhile, so it's never left orphaned.
+func (mgr *manager) start(ctx context.Context, s *Server) error {
+	if DeprecatedEncryptMethod(s.Method) {
+		mgr.logger.Warnf("Server(%d) uses insecure encrypt method %s", s.Port, s.Method)
+	}
+	err := s.Start()
+
+	mgr.serverMu.Lock()
+	delete(mgr.starting, s.Port)
+	if err != nil {
+		mgr.serverMu.Unlock()
+		return err
+	}
+	err = ctx.Err()
+	if err == nil && mgr.isClosed() {
+		err = ErrManagerClosed
+	}
+	if err == nil {
+		mgr.servers[s.Port] = s
+	}
+	mgr.serverMu.Unlock()
+
+	if err != nil {
+		if err := s.Stop(); err != nil {
+			mgr.logger.Warn(err)
+		}
+	}
+	return err
+}
 
+func (mgr *manager) AddAtomic(servers ...*Server) error {
+	added := make([]int32, 0, len(servers))
+	for _, s := range servers {
+		if err := mgr.Add(s); err != nil {
+			// roll back
+			for _, port := range added {
+				if err := mgr.Remove(port); err != nil {
+					mgr.logger.Warnf("Can not roll back server(%d), %s", port, err)
+				}
+			}
+			return serverError("add", s.Port, err)
+		}
+		added = append(added, s.Port)
+	}
 	return nil
 }
 
 func (mgr *manager) Remove(port int32) error {
-	mgr.serverMu.Lock()
-	defer mgr.serverMu.Unlock()
+	return mgr.RemoveWithDrain(port, 0)
+}
+
+func (mgr *manager) RemoveWithDrain(port int32, drainTimeout time.Duration) error {
+	return serverError("remove", port, mgr.remove(port, drainTimeout))
+}
+
+func (mgr *manager) remove(port int32, drainTimeout time.Duration) error {
+	if drainTimeout > 0 {
+		mgr.serverMu.RLock()
+		s, ok := mgr.servers[port]
+		mgr.serverMu.RUnlock()
+		if !ok {
+			return ErrServerNotFound
+		}
+
+		undrain := s.drain(drainTimeout)
+		defer undrain()
+	}
 
+	mgr.serverMu.Lock()
 	s, ok := mgr.servers[port]
 	if !ok {
+		mgr.serverMu.Unlock()
 		return ErrServerNotFound
 	}
-
+	if _, ok := mgr.stopping[port]; ok {
+		mgr.serverMu.Unlock()
+		return ErrServerBusy
+	}
 	delete(mgr.servers, port)
+	mgr.stopping[port] = s
+	mgr.serverMu.Unlock()
+	defer mgr.release(port)
+
 	if err := s.Stop(); err != nil {
-		log.Warn(err)
+		mgr.logger.Warn(err)
 	}
-	os.RemoveAll(s.runPath)
+	mgr.removeRunPath(s.runPath)
 
-	log.Infof("Remove server(%s)", s)
+	mgr.logger.Infof("Remove server(%s)", s)
 
 	return nil
 }
 
+func (mgr *manager) RemovePorts(ports ...int32) map[int32]error {
+	errs := make(map[int32]error)
+	servers := mgr.takeStopping(ports, errs)
+	for port, err := range mgr.stopServers(servers) {
+		errs[port] = err
+	}
+	return errs
+}
+
+func (mgr *manager) RemoveAll() []error {
+	errs := make(map[int32]error)
+	mgr.serverMu.Lock()
+	servers := make([]*Server, 0, len(mgr.servers))
+	for port, s := range mgr.servers {
+		if _, ok := mgr.stopping[port]; ok {
+			errs[port] = serverError("remove", port, ErrServerBusy)
+			continue
+		}
+		delete(mgr.servers, port)
+		mgr.stopping[port] = s
+		servers = append(servers, s)
+	}
+	mgr.serverMu.Unlock()
+
+	for port, err := range mgr.stopServers(servers) {
+		errs[port] = err
+	}
+	ports := make([]int, 0, len(errs))
+	for port := range errs {
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+
+	list := make([]error, 0, len(ports))
+	for _, port := range ports {
+		list = append(list, errs[int32(port)])
+	}
+	return list
+}
+
+// takeStopping removes the servers of ports and marks them as stopping, the errors of
+// missing or busy ones are set in errs.
+func (mgr *manager) takeStopping(ports []int32, errs map[int32]error) []*Server {
+	mgr.serverMu.Lock()
+	defer mgr.serverMu.Unlock()
+
+	servers := make([]*Server, 0, len(ports))
+	for _, port := range ports {
+		s, ok := mgr.servers[port]
+		if !ok {
+			errs[port] = serverError("remove", port, ErrServerNotFound)
+			continue
+		}
+		if _, ok := mgr.stopping[port]; ok {
+			errs[port] = serverError("remove", port, ErrServerBusy)
+			continue
+		}
+		delete(mgr.servers, port)
+		mgr.stopping[port] = s
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+// stopServers stops the removed servers concurrently and removes their files, the
+// errors of stopping are returned by port. The servers are released once stopped.
+func (mgr *manager) stopServers(servers []*Server) map[int32]error {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = make(map[int32]error)
+	)
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *Server) {
+			defer wg.Done()
+			defer mgr.release(s.Port)
+
+			err := s.Stop()
+			mgr.removeRunPath(s.runPath)
+			if err != nil {
+				mu.Lock()
+				errs[s.Port] = serverError("remove", s.Port, err)
+				mu.Unlock()
+				return
+			}
+			mgr.logger.Infof("Remove server(%s)", s)
+		}(s)
+	}
+	wg.Wait()
+	return errs
+}
+
 func (mgr *manager) ListServers() map[int32]*Server {
 	mgr.serverMu.RLock()
 	defer mgr.serverMu.RUnlock()
@@ -227,13 +1256,42 @@ func (mgr *manager) ListServers() map[int32]*Server {
 	return currentServers
 }
 
+func (mgr *manager) ListServersFiltered(filter ListFilter) []*Server {
+	mgr.serverMu.RLock()
+	defer mgr.serverMu.RUnlock()
+
+	servers := make([]*Server, 0)
+	for _, s := range mgr.servers {
+		if filter.match(s) {
+			servers = append(servers, s.clone())
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Port < servers[j].Port
+	})
+	return servers
+}
+
+func (mgr *manager) RangeServers(fn func(s *Server)) {
+	mgr.serverMu.RLock()
+	defer mgr.serverMu.RUnlock()
+
+	for _, s := range mgr.servers {
+		fn(s)
+	}
+}
+
+func (mgr *manager) Restarts() int64 {
+	return atomic.LoadInt64(&mgr.restarts)
+}
+
 func (mgr *manager) GetServer(port int32) (*Server, error) {
 	mgr.serverMu.RLock()
 	defer mgr.serverMu.RUnlock()
 
 	s, ok := mgr.servers[port]
 	if !ok {
-		return nil, ErrServerNotFound
+		return nil, serverError("get", port, ErrServerNotFound)
 	}
 	return s.clone(), nil
 }
@@ -243,11 +1301,6 @@ func isDir(dirname string) bool {
 	return err == nil && fileInfo.IsDir()
 }
 
-func getPort(portname string) (int32, bool) {
-	p, err := strconv.Atoi(portname)
-	return int32(p), err == nil && validPort(int32(p))
-}
-
 // readDirNames reads the directory named by dirname and returns
 // a sorted list of directory entries.
 func readDirNames(dirname string) ([]string, error) {
@@ -264,16 +1317,29 @@ func readDirNames(dirname string) ([]string, error) {
 	return names, nil
 }
 
-func (mgr *manager) restore(s *Server, serverPath string) error {
+func (mgr *manager) restore(serverPath string) error {
+	s := &Server{}
+	if err := s.restoreConf(serverPath); err != nil {
+		return err
+	}
 	if !validPort(s.Port) {
-		log.Warn("Invalid port")
+		return ErrInvalidServer
+	}
+
+	serverPath, err := mgr.migrate(s, serverPath)
+	if err != nil {
+		return err
 	}
 
 	s = mgr.prepareServer(s)
-	err := s.Restore(serverPath)
+	err = s.Restore(serverPath)
 	if err != nil {
 		return err
 	}
+	// the pidfile in config may be left in the path before migration
+	if len(s.opts.PidFile) != 0 {
+		s.opts.PidFile = path.Join(serverPath, "ss_server.pid")
+	}
 
 	// when server process is alive
 	if s.Alive() {
@@ -289,7 +1355,7 @@ func (mgr *manager) restore(s *Server, serverPath string) error {
 		return err
 	}
 
-	log.Infof("Server(%s) restored", s)
+	mgr.logger.Infof("Server(%s) restored", s)
 
 	return nil
 }
@@ -303,43 +1369,42 @@ func (mgr *manager) Restore() error {
 		return errors.New(mgr.path + " is not a directory")
 	}
 
-	// traverse all dirs in managed path and restore the servers.
-	names, err := readDirNames(mgr.path)
+	// traverse all server dirs in managed path and restore the servers, servers not in
+	// current layout are migrated.
+	serverPaths, err := mgr.findServerPaths()
 	if err != nil {
 		return err
 	}
-	for _, name := range names {
-		serverPath := path.Join(mgr.path, name)
-		if isDir(serverPath) {
-			if port, ok := getPort(name); ok {
-				log.Infof("Restoring server(%d)", port)
-
-				err := mgr.restore(&Server{Port: port}, serverPath)
-				if err != nil {
-					log.Warnf("Can not restore server(%d), %s. Remove it", port, err)
-					os.RemoveAll(serverPath)
-				}
-			} else {
-				log.Warnf("Ignore unrecognized port %s", name)
-			}
-		} else {
-			log.Warnf("Ignore normal file %s", serverPath)
+	for _, serverPath := range serverPaths {
+		mgr.logger.Infof("Restoring server in %s", serverPath)
+
+		err := mgr.restore(serverPath)
+		if err != nil {
+			mgr.logger.Warnf("Can not restore server in %s, %s. Remove it", serverPath, err)
+			mgr.removeRunPath(serverPath)
 		}
 	}
+
+	if err := mgr.ReapDuplicates(); err != nil {
+		mgr.logger.Warnf("Can not reap duplicate servers, %s", err)
+	}
 	return nil
 }
 
 func (mgr *manager) CleanUp() {
 	names, err := readDirNames(mgr.path)
 	if err != nil {
-		log.Warn(err)
+		mgr.logger.Warn(err)
 	}
 	for _, name := range names {
 		os.RemoveAll(path.Join(mgr.path, name))
 	}
-	for p := range mgr.ListServers() {
-		mgr.Remove(p)
+	for _, err := range mgr.RemoveAll() {
+		mgr.logger.Warn(err)
+	}
+	for _, err := range deleteShapingRoots() {
+		mgr.logger.Warn(err)
 	}
 
-	log.Infof("Clean up all managed servers")
+	mgr.logger.Infof("Clean up all managed servers")
 }
@@ -0,0 +1,572 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHandle is a ss-server run by fakeSupervisor.
+type fakeHandle struct {
+	pid int
+}
+
+func (h *fakeHandle) Pid() int {
+	return h.pid
+}
+
+// fakeSupervisor runs no processes, it records the started servers in memory.
+type fakeSupervisor struct {
+	// startDelay and stopDelay slow down Start and Stop
+	startDelay time.Duration
+	stopDelay  time.Duration
+
+	mu      sync.Mutex
+	nextPid int
+	alive   map[*fakeHandle]bool
+	started int
+	// failStart fails the next Start of the ports that many times
+	failStart map[int32]int
+	// failStop makes Stop return an error after stopping the process
+	failStop bool
+}
+
+func newFakeSupervisor() *fakeSupervisor {
+	return &fakeSupervisor{
+		nextPid:   100000,
+		alive:     make(map[*fakeHandle]bool),
+		failStart: make(map[int32]int),
+	}
+}
+
+func (sup *fakeSupervisor) Start(s *Server) (Handle, error) {
+	time.Sleep(sup.startDelay)
+
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	if sup.failStart[s.Port] > 0 {
+		sup.failStart[s.Port]--
+		return nil, errors.New("ss-server exited")
+	}
+	sup.nextPid++
+	h := &fakeHandle{pid: sup.nextPid}
+	sup.alive[h] = true
+	sup.started++
+	return h, nil
+}
+
+func (sup *fakeSupervisor) Stop(h Handle) error {
+	time.Sleep(sup.stopDelay)
+
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	delete(sup.alive, h.(*fakeHandle))
+	if sup.failStop {
+		return errors.New("ss-server exited with signal: terminated")
+	}
+	return nil
+}
+
+func (sup *fakeSupervisor) Alive(h Handle) bool {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	fh, ok := h.(*fakeHandle)
+	return ok && sup.alive[fh]
+}
+
+func (sup *fakeSupervisor) Recover(runPath string) (Handle, error) {
+	return nil, errors.New("not supported")
+}
+
+// kill makes the ss-server of the server dead.
+func (sup *fakeSupervisor) kill(s *Server) {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	delete(sup.alive, s.runtime.handle.(*fakeHandle))
+}
+
+func (sup *fakeSupervisor) startCount() int {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	return sup.started
+}
+
+// newTestManager returns a manager running servers with sup in a temp dir, `true` is
+// used as the binary so its help lists nothing and every flag is taken as supported.
+func newTestManager(t *testing.T, sup Supervisor, opts ...Option) *manager {
+	opts = append([]Option{
+		WithDataPath(t.TempDir()),
+		WithBinary("true"),
+		WithSupervisor(sup),
+	}, opts...)
+	mgr := NewManager(0, opts...).(*manager)
+	t.Cleanup(func() { mgr.Close() })
+	return mgr
+}
+
+// fakeBinary writes an executable printing help as ss-server does, and returns its path.
+func fakeBinary(t *testing.T, help string) string {
+	bin := path.Join(t.TempDir(), "ss-server")
+	script := "#!/bin/sh\ncat <<'EOF'\n" + help + "\nEOF\nexit 1\n"
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return bin
+}
+
+func testServer(port int32) *Server {
+	return &Server{
+		Host:     "127.0.0.1",
+		Port:     port,
+		Password: "password",
+		Method:   "aes-256-cfb",
+	}
+}
+
+func TestAddStartsWithoutLock(t *testing.T) {
+	sup := newFakeSupervisor()
+	sup.startDelay = 300 * time.Millisecond
+	mgr := newTestManager(t, sup)
+
+	done := make(chan error)
+	go func() {
+		done <- mgr.Add(testServer(20001))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the manager is readable while the server is starting
+	start := time.Now()
+	mgr.ListServers()
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("ListServers blocked %s by a starting server", d)
+	}
+	// and the port is reserved
+	if err := mgr.Add(testServer(20001)); !errors.Is(err, ErrServerExists) {
+		t.Errorf("got %v adding a starting port, want ErrServerExists", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.GetServer(20001); err != nil {
+		t.Errorf("started server is not added: %s", err)
+	}
+}
+
+func TestAddFailedStart(t *testing.T) {
+	sup := newFakeSupervisor()
+	sup.failStart[20001] = 1
+	mgr := newTestManager(t, sup)
+
+	if err := mgr.Add(testServer(20001)); err == nil {
+		t.Fatal("server failing to start is added")
+	}
+	if _, err := mgr.GetServer(20001); !errors.Is(err, ErrServerNotFound) {
+		t.Errorf("got %v, want ErrServerNotFound", err)
+	}
+
+	// the reservation is released
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Errorf("port is still reserved after failed start: %s", err)
+	}
+}
+func TestAddDefaultTimeout(t *testing.T) {
+	mgr := newTestManager(t, newFakeSupervisor())
+
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+	s, err := mgr.GetServer(20001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Timeout != 60 {
+		t.Errorf("got timeout %d, want 60", s.Timeout)
+	}
+}
+
+func TestUpdateRollback(t *testing.T) {
+	sup := newFakeSupervisor()
+	mgr := newTestManager(t, sup)
+
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+	mgr.handleStat([]byte(`stat: {"20001":100}`))
+
+	// the traffic is carried over by a successful update
+	s := testServer(20001)
+	s.Password = "password2"
+	if err := mgr.Update(20001, s); err != nil {
+		t.Fatal(err)
+	}
+	mgr.handleStat([]byte(`stat: {"20001":50}`))
+
+	// and kept when the old one is brought back after a failed update
+	sup.mu.Lock()
+	sup.failStart[20001] = 1
+	sup.mu.Unlock()
+	s = testServer(20001)
+	s.Password = "password3"
+	if err := mgr.Update(20001, s); err == nil {
+		t.Fatal("update with failed start succeeded")
+	}
+
+	got, err := mgr.GetServer(20001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Password != "password2" {
+		t.Errorf("got password %q, want the old one", got.Password)
+	}
+	if !got.Alive() {
+		t.Error("old server is not brought back")
+	}
+	if got.Extra == nil || got.Extra.TrafficBase != 100 {
+		t.Errorf("got extra %+v, want traffic base 100", got.Extra)
+	}
+	mgr.handleStat([]byte(`stat: {"20001":60}`))
+	if traffic := mgr.servers[20001].GetStat().Traffic; traffic != 160 {
+		t.Errorf("got traffic %d, want 160", traffic)
+	}
+}
+
+func TestUpdateValidatesLikeAdd(t *testing.T) {
+	sup := newFakeSupervisor()
+	mgr := newTestManager(t, sup)
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+
+	s := testServer(20001)
+	s.Password = "short"
+	if err := mgr.Update(20001, s); !errors.As(err, new(*InvalidServerError)) {
+		t.Errorf("got %v updating with invalid password, want InvalidServerError", err)
+	}
+
+	// the binary is checked before the old one is stopped
+	mgr.binary = path.Join(t.TempDir(), "ss-server")
+	s = testServer(20001)
+	s.Password = "password2"
+	if err := mgr.Update(20001, s); err == nil {
+		t.Error("update with missing binary succeeded")
+	}
+
+	got, err := mgr.GetServer(20001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Password != "password" || !got.Alive() {
+		t.Errorf("got server %s, want the old one running", got)
+	}
+}
+
+func TestStatNetwork(t *testing.T) {
+	defer func(f func(string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "v6.example.com":
+			return []net.IP{net.ParseIP("fd00::1")}, nil
+		case "dual.example.com":
+			return []net.IP{net.ParseIP("fd00::1"), net.ParseIP("10.0.0.1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		addr    string
+		network string
+		address string
+	}{
+		{"127.0.0.1", "udp", "127.0.0.1:6001"},
+		{"::1", "udp6", "[::1]:6001"},
+		{"[::1]", "udp6", "[::1]:6001"},
+		{"v6.example.com", "udp6", "v6.example.com:6001"},
+		{"dual.example.com", "udp", "dual.example.com:6001"},
+		{"unknown.example.com", "udp", "unknown.example.com:6001"},
+	}
+	for _, tt := range tests {
+		mgr := &manager{listenAddr: tt.addr}
+		if got := mgr.statNetwork("udp"); got != tt.network {
+			t.Errorf("%s: got network %s, want %s", tt.addr, got, tt.network)
+		}
+		if got := mgr.statAddress(6001); got != tt.address {
+			t.Errorf("%s: got address %s, want %s", tt.addr, got, tt.address)
+		}
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback is not available")
+	}
+	conn.Close()
+
+	mgr := newTestManager(t, newFakeSupervisor(), WithListenAddr("[::1]"))
+	mgr.udpPort = conn.LocalAddr().(*net.UDPAddr).Port
+	if err := mgr.Listen(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("udp6", mgr.managerAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 50; i++ {
+		client.Write([]byte(`stat: {"20001":5}`))
+		if mgr.servers[20001].GetStat().Traffic == 5 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("stats are not received on [::1]")
+}
+
+func TestDataPathWithoutHome(t *testing.T) {
+	t.Setenv("HOME", "")
+	logger := &captureLogger{}
+	mgr := NewManager(0, WithLogger(logger), WithSupervisor(newFakeSupervisor())).(*manager)
+	defer mgr.Close()
+
+	if want := path.Join(os.TempDir(), "ssmgr"); mgr.path != want {
+		t.Errorf("got data path %s, want %s", mgr.path, want)
+	}
+	if !logger.contains("warn", "$HOME is not set") {
+		t.Errorf("fallback to temp dir is not warned, got %q", logger.lines)
+	}
+}
+
+func TestNewManagerWithPath(t *testing.T) {
+	dir := path.Join(t.TempDir(), "data")
+	mgr, err := NewManagerWithPath(dir, 0, WithSupervisor(newFakeSupervisor()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Close()
+	if got := mgr.(*manager).path; got != dir {
+		t.Errorf("got data path %s, want %s", got, dir)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("data path is not created: %s", err)
+	}
+
+	// a path under a regular file can never be created
+	file := path.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewManagerWithPath(path.Join(file, "data"), 0)
+	var perr *ProvisioningError
+	if !errors.As(err, &perr) {
+		t.Errorf("got %v with an unwritable path, want ProvisioningError", err)
+	}
+}
+
+// assertUnblocked checks the manager is writable while a server is being stopped, the
+// server added on port is left.
+func assertUnblocked(t *testing.T, mgr *manager, port int32, op string) {
+	start := time.Now()
+	if err := mgr.Add(testServer(port)); err != nil {
+		t.Errorf("%s: %s", op, err)
+	}
+	mgr.ListServers()
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("%s: manager is blocked %s by a stopping server", op, d)
+	}
+}
+
+func TestStopWithoutLock(t *testing.T) {
+	sup := newFakeSupervisor()
+	mgr := newTestManager(t, sup)
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+	sup.mu.Lock()
+	sup.stopDelay = 300 * time.Millisecond
+	sup.mu.Unlock()
+
+	// update
+	done := make(chan error)
+	go func() {
+		s := testServer(20001)
+		s.Password = "password2"
+		done <- mgr.Update(20001, s)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assertUnblocked(t, mgr, 20002, "update")
+	if err := mgr.Remove(20001); !errors.Is(err, ErrServerBusy) {
+		t.Errorf("got %v removing a server being updated, want ErrServerBusy", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// remove
+	go func() {
+		done <- mgr.Remove(20001)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assertUnblocked(t, mgr, 20003, "remove")
+	// and the port is reserved until the server is stopped
+	if err := mgr.Add(testServer(20001)); !errors.Is(err, ErrServerExists) {
+		t.Errorf("got %v adding a stopping port, want ErrServerExists", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Errorf("port is still reserved after removal: %s", err)
+	}
+}
+
+func TestCloseWithoutLock(t *testing.T) {
+	sup := newFakeSupervisor()
+	mgr := newTestManager(t, sup)
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+	sup.mu.Lock()
+	sup.stopDelay = 300 * time.Millisecond
+	sup.mu.Unlock()
+
+	done := make(chan error)
+	go func() {
+		done <- mgr.Close()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	mgr.ListServers()
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("manager is blocked %s by closing", d)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addServers adds the test servers of ports, the one of stopped port is stopped behind
+// the manager so it fails to be removed.
+func addServers(t *testing.T, mgr *manager, stopped int32, ports ...int32) {
+	for _, port := range ports {
+		if err := mgr.Add(testServer(port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mgr.serverMu.RLock()
+	s := mgr.servers[stopped]
+	mgr.serverMu.RUnlock()
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// markStopping marks the server of port as being stopped by another call.
+func markStopping(mgr *manager, port int32) {
+	mgr.serverMu.Lock()
+	defer mgr.serverMu.Unlock()
+	mgr.stopping[port] = mgr.servers[port]
+}
+
+func TestRemovePortsPartially(t *testing.T) {
+	mgr := newTestManager(t, newFakeSupervisor())
+	addServers(t, mgr, 20002, 20001, 20002, 20003, 20004)
+	markStopping(mgr, 20003)
+
+	errs := mgr.RemovePorts(20001, 20002, 20003, 20005)
+	want := map[int32]error{
+		20002: errServerNotStarted,
+		20003: ErrServerBusy,
+		20005: ErrServerNotFound,
+	}
+	if len(errs) != len(want) {
+		t.Errorf("got errors %v, want of ports 20002, 20003 and 20005", errs)
+	}
+	for port, target := range want {
+		if !errors.Is(errs[port], target) {
+			t.Errorf("got %v removing port %d, want %v", errs[port], port, target)
+		}
+	}
+
+	// the failed server to stop is removed as well, the busy one is left to its caller
+	servers := mgr.ListServers()
+	for port, removed := range map[int32]bool{20001: true, 20002: true, 20003: false, 20004: false} {
+		if _, ok := servers[port]; ok == removed {
+			t.Errorf("server on port %d: got removed %t, want %t", port, !ok, removed)
+		}
+	}
+}
+
+func TestRemoveAllPartially(t *testing.T) {
+	mgr := newTestManager(t, newFakeSupervisor())
+	addServers(t, mgr, 20002, 20001, 20002, 20003, 20004)
+	markStopping(mgr, 20004)
+
+	errs := mgr.RemoveAll()
+	if len(errs) != 2 || !errors.Is(errs[0], errServerNotStarted) || !errors.Is(errs[1], ErrServerBusy) {
+		t.Errorf("got errors %v, want not started of 20002 and busy of 20004", errs)
+	}
+	if servers := mgr.ListServers(); len(servers) != 1 || servers[20004] == nil {
+		t.Errorf("got servers %v, want the busy one left", servers)
+	}
+}
+
+// waitTraffic waits for the traffic of server on port to become want.
+func waitTraffic(t *testing.T, mgr *manager, port int32, want int64) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		var got int64
+		mgr.RangeServers(func(s *Server) {
+			if s.Port == port {
+				got = s.GetStat().Traffic
+			}
+		})
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got traffic %d of server on port %d, want %d", got, port, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeUDPZeroLength(t *testing.T) {
+	mgr := newTestManager(t, newFakeSupervisor())
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mgr.serveUDP(ctx, conn)
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the stat after the zero-length packet is still received
+	for _, packet := range []string{"", "\x00", `stat: {"20001":100}`} {
+		if _, err := client.Write([]byte(packet)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitTraffic(t, mgr, 20001, 100)
+}
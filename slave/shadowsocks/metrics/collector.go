@@ -0,0 +1,68 @@
+// Package metrics exports the servers of shadowsocks manager as prometheus metrics.
+package metrics
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	ss "github.com/arkbriar/ssmgr/slave/shadowsocks"
+)
+
+var (
+	trafficDesc = prometheus.NewDesc(
+		"ssmgr_server_traffic_bytes",
+		"Traffic of ss-servers in bytes since they're started.",
+		[]string{"port"}, nil,
+	)
+	aliveDesc = prometheus.NewDesc(
+		"ssmgr_server_alive",
+		"Whether the process of ss-server is alive, 1 if alive.",
+		[]string{"port"}, nil,
+	)
+	serversDesc = prometheus.NewDesc(
+		"ssmgr_servers_total",
+		"Number of managed ss-servers.",
+		nil, nil,
+	)
+	restartsDesc = prometheus.NewDesc(
+		"ssmgr_server_restarts_total",
+		"Number of dead ss-servers restarted by the monitor.",
+		nil, nil,
+	)
+)
+
+// Collector collects the metrics of managed servers on each scrape. The servers are
+// copied before the metrics are emitted, so a slow scrape never blocks the manager.
+type Collector struct {
+	mgr ss.Manager
+}
+
+// NewCollector returns a collector of the servers of mgr.
+func NewCollector(mgr ss.Manager) *Collector {
+	return &Collector{mgr: mgr}
+}
+
+// Describe implements `prometheus.Collector`.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- trafficDesc
+	ch <- aliveDesc
+	ch <- serversDesc
+	ch <- restartsDesc
+}
+
+// Collect implements `prometheus.Collector`.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	servers := c.mgr.ListServersFiltered(ss.ListFilter{})
+	for _, s := range servers {
+		port := strconv.Itoa(int(s.Port))
+		alive := 0.0
+		if s.Alive() {
+			alive = 1
+		}
+		ch <- prometheus.MustNewConstMetric(trafficDesc, prometheus.CounterValue, float64(s.GetStat().Traffic), port)
+		ch <- prometheus.MustNewConstMetric(aliveDesc, prometheus.GaugeValue, alive, port)
+	}
+	ch <- prometheus.MustNewConstMetric(serversDesc, prometheus.GaugeValue, float64(len(servers)))
+	ch <- prometheus.MustNewConstMetric(restartsDesc, prometheus.CounterValue, float64(c.mgr.Restarts()))
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	ss "github.com/arkbriar/ssmgr/slave/shadowsocks"
+)
+
+// fakeManager lists the servers under a lock like the manager, the methods not
+// overridden panic.
+type fakeManager struct {
+	ss.Manager
+
+	mu      sync.RWMutex
+	servers []*ss.Server
+}
+
+func (m *fakeManager) ListServersFiltered(filter ss.ListFilter) []*ss.Server {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	servers := make([]*ss.Server, len(m.servers))
+	copy(servers, m.servers)
+	return servers
+}
+
+func (m *fakeManager) Restarts() int64 {
+	return 3
+}
+
+func TestCollectWithoutLock(t *testing.T) {
+	mgr := &fakeManager{servers: []*ss.Server{{Port: 20001}, {Port: 20002}}}
+	c := NewCollector(mgr)
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	// the scraper is slow to receive the metrics
+	<-ch
+	go func() {
+		mgr.mu.Lock()
+		mgr.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("manager is locked by a slow scrape")
+	}
+
+	n := 1
+	for range ch {
+		n++
+	}
+	// traffic and alive of each server, the number of servers and restarts
+	if n != 6 {
+		t.Errorf("got %d metrics, want 6", n)
+	}
+}
@@ -0,0 +1,106 @@
+package shadowsocks
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/arkbriar/ssmgr/internal/backoff"
+)
+
+// defaultMaxReviveFailures is the number of consecutive failures of reviving a server
+// before the monitor gives up and removes it.
+const defaultMaxReviveFailures = 5
+
+// reviveState tracks the failures of reviving a dead server.
+type reviveState struct {
+	failures int
+	retry    backoff.Backoff
+	next     time.Time
+}
+
+func (mgr *manager) StartMonitor(ctx context.Context, interval time.Duration) {
+	ctx = mgr.untilClosed(ctx)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		states := make(map[int32]*reviveState)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				mgr.checkDead(states, interval)
+			}
+		}
+	}()
+}
+
+// checkDead revives the dead servers, the failed ones are retried with exponential
+// backoff and removed after too many failures.
+func (mgr *manager) checkDead(states map[int32]*reviveState, interval time.Duration) {
+	mgr.serverMu.RLock()
+	servers := make(map[int32]*Server, len(mgr.servers))
+	for port, s := range mgr.servers {
+		if _, ok := mgr.stopping[port]; !ok {
+			servers[port] = s
+		}
+	}
+	mgr.serverMu.RUnlock()
+
+	for port := range states {
+		if _, ok := servers[port]; !ok {
+			delete(states, port)
+		}
+	}
+
+	now := mgr.clock.Now()
+	for port, s := range servers {
+		if s.Alive() {
+			delete(states, port)
+			continue
+		}
+
+		state, ok := states[port]
+		if !ok {
+			state = &reviveState{
+				retry: backoff.Backoff{
+					Initial: interval,
+					Max:     maxReviveInterval,
+					Jitter:  0.2,
+				},
+			}
+			states[port] = state
+		}
+		if now.Before(state.next) {
+			continue
+		}
+
+		mgr.logger.Warnf("Server(%d) is detected dead", port)
+
+		err := s.revive()
+		if err == nil {
+			atomic.AddInt64(&mgr.restarts, 1)
+		}
+		if err == nil || err == errServerAlive {
+			mgr.logger.Infof("Server(%d) is back to work", port)
+			delete(states, port)
+			continue
+		}
+
+		state.failures++
+		if mgr.maxReviveFailures > 0 && state.failures >= mgr.maxReviveFailures {
+			mgr.logger.Errorf("Server(%d) can not be restarted after %d attempts, give up and remove it, last error: %s",
+				port, state.failures, err)
+			if err := mgr.Remove(port); err != nil {
+				mgr.logger.Warn(err)
+			}
+			delete(states, port)
+			continue
+		}
+		wait := state.retry.Next()
+		state.next = now.Add(wait)
+		mgr.logger.Warnf("Can not restart server(%d), %s. Retry in %s", port, err, wait)
+	}
+}
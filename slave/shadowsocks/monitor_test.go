@@ -0,0 +1,85 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond every 10ms until it's true or timeout.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func TestMonitorRevives(t *testing.T) {
+	sup := newFakeSupervisor()
+	mgr := newTestManager(t, sup)
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+	if mgr.servers[20001].watchDaemon.enable {
+		t.Error("watch daemon is enabled for managed server")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mgr.StartMonitor(ctx, 10*time.Millisecond)
+
+	sup.kill(mgr.servers[20001])
+	if !waitFor(time.Second, func() bool { return mgr.Restarts() == 1 }) {
+		t.Fatalf("got %d restarts, want 1", mgr.Restarts())
+	}
+	s, err := mgr.GetServer(20001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Alive() {
+		t.Error("server is not revived")
+	}
+	// only the monitor revives the server
+	if n := sup.startCount(); n != 2 {
+		t.Errorf("got %d starts, want 2", n)
+	}
+}
+
+func TestMonitorGivesUp(t *testing.T) {
+	sup := newFakeSupervisor()
+	mgr := newTestManager(t, sup, WithMaxReviveFailures(3))
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mgr.StartMonitor(ctx, 10*time.Millisecond)
+
+	sup.mu.Lock()
+	sup.failStart[20001] = 100
+	sup.mu.Unlock()
+	sup.kill(mgr.servers[20001])
+
+	removed := waitFor(2*time.Second, func() bool {
+		_, err := mgr.GetServer(20001)
+		return errors.Is(err, ErrServerNotFound)
+	})
+	if !removed {
+		t.Fatal("server failing to restart is not removed")
+	}
+	sup.mu.Lock()
+	failures := 100 - sup.failStart[20001]
+	sup.mu.Unlock()
+	if failures != 3 {
+		t.Errorf("got %d failed restarts, want 3", failures)
+	}
+	if mgr.Restarts() != 0 {
+		t.Errorf("got %d restarts, want 0", mgr.Restarts())
+	}
+}
@@ -0,0 +1,57 @@
+// +build linux
+
+package shadowsocks
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tcpEstablished is the state code of an established connection in /proc/net/tcp.
+const tcpEstablished = "01"
+
+func countEstablishedIn(filename string, port int32) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != tcpEstablished {
+			continue
+		}
+		// local address is formatted as HEX_IP:HEX_PORT
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			continue
+		}
+		p, err := strconv.ParseInt(fields[1][i+1:], 16, 32)
+		if err == nil && int32(p) == port {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+// countEstablished counts the established tcp connections whose local port is the given one.
+func countEstablished(port int32) (int, error) {
+	count := 0
+	for _, filename := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		n, err := countEstablishedIn(filename, port)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
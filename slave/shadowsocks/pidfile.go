@@ -0,0 +1,94 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// unrecoverableMarker is created in run path when the pidfile of server can not be
+// written, so the pidfile is not trusted on restore.
+const unrecoverableMarker = "ss_server.unrecoverable"
+
+var errUnrecoverable = errors.New("pidfile is not trusted")
+
+// pidFileRetry controls the retries of reading and writing pidfiles.
+type pidFileRetry struct {
+	attempts int
+	interval time.Duration
+}
+
+var defaultPidFileRetry = pidFileRetry{attempts: 5, interval: 100 * time.Millisecond}
+
+// do calls f until it succeeds or the attempts are used up.
+func (r pidFileRetry) do(f func() error) error {
+	attempts := r.attempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(r.interval)
+		}
+		if err = f(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func writePidFile(filename string, pid int) error {
+	return ioutil.WriteFile(filename, []byte(fmt.Sprintln(pid)), 0644)
+}
+
+// persistPid makes sure the pidfile in run path records the pid of the server, which is
+// the only durable link to the process on restore. When the pidfile can not be written,
+// the server is marked unrecoverable, and it will be reprovisioned instead of adopted on
+// restore.
+func (s *Server) persistPid(pid int) {
+	if len(s.runPath) == 0 || pid < 0 {
+		return
+	}
+	pidFile := path.Join(s.runPath, "ss_server.pid")
+	marker := path.Join(s.runPath, unrecoverableMarker)
+
+	err := s.pidRetry.do(func() error {
+		if p, err := readPidFile(pidFile); err == nil && p == pid {
+			return nil
+		}
+		return writePidFile(pidFile, pid)
+	})
+	if err == nil {
+		s.unrecoverable = false
+		os.Remove(marker)
+		return
+	}
+
+	s.log().Warnf("Can not save pidfile of server(%d), it will not be recovered on restart, %s", s.Port, err)
+	s.unrecoverable = true
+	os.Remove(pidFile)
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		s.log().Warnf("Can not mark server(%d) unrecoverable, %s", s.Port, err)
+	}
+}
+
+// Recoverable returns false if the pidfile of the running server failed to be saved, the
+// server will be restarted rather than recovered when the slave restarts.
+func (s *Server) Recoverable() bool {
+	s.rtMu.RLock()
+	defer s.rtMu.RUnlock()
+
+	return !s.unrecoverable
+}
+
+// trustPidFile returns errUnrecoverable if the server in run path is marked unrecoverable.
+func trustPidFile(runPath string) error {
+	if _, err := os.Stat(path.Join(runPath, unrecoverableMarker)); err == nil {
+		return errUnrecoverable
+	}
+	return nil
+}
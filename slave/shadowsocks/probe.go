@@ -0,0 +1,138 @@
+package shadowsocks
+
+import (
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// defaultBinary is the ss-server binary used when none is configured.
+const defaultBinary = "ss-server"
+
+// binaryProbe is the capabilities of a ss-server binary.
+type binaryProbe struct {
+	helpOnce sync.Once
+	help     string
+
+	methodsOnce sync.Once
+	methods     []MethodInfo
+}
+
+var (
+	probesMu sync.Mutex
+	probes   = make(map[string]*binaryProbe)
+)
+
+// probeOf returns the probe of the binary, which is shared by all servers of it.
+func probeOf(binary string) *binaryProbe {
+	probesMu.Lock()
+	defer probesMu.Unlock()
+
+	p, ok := probes[binary]
+	if !ok {
+		p = &binaryProbe{}
+		probes[binary] = p
+	}
+	return p
+}
+
+// binaryHelp returns the help text of ss-server, which is used to probe the capabilities
+// of the installed binary. It's probed only once.
+func binaryHelp(binary string) string {
+	p := probeOf(binary)
+	p.helpOnce.Do(func() {
+		// ss-server exits with non-zero code after printing help, so ignore the error
+		out, _ := exec.Command(binary, "--help").CombinedOutput()
+		p.help = string(out)
+	})
+	return p.help
+}
+
+// binarySupports checks if the flag is mentioned in the help text of ss-server. It's
+// assumed to be supported when the binary can not be probed.
+func binarySupports(binary, flag string) bool {
+	help := binaryHelp(binary)
+	return len(help) == 0 || strings.Contains(help, flag)
+}
+
+var methodNameRegex = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// parseMethods parses the encrypt methods listed after "Encrypt method:" in the help text
+// of ss-server, e.g.
+//
+//	-m <encrypt_method>        Encrypt method: rc4-md5,
+//	                           aes-128-gcm, aes-192-gcm, aes-256-gcm,
+//	                           salsa20, chacha20 and chacha20-ietf.
+//	                           The default cipher is chacha20-ietf-poly1305.
+func parseMethods(help string) []string {
+	const marker = "Encrypt method:"
+
+	var list []string
+	found := false
+	for _, line := range strings.Split(help, "\n") {
+		if !found {
+			i := strings.Index(line, marker)
+			if i < 0 {
+				continue
+			}
+			found = true
+			line = line[i+len(marker):]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "-") || strings.HasPrefix(line, "[") ||
+			strings.Contains(line, "default") {
+			break
+		}
+		list = append(list, line)
+
+		// the list ends with a period
+		if strings.HasSuffix(line, ".") {
+			break
+		}
+	}
+
+	text := strings.Replace(strings.Join(list, " "), " and ", ",", -1)
+	var names []string
+	for _, name := range strings.Split(text, ",") {
+		name = strings.Trim(name, " .")
+		if methodNameRegex.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// isAEADMethod guesses if the method is an AEAD cipher by its name.
+func isAEADMethod(m string) bool {
+	return strings.HasSuffix(m, "-gcm") || strings.HasSuffix(m, "-poly1305")
+}
+
+// availableMethods returns the encrypt methods supported by the installed ss-server. The
+// built-in list is used if they can not be discovered. It's discovered only once.
+func availableMethods(binary string, logger Logger) []MethodInfo {
+	p := probeOf(binary)
+	p.methodsOnce.Do(func() {
+		names := parseMethods(binaryHelp(binary))
+		if len(names) == 0 {
+			logger.Warnf("Can not discover the encrypt methods of %s, use the built-in list", binary)
+			p.methods = methods
+			return
+		}
+
+		known := make(map[string]MethodInfo, len(methods))
+		for _, m := range methods {
+			known[m.Name] = m
+		}
+		p.methods = make([]MethodInfo, 0, len(names))
+		for _, name := range names {
+			m, ok := known[name]
+			if !ok {
+				m = MethodInfo{Name: name, AEAD: isAEADMethod(name)}
+			}
+			p.methods = append(p.methods, m)
+		}
+		logger.Debugf("Discovered encrypt methods of %s: %v", binary, names)
+	})
+	return p.methods
+}
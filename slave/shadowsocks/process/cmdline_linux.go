@@ -0,0 +1,45 @@
+// +build linux
+
+package process
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Read command lines from /proc/<pid>/cmdline, arguments are separated by '\0'.
+func cmdlines() (map[int][]string, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[int][]string)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		args, err := cmdline(pid)
+		if err != nil || len(args) == 0 {
+			// process exited or is a kernel thread
+			continue
+		}
+		result[pid] = args
+	}
+	return result, nil
+}
+
+// Read the command line of process from /proc/<pid>/cmdline, it's empty for kernel threads.
+func cmdline(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(path.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"), nil
+}
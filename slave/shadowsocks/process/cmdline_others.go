@@ -0,0 +1,13 @@
+// +build !linux
+
+package process
+
+// Listing processes is not supported on non-linux system.
+func cmdlines() (map[int][]string, error) {
+	return nil, ErrNotSupported
+}
+
+// Reading command lines is not supported on non-linux system.
+func cmdline(pid int) ([]string, error) {
+	return nil, ErrNotSupported
+}
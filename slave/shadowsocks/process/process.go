@@ -1,6 +1,30 @@
 package process
 
+import (
+	"errors"
+	"os"
+)
+
+// ErrNotSupported is returned when the processes can't be inspected on this system.
+var ErrNotSupported = errors.New("inspecting processes is not supported")
+
 // Alive returns if the process is still alive
 func Alive(pid int) bool {
 	return alive(pid)
 }
+
+// Terminate asks the process to exit, e.g. by SIGTERM. ErrNotSupported is returned if
+// it can't be done on this system.
+func Terminate(p *os.Process) error {
+	return terminate(p)
+}
+
+// Cmdlines returns the command lines of all running processes indexed by pid.
+func Cmdlines() (map[int][]string, error) {
+	return cmdlines()
+}
+
+// Cmdline returns the command line of the process.
+func Cmdline(pid int) ([]string, error) {
+	return cmdline(pid)
+}
@@ -2,7 +2,14 @@
 
 package process
 
-import "syscall"
+import (
+	"os"
+	"syscall"
+)
+
+func terminate(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
 
 // Unix kill 0, check if process is alive
 func alive(pid int) bool {
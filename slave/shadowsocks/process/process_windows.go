@@ -4,6 +4,10 @@ package process
 
 import "os"
 
+func terminate(p *os.Process) error {
+	return ErrNotSupported
+}
+
 func alive(pid int) bool {
 	p, err := os.FindProcess(pid)
 	return err == nil && p != nil
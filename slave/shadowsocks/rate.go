@@ -0,0 +1,53 @@
+package shadowsocks
+
+import (
+	"math"
+	"time"
+)
+
+// rateWindow is the time constant of the exponentially weighted rate of traffic, the
+// weight of a sample decays to 1/e after it.
+const rateWindow = 10 * time.Second
+
+// decay returns the weight of the rate measured d ago.
+func decay(d time.Duration) float64 {
+	return math.Exp(-d.Seconds() / rateWindow.Seconds())
+}
+
+// withRate returns the stat with the rate updated from the previous stat. The rate of
+// the first stat is 0, and the rate over a long gap is averaged over the gap rather
+// than counted as a burst.
+func (stat Stat) withRate(prev Stat) Stat {
+	if prev.UpdatedAt.IsZero() {
+		stat.Rate = 0
+		return stat
+	}
+	elapsed := stat.UpdatedAt.Sub(prev.UpdatedAt)
+	if elapsed <= 0 {
+		stat.Rate = prev.Rate
+		return stat
+	}
+
+	delta := stat.Traffic - prev.Traffic
+	if delta < 0 {
+		// counter reset
+		delta = stat.Traffic
+	}
+	current := float64(delta) / elapsed.Seconds()
+	w := decay(elapsed)
+	stat.Rate = w*prev.Rate + (1-w)*current
+	return stat
+}
+
+// GetRate returns the exponentially weighted rate of traffic in bytes per second. The
+// rate decays while no stats are received.
+func (s *Server) GetRate() float64 {
+	stat := s.GetStat()
+	if stat.UpdatedAt.IsZero() {
+		return 0
+	}
+	if idle := s.now().Sub(stat.UpdatedAt); idle > 0 {
+		return stat.Rate * decay(idle)
+	}
+	return stat.Rate
+}
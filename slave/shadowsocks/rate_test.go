@@ -0,0 +1,77 @@
+package shadowsocks
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock advanced by tests.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestRate(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2017, 5, 10, 0, 0, 0, 0, time.UTC)}
+	mgr := newTestManager(t, newFakeSupervisor(), WithClock(clock))
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+	s := mgr.servers[20001]
+
+	// the first sample has no rate
+	mgr.handleStat([]byte(`stat: {"20001":1000}`))
+	if rate := s.GetRate(); rate != 0 {
+		t.Errorf("got rate %f of the first sample, want 0", rate)
+	}
+
+	// 1000 bytes in a window is weighted by 1-1/e
+	clock.advance(rateWindow)
+	mgr.handleStat([]byte(`stat: {"20001":2000}`))
+	want := (1 - math.Exp(-1)) * 1000 / rateWindow.Seconds()
+	if rate := s.GetRate(); !almostEqual(rate, want) {
+		t.Errorf("got rate %f, want %f", rate, want)
+	}
+
+	// and decays while no stats are received
+	clock.advance(rateWindow)
+	if rate := s.GetRate(); !almostEqual(rate, want*math.Exp(-1)) {
+		t.Errorf("got rate %f after a window without stats, want %f", rate, want*math.Exp(-1))
+	}
+}
+
+func TestRateLongGap(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2017, 5, 10, 0, 0, 0, 0, time.UTC)}
+	mgr := newTestManager(t, newFakeSupervisor(), WithClock(clock))
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+	s := mgr.servers[20001]
+
+	mgr.handleStat([]byte(`stat: {"20001":0}`))
+	// the traffic over a long gap is averaged over it rather than counted as a spike
+	clock.advance(100 * rateWindow)
+	mgr.handleStat([]byte(`stat: {"20001":1000000}`))
+	avg := 1000000 / (100 * rateWindow).Seconds()
+	if rate := s.GetRate(); rate > avg {
+		t.Errorf("got rate %f after a long gap, want at most the average %f", rate, avg)
+	}
+}
@@ -0,0 +1,70 @@
+package shadowsocks
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	proc "github.com/arkbriar/ssmgr/slave/shadowsocks/process"
+)
+
+// managedConf returns the config file of the ss-server process started by manager,
+// which is recognized by the config file in managed path.
+func (mgr *manager) managedConf(args []string) (string, bool) {
+	if len(args) == 0 || path.Base(args[0]) != path.Base(mgr.binary) {
+		return "", false
+	}
+	for i := 1; i+1 < len(args); i++ {
+		if args[i] != "-c" {
+			continue
+		}
+		conf := path.Clean(args[i+1])
+		if path.Base(conf) != "ss_server.conf" || !strings.HasPrefix(conf, path.Clean(mgr.path)+"/") {
+			return "", false
+		}
+		return conf, true
+	}
+	return "", false
+}
+
+// trackedPid returns the pid of the server process tracked by manager, or -1 if there's none.
+func (s *Server) trackedPid() int {
+	s.rtMu.RLock()
+	defer s.rtMu.RUnlock()
+
+	if s.runtime == nil || s.runtime.handle == nil {
+		return -1
+	}
+	return s.runtime.handle.Pid()
+}
+
+func (mgr *manager) ReapDuplicates() error {
+	cmdlines, err := proc.Cmdlines()
+	if err != nil {
+		return err
+	}
+
+	tracked := make(map[int]bool)
+	mgr.serverMu.RLock()
+	for _, s := range mgr.servers {
+		tracked[s.trackedPid()] = true
+	}
+	mgr.serverMu.RUnlock()
+
+	for pid, args := range cmdlines {
+		conf, ok := mgr.managedConf(args)
+		if !ok || tracked[pid] {
+			continue
+		}
+
+		mgr.logger.Warnf("Kill duplicate ss-server(%d) of %s", pid, conf)
+		p, err := os.FindProcess(pid)
+		if err != nil {
+			continue
+		}
+		if err := p.Kill(); err != nil {
+			mgr.logger.Warnf("Can not kill ss-server(%d), %s", pid, err)
+		}
+	}
+	return nil
+}
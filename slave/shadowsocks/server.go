@@ -2,14 +2,18 @@ package shadowsocks
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
 	"path"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -18,7 +22,7 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	proc "github.com/arkbriar/ssmgr/slave/shadowsocks/process"
+	"github.com/arkbriar/ssmgr/internal/backoff"
 	"github.com/coreos/go-iptables/iptables"
 )
 
@@ -28,8 +32,8 @@ var (
 )
 
 func init() {
-	if _, err := exec.LookPath("ss-server"); err != nil {
-		log.Fatalf("Can not find ss-server in $PATH. Install it")
+	if _, err := exec.LookPath(defaultBinary); err != nil {
+		log.Warnf("Can not find ss-server in $PATH. Install it or configure the binary path")
 	}
 
 	// initialize ipt and warn unsupported
@@ -45,24 +49,90 @@ func init() {
 	}
 }
 
+// UDPRelayMode is the mode of udp relay of ss-server.
+type UDPRelayMode int
+
+const (
+	// UDPRelayNone relays tcp only, it's the default.
+	UDPRelayNone UDPRelayMode = iota
+	// UDPRelayEnabled relays both tcp and udp.
+	UDPRelayEnabled
+	// UDPRelayOnly relays udp only.
+	UDPRelayOnly
+)
+
+var udpRelayModeNames = map[UDPRelayMode]string{
+	UDPRelayNone:    "none",
+	UDPRelayEnabled: "enabled",
+	UDPRelayOnly:    "only",
+}
+
+func (m UDPRelayMode) String() string {
+	if name, ok := udpRelayModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("UDPRelayMode(%d)", int(m))
+}
+
+// MarshalJSON encodes the mode as its name.
+func (m UDPRelayMode) MarshalJSON() ([]byte, error) {
+	if _, ok := udpRelayModeNames[m]; !ok {
+		return nil, fmt.Errorf("invalid udp relay mode %d", int(m))
+	}
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON decodes the mode from its name, or from a bool saved by the prior
+// versions, where true means enabled.
+func (m *UDPRelayMode) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		if enabled {
+			*m = UDPRelayEnabled
+		} else {
+			*m = UDPRelayNone
+		}
+		return nil
+	}
+
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	for mode, n := range udpRelayModeNames {
+		if n == name {
+			*m = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown udp relay mode %q", name)
+}
+
 type serverOptions struct {
-	UDPRelay       bool
-	IPv6First      bool
-	MPTCP          bool
-	TCPFastOpen    bool
-	Auth           bool
-	NameServer     string
-	PidFile        string
-	ManagerAddress string
-	Interface      string
-	FireWall       bool
-	Verbose        bool
+	UDPRelay       UDPRelayMode `json:"udp_relay,omitempty"`
+	IPv6First      bool         `json:"ipv6_first,omitempty"`
+	MPTCP          bool         `json:"mptcp,omitempty"`
+	TCPFastOpen    bool         `json:"fast_open,omitempty"`
+	NoDelay        bool         `json:"no_delay,omitempty"`
+	ReusePort      bool         `json:"reuse_port,omitempty"`
+	Auth           bool         `json:"auth,omitempty"`
+	NameServer     string       `json:"nameserver,omitempty"`
+	PidFile        string       `json:"pid_file,omitempty"`
+	ManagerAddress string       `json:"manager_address,omitempty"`
+	Interface      string       `json:"interface,omitempty"`
+	FireWall       bool         `json:"firewall,omitempty"`
+	Verbose        bool         `json:"verbose,omitempty"`
+	Plugin         string       `json:"plugin,omitempty"`
+	PluginOpts     string       `json:"plugin_opts,omitempty"`
 }
 
 func (o *serverOptions) args() []string {
 	args := make([]string, 0)
-	if o.UDPRelay {
+	switch o.UDPRelay {
+	case UDPRelayEnabled:
 		args = append(args, "-u")
+	case UDPRelayOnly:
+		args = append(args, "-U")
 	}
 	if o.IPv6First {
 		args = append(args, "-6")
@@ -73,6 +143,12 @@ func (o *serverOptions) args() []string {
 	if o.TCPFastOpen {
 		args = append(args, "--fast-open")
 	}
+	if o.NoDelay {
+		args = append(args, "--no-delay")
+	}
+	if o.ReusePort {
+		args = append(args, "--reuse-port")
+	}
 	if o.Auth {
 		args = append(args, "-A")
 	}
@@ -91,6 +167,12 @@ func (o *serverOptions) args() []string {
 	if o.Verbose {
 		args = append(args, "-v")
 	}
+	if len(o.Plugin) != 0 {
+		args = append(args, "--plugin", o.Plugin)
+	}
+	if len(o.PluginOpts) != 0 {
+		args = append(args, "--plugin-opts", o.PluginOpts)
+	}
 	return args
 }
 
@@ -98,62 +180,183 @@ func (o *serverOptions) reset() {
 	*o = serverOptions{}
 }
 
-var methods = []string{
-	"table", "rc4", "rc4-md5", "aes-128-cfb", "aes-192-cfb", "aes-256-cfb",
-	"aes-128-ctr", "aes-192-ctr", "aes-256-ctr", "bf-cfb", "camellia-128-cfb",
-	"camellia-192-cfb", "camellia-256-cfb", "cast5-cfb", "des-cfb", "idea-cfb",
-	"rc2-cfb", "seed-cfb", "salsa20", "chacha20", "chacha20-ietf",
+// validate checks if the options are supported by ss-server binary.
+func (o *serverOptions) validate(binary string) error {
+	if _, ok := udpRelayModeNames[o.UDPRelay]; !ok {
+		return fmt.Errorf("invalid udp relay mode %d", int(o.UDPRelay))
+	}
+	if o.UDPRelay == UDPRelayOnly {
+		switch {
+		case o.TCPFastOpen:
+			return errors.New("tcp fast open is set with udp relay only")
+		case o.NoDelay:
+			return errors.New("tcp no delay is set with udp relay only")
+		case o.MPTCP:
+			return errors.New("mptcp is set with udp relay only")
+		case len(o.Plugin) != 0:
+			return errors.New("plugin is set with udp relay only")
+		}
+	}
+	if o.NoDelay && !binarySupports(binary, "--no-delay") {
+		return errors.New("--no-delay is not supported by ss-server")
+	}
+	if o.ReusePort && !binarySupports(binary, "--reuse-port") {
+		return errors.New("--reuse-port is not supported by ss-server")
+	}
+	if len(o.PluginOpts) != 0 && len(o.Plugin) == 0 {
+		return errors.New("plugin options are set without plugin")
+	}
+	if len(o.Plugin) != 0 && !binarySupports(binary, "--plugin") {
+		return errors.New("--plugin is not supported by ss-server")
+	}
+	return nil
 }
 
-// validEncryptMethod checks if the encrypt method is supported.
-func validEncryptMethod(m string) bool {
-	for _, method := range methods {
-		if m == method {
+// MethodInfo describes an encrypt method and how it's classified.
+type MethodInfo struct {
+	Name       string `json:"name"`
+	AEAD       bool   `json:"aead"`
+	Deprecated bool   `json:"deprecated"`
+}
+
+var methods = []MethodInfo{
+	{Name: "table", Deprecated: true},
+	{Name: "rc4", Deprecated: true},
+	{Name: "rc4-md5", Deprecated: true},
+	{Name: "aes-128-cfb"},
+	{Name: "aes-192-cfb"},
+	{Name: "aes-256-cfb"},
+	{Name: "aes-128-ctr"},
+	{Name: "aes-192-ctr"},
+	{Name: "aes-256-ctr"},
+	{Name: "bf-cfb", Deprecated: true},
+	{Name: "camellia-128-cfb"},
+	{Name: "camellia-192-cfb"},
+	{Name: "camellia-256-cfb"},
+	{Name: "cast5-cfb", Deprecated: true},
+	{Name: "des-cfb", Deprecated: true},
+	{Name: "idea-cfb", Deprecated: true},
+	{Name: "rc2-cfb", Deprecated: true},
+	{Name: "seed-cfb", Deprecated: true},
+	{Name: "salsa20"},
+	{Name: "chacha20"},
+	{Name: "chacha20-ietf"},
+	{Name: "aes-128-gcm", AEAD: true},
+	{Name: "aes-192-gcm", AEAD: true},
+	{Name: "aes-256-gcm", AEAD: true},
+	{Name: "chacha20-ietf-poly1305", AEAD: true},
+	{Name: "xchacha20-ietf-poly1305", AEAD: true},
+}
+
+// validEncryptMethod checks if the encrypt method is supported by the binary.
+func validEncryptMethod(binary, m string, logger Logger) bool {
+	for _, method := range availableMethods(binary, logger) {
+		if m == method.Name {
 			return true
 		}
 	}
 	return false
 }
 
+// DeprecatedEncryptMethod checks if the encrypt method is known to be insecure, callers
+// should warn about the servers using it.
+func DeprecatedEncryptMethod(m string) bool {
+	for _, method := range methods {
+		if m == method.Name {
+			return method.Deprecated
+		}
+	}
+	return false
+}
+
+const randomPasswordBytes = 12
+
+// RandomPassword generates a strong random password for ss-server.
+func RandomPassword() (string, error) {
+	b := make([]byte, randomPasswordBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 func validPort(p int32) bool {
 	return p > 0 && p < (1<<16)
 }
 
 type serverRuntime struct {
-	proc *os.Process
+	handle Handle
+	sup    Supervisor
 }
 
 func (rt *serverRuntime) alive() bool {
-	return rt.proc != nil && proc.Alive(rt.proc.Pid)
+	return rt.handle != nil && rt.sup.Alive(rt.handle)
+}
+
+func (rt *serverRuntime) stop(logger Logger) {
+	if err := rt.sup.Stop(rt.handle); err != nil {
+		logger.Debugf("Stop ss-server: %s", err)
+	}
 }
 
 type serverExtra struct {
 	StartTime time.Time `json:"start_time"`
+	// Traffic carried over from the process replaced by an update
+	TrafficBase int64 `json:"traffic_base,omitempty"`
+	RxBase      int64 `json:"rx_base,omitempty"`
+	TxBase      int64 `json:"tx_base,omitempty"`
 }
 
 // Server represents a ss-server instance.
 type Server struct {
-	Host        string       `json:"server"`
-	Port        int32        `json:"server_port"`
-	Password    string       `json:"password"`
-	Method      string       `json:"method"`
-	Timeout     int          `json:"timeout"`
-	Extra       *serverExtra `json:"extra,omitempty"`
-	opts        serverOptions
-	connLimit   int
-	watchDaemon struct {
+	Host           string       `json:"server"`
+	Port           int32        `json:"server_port"`
+	Password       string       `json:"password"`
+	Method         string       `json:"method"`
+	Timeout        int          `json:"timeout"`
+	UserID         string       `json:"user_id,omitempty"`
+	Quota          int64        `json:"quota,omitempty"`           // Traffic limit in bytes, 0 means unlimited
+	BandwidthLimit int64        `json:"bandwidth_limit,omitempty"` // Bytes per second, 0 means unlimited
+	Namespace      string       `json:"namespace,omitempty"`
+	Extra          *serverExtra `json:"extra,omitempty"`
+	opts           serverOptions
+	connLimit      int
+	watchDaemon    struct {
 		enable bool
 		cancel context.CancelFunc
 	}
 	rtMu    sync.RWMutex
 	runPath string
 	runtime *serverRuntime
+	sup     Supervisor
+	clock   Clock
 	stat    atomic.Value
+
+	// pidfile of the running server failed to be saved
+	unrecoverable bool
+	pidRetry      pidFileRetry
+	// timeout to verify the port is bound after start, 0 means no verification
+	bindCheck time.Duration
+	// how long the process is watched after start, earlyExitWindow if 0
+	startGrace time.Duration
+	// last sampled resource usage of the process
+	usage atomic.Value
+	// last counted established connections
+	conns atomic.Value
+	// path of ss-server binary, "ss-server" if empty
+	binary string
+	logger Logger
 }
 
 // WithUDPRelay enables udp relay.
 func (s *Server) WithUDPRelay() *Server {
-	s.opts.UDPRelay = true
+	s.opts.UDPRelay = UDPRelayEnabled
+	return s
+}
+
+// WithUDPRelayMode sets the mode of udp relay, udp is not relayed by default.
+func (s *Server) WithUDPRelayMode(mode UDPRelayMode) *Server {
+	s.opts.UDPRelay = mode
 	return s
 }
 
@@ -175,6 +378,26 @@ func (s *Server) WithTCPFastOpen() *Server {
 	return s
 }
 
+// WithNoDelay enables TCP_NODELAY.
+func (s *Server) WithNoDelay() *Server {
+	s.opts.NoDelay = true
+	return s
+}
+
+// WithPlugin runs the server behind the SIP003 plugin, e.g. obfs-server or v2ray-plugin,
+// with the plugin options.
+func (s *Server) WithPlugin(plugin, opts string) *Server {
+	s.opts.Plugin = plugin
+	s.opts.PluginOpts = opts
+	return s
+}
+
+// WithReusePort enables SO_REUSEPORT.
+func (s *Server) WithReusePort() *Server {
+	s.opts.ReusePort = true
+	return s
+}
+
 // WithOneTimeAuth enables one time auth.
 func (s *Server) WithOneTimeAuth() *Server {
 	s.opts.Auth = true
@@ -247,8 +470,7 @@ func (s *Server) WithRunPath(runPath string) *Server {
 // WithDefaults sets the default options for the server.
 func (s *Server) WithDefaults() *Server {
 	return s.WithConnLimit(32).
-		WithWatchDaemon().
-		WithUDPRelay()
+		WithWatchDaemon()
 }
 
 // ResetOptions sets all the server options to default.
@@ -257,6 +479,13 @@ func (s *Server) ResetOptions() *Server {
 	return s
 }
 
+func (s *Server) now() time.Time {
+	if s.clock == nil {
+		return RealClock.Now()
+	}
+	return s.clock.Now()
+}
+
 func (s *Server) args() []string {
 	var args []string
 	if len(s.runPath) != 0 {
@@ -268,17 +497,77 @@ func (s *Server) args() []string {
 }
 
 func (s *Server) valid() bool {
-	return len(s.Host) != 0 && validPort(s.Port) && len(s.Password) >= 8 && validEncryptMethod(s.Method) && s.Timeout > 0
+	return s.validate() == nil
+}
+
+// InvalidServerError lists the problems of an invalid server.
+type InvalidServerError struct {
+	Problems []string
+}
+
+func (e *InvalidServerError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInvalidServer, strings.Join(e.Problems, "; "))
+}
+
+// Is reports whether the target is ErrInvalidServer.
+func (e *InvalidServerError) Is(target error) bool {
+	return target == ErrInvalidServer
+}
+
+// hostnamePattern matches the hostnames defined in RFC 1123.
+var hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// Validate checks the server and returns an `*InvalidServerError` describing all the
+// problems found, the host must be an ip or a hostname. The host isn't resolved and a
+// privileged port isn't rejected here, ss-server reports them when it fails to bind.
+func (s *Server) Validate() error {
+	return s.validate()
+}
+
+func (s *Server) validate() error {
+	var problems []string
+	switch {
+	case len(s.Host) == 0:
+		problems = append(problems, "empty host")
+	case net.ParseIP(s.Host) != nil:
+	case len(s.Host) > 253 || !hostnamePattern.MatchString(s.Host):
+		problems = append(problems, fmt.Sprintf("invalid host %q", s.Host))
+	}
+	if !validPort(s.Port) {
+		problems = append(problems, fmt.Sprintf("invalid port %d", s.Port))
+	}
+	if len(s.Password) < 8 {
+		problems = append(problems, "password shorter than 8")
+	}
+	if !validEncryptMethod(s.binaryPath(), s.Method, s.log()) {
+		problems = append(problems, fmt.Sprintf("unsupported method %q", s.Method))
+	}
+	if s.Timeout <= 0 {
+		problems = append(problems, fmt.Sprintf("invalid timeout %d", s.Timeout))
+	}
+
+	if len(problems) != 0 {
+		return &InvalidServerError{Problems: problems}
+	}
+	return nil
+}
+
+// binaryPath returns the ss-server binary this server runs.
+func (s *Server) binaryPath() string {
+	if len(s.binary) == 0 {
+		return defaultBinary
+	}
+	return s.binary
 }
 
 // command constructs a new shadowsock server command
 func (s *Server) command() *exec.Cmd {
-	return exec.Command("ss-server", s.args()...)
+	return exec.Command(s.binaryPath(), s.args()...)
 }
 
 // Command returns the command string this server starts with.
 func (s *Server) Command() string {
-	return fmt.Sprintf("ss-server %s", strings.Join(s.args(), " "))
+	return fmt.Sprintf("%s %s", s.binaryPath(), strings.Join(s.args(), " "))
 }
 
 func (s *Server) clone() *Server {
@@ -302,6 +591,11 @@ var (
 	errWatchDaemonIsNotStarted   = errors.New("watch daemon is not started")
 )
 
+const (
+	watchInterval     = 5 * time.Second
+	maxReviveInterval = 5 * time.Minute
+)
+
 func (s *Server) startWatchDaemon() error {
 	if !s.watchDaemon.enable {
 		return errWatchDaemonNotEnabled
@@ -313,20 +607,30 @@ func (s *Server) startWatchDaemon() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	s.watchDaemon.cancel = cancel
 	go func(ctx context.Context) {
+		// back off when the server can not be restarted
+		retry := backoff.Backoff{
+			Initial: watchInterval,
+			Max:     maxReviveInterval,
+			Jitter:  0.2,
+		}
+		wait := watchInterval
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(5 * time.Second):
+			case <-time.After(wait):
+				wait = watchInterval
 				if !s.Alive() {
-					log.Warnf("Server(%s) is detected dead", s)
+					s.log().Warnf("Server(%s) is detected dead", s)
 
 					if err := s.revive(); err != nil {
 						if err != errServerAlive {
-							log.Warnf("Can not restart server(%s), %s", s, err)
+							wait = retry.Next()
+							s.log().Warnf("Can not restart server(%s), %s. Retry in %s", s, err, wait)
 						}
 					} else {
-						log.Infof("Server(%s) is back to work", s)
+						retry.Reset()
+						s.log().Infof("Server(%s) is back to work", s)
 					}
 				}
 			}
@@ -335,6 +639,14 @@ func (s *Server) startWatchDaemon() error {
 	return nil
 }
 
+// watchDaemonRunning returns false if watch daemon is enabled but not started.
+func (s *Server) watchDaemonRunning() bool {
+	s.rtMu.RLock()
+	defer s.rtMu.RUnlock()
+
+	return !s.watchDaemon.enable || s.watchDaemon.cancel != nil
+}
+
 func (s *Server) stopWatchDaemon() error {
 	if !s.watchDaemon.enable {
 		return errWatchDaemonNotEnabled
@@ -393,12 +705,71 @@ func (s *Server) checkConnLimit() (bool, error) {
 	return ipt.Exists("filter", "INPUT", s.connLimitIPTablesRule()...)
 }
 
+func (s *Server) drainIPTablesRule() []string {
+	return []string{"-p", "tcp", "--syn", "--dport", fmt.Sprint(s.Port), "-j", "REJECT", "--reject-with", "tcp-reset",
+		"-m", "comment", "--comment", fmt.Sprintf("SS_DRAIN(%d)", s.Port)}
+}
+
+func (s *Server) createDrain() error {
+	if ipt == nil {
+		return errIPTablesNotSupported
+	}
+
+	// insert to the head of chain to go before any accept rule
+	return ipt.Insert("filter", "INPUT", 1, s.drainIPTablesRule()...)
+}
+
+func (s *Server) deleteDrain() error {
+	if ipt == nil {
+		return errIPTablesNotSupported
+	}
+
+	return ipt.Delete("filter", "INPUT", s.drainIPTablesRule()...)
+}
+
+const drainCheckInterval = 500 * time.Millisecond
+
+// drain rejects the new connections to the server and waits at most timeout for the
+// established ones to finish. When iptables is not supported, new connections are still
+// accepted during the timeout. It returns a function to accept new connections again.
+func (s *Server) drain(timeout time.Duration) func() {
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	err := s.createDrain()
+	if err != nil && err != errIPTablesNotSupported {
+		s.log().Warn(err)
+	}
+	undrain := func() {
+		if err == nil {
+			if err := s.deleteDrain(); err != nil {
+				s.log().Warn(err)
+			}
+		}
+	}
+
+	deadline := time.After(timeout)
+	for {
+		n, err := countEstablished(s.Port)
+		if err == nil && n == 0 {
+			return undrain
+		}
+		select {
+		case <-deadline:
+			s.log().Infof("Server(%d) is not drained in %s", s.Port, timeout)
+			return undrain
+		case <-time.After(drainCheckInterval):
+		}
+	}
+}
+
 func readPidFile(filename string) (int, error) {
 	pidname, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return 0, err
 	}
-	pid, err := strconv.Atoi(string(pidname))
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidname)))
 	if err != nil {
 		return 0, err
 	}
@@ -413,8 +784,20 @@ func findProcFromPidFile(filename string) (*os.Process, error) {
 	return os.FindProcess(pid)
 }
 
+// serverConf is the content of config file. Options are saved along with the server
+// so that they can be restored, and they are ignored by ss-server.
+type serverConf struct {
+	*Server
+	Options *serverOptions `json:"ssmgr_options,omitempty"`
+}
+
+// marshalConf returns the content of config file.
+func (s *Server) marshalConf() ([]byte, error) {
+	return json.MarshalIndent(&serverConf{Server: s, Options: &s.opts}, "", "  ")
+}
+
 func (s *Server) save(filename string) error {
-	data, err := json.MarshalIndent(s, "", "  ")
+	data, err := s.marshalConf()
 	if err != nil {
 		return err
 	}
@@ -430,7 +813,7 @@ func (s *Server) load(filename string) error {
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data, s)
+	return json.Unmarshal(data, &serverConf{Server: s, Options: &s.opts})
 }
 
 var (
@@ -439,40 +822,34 @@ var (
 	errServerNotStarted     = errors.New("server not started")
 )
 
-func (s *Server) exec() error {
-	cmd := s.command()
+// supervisor returns the supervisor running the server, `ExecSupervisor` by default.
+func (s *Server) supervisor() Supervisor {
+	if s.sup == nil {
+		return ExecSupervisor{}
+	}
+	return s.sup
+}
 
-	// redirect the stdout and stderr to ss_server.log when pidfile is not given
-	if len(s.runPath) != 0 && len(s.opts.PidFile) == 0 {
-		logw, err := os.Create(path.Join(s.runPath, "ss_server.log"))
-		if err != nil {
-			log.Warnf("Can not open log file, %s", err)
-		} else {
-			cmd.Stdout, cmd.Stderr = logw, logw
-		}
+func (s *Server) exec() error {
+	sup := s.supervisor()
+	h, err := sup.Start(s)
+	if err != nil {
+		return err
+	}
+	s.runtime = &serverRuntime{
+		handle: h,
+		sup:    sup,
 	}
 
-	// ss-server will fork and exit when pidfile is specified, so run it
-	if len(s.opts.PidFile) != 0 {
-		if err := cmd.Run(); err != nil {
-			return err
-		}
-		proc, err := findProcFromPidFile(s.opts.PidFile)
-		if err != nil {
-			log.Warn(err)
-			return errors.New("can not get process from pid file")
-		}
-		s.runtime = &serverRuntime{
-			proc: proc,
-		}
-	} else {
-		if err := cmd.Start(); err != nil {
+	if s.bindCheck > 0 {
+		if err := s.waitBound(s.bindCheck); err != nil {
+			rt := s.runtime
+			s.runtime = nil
+			rt.stop(s.log())
 			return err
 		}
-		s.runtime = &serverRuntime{
-			proc: cmd.Process,
-		}
 	}
+	s.persistPid(h.Pid())
 	return nil
 }
 
@@ -493,6 +870,15 @@ func (s *Server) afterStart() []error {
 		}
 	}
 
+	if s.BandwidthLimit > 0 {
+		err := s.createShaping()
+		if err == errShapingNotSupported {
+			s.log().Warnf("Bandwidth of server(%d) is not limited, it requires root and the interface", s.Port)
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	if len(errs) == 0 {
 		return nil
 	}
@@ -500,8 +886,17 @@ func (s *Server) afterStart() []error {
 }
 
 func (s *Server) start() error {
-	if !s.valid() {
-		return errors.New("invalid server configuration")
+	return s.resume(&serverExtra{StartTime: s.now()})
+}
+
+// resume starts the server continuing the stats in extra, e.g. the ones of the server
+// it replaces.
+func (s *Server) resume(extra *serverExtra) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if err := s.opts.validate(s.binaryPath()); err != nil {
+		return err
 	}
 
 	if s.runtime != nil {
@@ -512,21 +907,19 @@ func (s *Server) start() error {
 		return errors.New("start server without run path is not supported")
 	}
 
-	s.Extra = &serverExtra{
-		StartTime: time.Now(),
-	}
-	err := s.save(path.Join(s.runPath, "ss_server.conf"))
-	if err != nil {
-		return err
+	s.Extra = extra
+	confPath := path.Join(s.runPath, "ss_server.conf")
+	if err := s.save(confPath); err != nil {
+		return &ProvisioningError{Path: confPath, Err: err}
 	}
 
 	// execute and run actions after start
-	err = s.exec()
+	err := s.exec()
 	if err == nil {
 		errs := s.afterStart()
 		if errs != nil {
 			for _, err := range errs {
-				log.Warn(err)
+				s.log().Warn(err)
 			}
 		}
 	}
@@ -546,10 +939,7 @@ func (s *Server) kill() error {
 		return errServerNotStarted
 	}
 
-	proc := s.runtime.proc
-	s.runtime, s.Extra = nil, nil
-	proc.Kill()
-	proc.Wait()
+	s.detach().stop(s.log())
 	return nil
 }
 
@@ -558,24 +948,37 @@ func (s *Server) forceKill() {
 		return
 	}
 
-	proc := s.runtime.proc
-	s.runtime, s.Extra = nil, nil
-	proc.Kill()
-	proc.Wait()
+	s.detach().stop(s.log())
+}
+
+// detach removes the runtime from the server and returns it to be stopped. The extra is
+// kept, so the stopped server still reports its start time and stats, e.g. while it's
+// being replaced by an update.
+func (s *Server) detach() *serverRuntime {
+	rt := s.runtime
+	s.runtime = nil
+	return rt
 }
 
 func (s *Server) beforeStop() {
 	if s.connLimit > 0 {
 		err := s.deleteConnLimit()
 		if err != nil && err != errIPTablesNotSupported {
-			log.Warn(err)
+			s.log().Warn(err)
+		}
+	}
+
+	if s.BandwidthLimit > 0 {
+		err := s.deleteShaping()
+		if err != nil && err != errShapingNotSupported {
+			s.log().Warn(err)
 		}
 	}
 
 	if s.watchDaemon.enable {
 		err := s.stopWatchDaemon()
 		if err != nil {
-			log.Warn(err)
+			s.log().Warn(err)
 		}
 	}
 }
@@ -585,12 +988,29 @@ func (s *Server) stop() error {
 	return s.kill()
 }
 
-// Stop stops the server.
+// Stop stops the server. The process is waited to exit without holding the lock, so the
+// server can be read meanwhile.
 func (s *Server) Stop() error {
 	s.rtMu.Lock()
-	defer s.rtMu.Unlock()
+	s.beforeStop()
+	if s.runtime == nil {
+		s.rtMu.Unlock()
+		return errServerNotStarted
+	}
+	rt := s.detach()
+	s.rtMu.Unlock()
+
+	rt.stop(s.log())
+	return nil
+}
+
+// StopWithDrain stops the server after waiting at most drainTimeout for its connections
+// to finish.
+func (s *Server) StopWithDrain(drainTimeout time.Duration) error {
+	undrain := s.drain(drainTimeout)
+	defer undrain()
 
-	return s.stop()
+	return s.Stop()
 }
 
 // Restart restarts the server.
@@ -602,6 +1022,15 @@ func (s *Server) Restart() error {
 	return s.start()
 }
 
+// RestartWithDrain restarts the server after waiting at most drainTimeout for its
+// connections to finish.
+func (s *Server) RestartWithDrain(drainTimeout time.Duration) error {
+	undrain := s.drain(drainTimeout)
+	defer undrain()
+
+	return s.Restart()
+}
+
 // Alive returns if the server is alive
 func (s *Server) Alive() bool {
 	s.rtMu.RLock()
@@ -630,17 +1059,19 @@ func (s *Server) restoreRuntime(runPath string) error {
 	s.rtMu.Lock()
 	defer s.rtMu.Unlock()
 
-	proc, err := findProcFromPidFile(path.Join(runPath, "ss_server.pid"))
+	sup := s.supervisor()
+	h, err := sup.Recover(runPath)
 	if err != nil {
 		return err
 	}
 
 	s.runtime = &serverRuntime{
-		proc: proc,
+		handle: h,
+		sup:    sup,
 	}
 	if !s.runtime.alive() {
 		s.runtime = nil
-		log.Debugf("Recovered process is not alive, reset runtime")
+		s.log().Debugf("Recovered process is not alive, reset runtime")
 	}
 	return nil
 }
@@ -657,7 +1088,7 @@ func (s *Server) Restore(runPath string) error {
 	}
 	err = s.restoreRuntime(runPath)
 	if err != nil {
-		log.Warnf("Can not restore runtime of server (%s)", s)
+		s.log().Warnf("Can not restore runtime of server (%s), %s", s, err)
 	} else {
 		if s.Alive() {
 			s.afterStart()
@@ -667,11 +1098,31 @@ func (s *Server) Restore(runPath string) error {
 	return nil
 }
 
+// statBase returns the traffic carried over from the replaced process.
+func (s *Server) statBase() Stat {
+	if extra := s.Extra; extra != nil {
+		return Stat{Traffic: extra.TrafficBase, Rx: extra.RxBase, Tx: extra.TxBase}
+	}
+	return Stat{}
+}
+
 // Stat represents the statistics collected from a shadowsocks server
 type Stat struct {
-	Traffic int64 `json:"traffic"` // Transfered traffic in bytes
-	/* Rx      int64 `json:"rx"`      // Receive in bytes
-	 * Tx      int64 `json:"tx"`      // Transmit in bytes */
+	Traffic   int64     `json:"traffic"`    // Transfered traffic in bytes
+	Rx        int64     `json:"rx"`         // Receive in bytes, 0 if not reported
+	Tx        int64     `json:"tx"`         // Transmit in bytes, 0 if not reported
+	UpdatedAt time.Time `json:"updated_at"` // Time the stat is received, zero if never
+	Rate      float64   `json:"rate"`       // Weighted rate of traffic in bytes per second
+	// Established connections, 0 unless counted by `WithConnectionCount`
+	Connections int `json:"connections"`
+}
+
+// add returns the sum of traffic of both stats.
+func (stat Stat) add(o Stat) Stat {
+	stat.Traffic += o.Traffic
+	stat.Rx += o.Rx
+	stat.Tx += o.Tx
+	return stat
 }
 
 func (s *Server) updateStat(stat Stat) {
@@ -680,9 +1131,7 @@ func (s *Server) updateStat(stat Stat) {
 
 // GetStat returns the stats of the server.
 func (s *Server) GetStat() Stat {
-	stat := s.stat.Load()
-	if stat != nil {
-		return stat.(Stat)
-	}
-	return Stat{}
+	stat, _ := s.stat.Load().(Stat)
+	stat.Connections = s.connections()
+	return stat
 }
@@ -0,0 +1,242 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := func() *Server {
+		s := testServer(20001)
+		s.Timeout = 60
+		s.binary = "true"
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		modify func(s *Server)
+		ok     bool
+	}{
+		{"valid", func(s *Server) {}, true},
+		{"hostname", func(s *Server) { s.Host = "ss.example.com" }, true},
+		{"unresolvable hostname", func(s *Server) { s.Host = "nonexistent.invalid" }, true},
+		{"ipv6", func(s *Server) { s.Host = "::1" }, true},
+		{"privileged port", func(s *Server) { s.Port = 443 }, true},
+		{"empty host", func(s *Server) { s.Host = "" }, false},
+		{"invalid host", func(s *Server) { s.Host = "-bad_host" }, false},
+		{"zero port", func(s *Server) { s.Port = 0 }, false},
+		{"large port", func(s *Server) { s.Port = 65536 }, false},
+		{"short password", func(s *Server) { s.Password = "short" }, false},
+		{"unsupported method", func(s *Server) { s.Method = "rot13" }, false},
+		{"zero timeout", func(s *Server) { s.Timeout = 0 }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := valid()
+			tt.modify(s)
+			err := s.Validate()
+			if tt.ok && err != nil {
+				t.Errorf("got %v, want valid", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidServer) {
+				t.Errorf("got %v, want ErrInvalidServer", err)
+			}
+		})
+	}
+}
+
+func TestEncryptMethods(t *testing.T) {
+	for _, m := range []string{
+		"aes-128-gcm", "aes-192-gcm", "aes-256-gcm",
+		"chacha20-ietf-poly1305", "xchacha20-ietf-poly1305",
+		"aes-256-cfb", "rc4-md5",
+	} {
+		if !validEncryptMethod("true", m, &captureLogger{}) {
+			t.Errorf("method %s is not supported", m)
+		}
+	}
+	if validEncryptMethod("true", "unknown-cipher", &captureLogger{}) {
+		t.Error("unknown method is supported")
+	}
+}
+
+func TestDeprecatedEncryptMethod(t *testing.T) {
+	tests := map[string]bool{
+		"rc4-md5":                true,
+		"table":                  true,
+		"des-cfb":                true,
+		"aes-256-cfb":            false,
+		"aes-256-gcm":            false,
+		"chacha20-ietf-poly1305": false,
+		"unknown-cipher":         false,
+	}
+	for m, want := range tests {
+		if got := DeprecatedEncryptMethod(m); got != want {
+			t.Errorf("DeprecatedEncryptMethod(%q) = %v, want %v", m, got, want)
+		}
+	}
+}
+
+func TestPluginArgs(t *testing.T) {
+	tests := []struct {
+		plugin, opts string
+		args         []string
+		ok           bool
+	}{
+		{"", "", []string{}, true},
+		{"obfs-server", "", []string{"--plugin", "obfs-server"}, true},
+		{"v2ray-plugin", "server;tls", []string{"--plugin", "v2ray-plugin", "--plugin-opts", "server;tls"}, true},
+		{"", "obfs=http", nil, false},
+	}
+	bin := fakeBinary(t, "    --plugin <name>            Enable SIP003 plugin.\n    --plugin-opts <options>    Set SIP003 plugin options.")
+	for _, tt := range tests {
+		s := (&Server{}).WithPlugin(tt.plugin, tt.opts)
+		err := s.opts.validate(bin)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("plugin %q with opts %q: validated without error", tt.plugin, tt.opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("plugin %q with opts %q: %s", tt.plugin, tt.opts, err)
+		}
+		if args := s.opts.args(); !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("plugin %q with opts %q: got args %q, want %q", tt.plugin, tt.opts, args, tt.args)
+		}
+	}
+}
+
+func TestPluginNotSupported(t *testing.T) {
+	bin := fakeBinary(t, "    -v    Verbose mode.")
+	s := (&Server{}).WithPlugin("obfs-server", "")
+	if err := s.opts.validate(bin); err == nil {
+		t.Error("plugin is validated with a binary not supporting it")
+	}
+}
+
+func TestSupportedMethodsOfBinary(t *testing.T) {
+	bin := fakeBinary(t, "    -m <encrypt_method>        Encrypt method: aes-256-gcm,\n                               chacha20-ietf-poly1305 and rc4-md5.")
+	mgr := newTestManager(t, newFakeSupervisor(), WithBinary(bin))
+
+	var names []string
+	for _, m := range mgr.SupportedMethods() {
+		names = append(names, m.Name)
+	}
+	want := []string{"aes-256-gcm", "chacha20-ietf-poly1305", "rc4-md5"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got methods %v, want %v", names, want)
+	}
+}
+
+func TestUDPRelayArgs(t *testing.T) {
+	tests := []struct {
+		mode UDPRelayMode
+		args []string
+	}{
+		{UDPRelayEnabled, []string{"-u"}},
+		{UDPRelayNone, []string{}},
+		{UDPRelayOnly, []string{"-U"}},
+	}
+	for _, tt := range tests {
+		s := (&Server{}).WithUDPRelayMode(tt.mode)
+		if err := s.opts.validate("true"); err != nil {
+			t.Errorf("udp relay %s: %s", tt.mode, err)
+		}
+		if args := s.opts.args(); !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("udp relay %s: got args %q, want %q", tt.mode, args, tt.args)
+		}
+	}
+
+	if err := (&Server{}).WithUDPRelayMode(UDPRelayMode(3)).opts.validate("true"); err == nil {
+		t.Error("invalid udp relay mode is validated")
+	}
+}
+
+func TestUDPRelayOnlyConflicts(t *testing.T) {
+	tests := map[string]func(s *Server) *Server{
+		"fast open": (*Server).WithTCPFastOpen,
+		"no delay":  (*Server).WithNoDelay,
+		"mptcp":     (*Server).WithMPTCP,
+		"plugin": func(s *Server) *Server {
+			return s.WithPlugin("obfs-server", "")
+		},
+	}
+	for name, with := range tests {
+		s := with((&Server{}).WithUDPRelayMode(UDPRelayOnly))
+		if err := s.opts.validate("true"); err == nil {
+			t.Errorf("%s is validated with udp relay only", name)
+		}
+		// tcp options are fine with udp relay enabled
+		s = with((&Server{}).WithUDPRelay())
+		if err := s.opts.validate(fakeBinary(t, "--no-delay --plugin")); err != nil {
+			t.Errorf("%s with udp relay enabled: %s", name, err)
+		}
+	}
+}
+
+func TestUDPRelayDefault(t *testing.T) {
+	if args := (&Server{}).opts.args(); len(args) != 0 {
+		t.Errorf("got args %q of the default options", args)
+	}
+
+	// configs saved by the prior versions without udp relay
+	for _, conf := range []string{
+		`{"server_port": 8388, "password": "password", "method": "aes-256-cfb"}`,
+		`{"server_port": 8388, "password": "password", "method": "aes-256-cfb", "ssmgr_options": {"fast_open": true}}`,
+	} {
+		filename := path.Join(t.TempDir(), "config.json")
+		if err := ioutil.WriteFile(filename, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{}
+		if err := s.load(filename); err != nil {
+			t.Fatal(err)
+		}
+		if s.opts.UDPRelay != UDPRelayNone {
+			t.Errorf("got udp relay %s loading %s", s.opts.UDPRelay, conf)
+		}
+		for _, arg := range s.opts.args() {
+			if arg == "-u" || arg == "-U" {
+				t.Errorf("got args %q loading %s", s.opts.args(), conf)
+			}
+		}
+	}
+}
+
+func TestUDPRelayModeJSON(t *testing.T) {
+	for _, mode := range []UDPRelayMode{UDPRelayEnabled, UDPRelayNone, UDPRelayOnly} {
+		data, err := json.Marshal(mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got UDPRelayMode
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != mode {
+			t.Errorf("got %s decoding %s, want %s", got, data, mode)
+		}
+	}
+
+	// bools saved by the prior versions
+	for data, want := range map[string]UDPRelayMode{"true": UDPRelayEnabled, "false": UDPRelayNone} {
+		var got UDPRelayMode
+		if err := json.Unmarshal([]byte(data), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %s decoding %s, want %s", got, data, want)
+		}
+	}
+
+	var mode UDPRelayMode
+	if err := json.Unmarshal([]byte(`"both"`), &mode); err == nil {
+		t.Error("unknown mode is decoded")
+	}
+}
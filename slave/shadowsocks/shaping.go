@@ -0,0 +1,120 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var errShapingNotSupported = errors.New("traffic shaping not supported")
+
+// runCommand runs the command and returns its combined output.
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// tc runs tc with the args.
+func tc(args ...string) error {
+	out, err := runCommand("tc", args...)
+	if err != nil {
+		return fmt.Errorf("tc %s: %s, %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// shapingRoots is the set of interfaces whose htb root qdisc is created by the servers,
+// they're torn down on `CleanUp`. Root qdiscs configured by others are never touched.
+var shapingRoots = struct {
+	sync.Mutex
+	devs map[string]bool
+}{devs: make(map[string]bool)}
+
+// ensureShapingRoot creates the htb root qdisc of dev shared by all servers if it's
+// missing. A root qdisc other than the kernel default makes it fail instead of being
+// replaced.
+func ensureShapingRoot(dev string) error {
+	shapingRoots.Lock()
+	defer shapingRoots.Unlock()
+
+	out, err := runCommand("tc", "qdisc", "show", "dev", dev, "root")
+	if err != nil {
+		return fmt.Errorf("tc qdisc show dev %s root: %s, %s", dev, err, strings.TrimSpace(string(out)))
+	}
+	if strings.Contains(string(out), "qdisc htb 1: ") {
+		return nil
+	}
+	if err := tc("qdisc", "add", "dev", dev, "root", "handle", "1:", "htb"); err != nil {
+		return err
+	}
+	shapingRoots.devs[dev] = true
+	return nil
+}
+
+// deleteShapingRoots removes the htb root qdiscs created by `ensureShapingRoot`.
+func deleteShapingRoots() []error {
+	shapingRoots.Lock()
+	defer shapingRoots.Unlock()
+
+	var errs []error
+	for dev := range shapingRoots.devs {
+		if err := tc("qdisc", "del", "dev", dev, "root", "handle", "1:"); err != nil {
+			errs = append(errs, err)
+		}
+		delete(shapingRoots.devs, dev)
+	}
+	return errs
+}
+
+// shapingSupported checks if the bandwidth of server can be limited, which requires root
+// on linux and the interface of server.
+func (s *Server) shapingSupported() bool {
+	return runtime.GOOS == "linux" && os.Geteuid() == 0 && len(s.opts.Interface) != 0
+}
+
+// shapingClass returns the class id of the server under the htb qdisc, which is keyed on
+// the port.
+func (s *Server) shapingClass() string {
+	return fmt.Sprintf("1:%x", s.Port)
+}
+
+// createShaping limits the outgoing traffic from the port of server to BandwidthLimit
+// bytes per second. The htb root qdisc of the interface is shared by all servers, and
+// each server has a class and a filter with the port as priority.
+func (s *Server) createShaping() error {
+	if !s.shapingSupported() {
+		return errShapingNotSupported
+	}
+
+	dev := s.opts.Interface
+	if err := ensureShapingRoot(dev); err != nil {
+		return err
+	}
+	rate := fmt.Sprintf("%dbit", s.BandwidthLimit*8)
+	if err := tc("class", "replace", "dev", dev, "parent", "1:", "classid", s.shapingClass(),
+		"htb", "rate", rate, "ceil", rate); err != nil {
+		return err
+	}
+	s.deleteShapingFilter()
+	return tc("filter", "add", "dev", dev, "parent", "1:", "protocol", "ip", "prio", fmt.Sprint(s.Port),
+		"u32", "match", "ip", "sport", fmt.Sprint(s.Port), "0xffff", "flowid", s.shapingClass())
+}
+
+func (s *Server) deleteShapingFilter() error {
+	return tc("filter", "del", "dev", s.opts.Interface, "parent", "1:", "prio", fmt.Sprint(s.Port))
+}
+
+// deleteShaping removes the filter and class of server.
+func (s *Server) deleteShaping() error {
+	if !s.shapingSupported() {
+		return errShapingNotSupported
+	}
+
+	if err := s.deleteShapingFilter(); err != nil {
+		s.log().Debug(err)
+	}
+	return tc("class", "del", "dev", s.opts.Interface, "classid", s.shapingClass())
+}
@@ -0,0 +1,125 @@
+package shadowsocks
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTC records the tc commands and answers `qdisc show` with root.
+type fakeTC struct {
+	mu   sync.Mutex
+	root string
+	cmds []string
+}
+
+func (f *fakeTC) run(name string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cmd := name + " " + strings.Join(args, " ")
+	f.cmds = append(f.cmds, cmd)
+	switch {
+	case strings.HasPrefix(cmd, "tc qdisc show"):
+		return []byte(f.root), nil
+	case strings.HasPrefix(cmd, "tc qdisc add"):
+		if !strings.Contains(f.root, " 0: ") {
+			return []byte("Error: Exclusivity flag on, cannot modify."), errors.New("exit status 2")
+		}
+		f.root = "qdisc htb 1: root refcnt 2 r2q 10 default 0\n"
+	case strings.HasPrefix(cmd, "tc qdisc del"):
+		f.root = "qdisc noqueue 0: root refcnt 2\n"
+	}
+	return nil, nil
+}
+
+func (f *fakeTC) count(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, cmd := range f.cmds {
+		if strings.HasPrefix(cmd, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func withFakeTC(t *testing.T, root string) *fakeTC {
+	f := &fakeTC{root: root}
+	orig := runCommand
+	runCommand = f.run
+	t.Cleanup(func() {
+		runCommand = orig
+		shapingRoots.Lock()
+		shapingRoots.devs = make(map[string]bool)
+		shapingRoots.Unlock()
+	})
+	return f
+}
+
+func TestShapingRootCreatedOnce(t *testing.T) {
+	f := withFakeTC(t, "qdisc noqueue 0: root refcnt 2\n")
+
+	for i := 0; i < 3; i++ {
+		if err := ensureShapingRoot("eth0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.count("tc qdisc add dev eth0 root handle 1: htb"); n != 1 {
+		t.Errorf("root qdisc is added %d times, want once", n)
+	}
+	if n := f.count("tc qdisc replace"); n != 0 {
+		t.Errorf("root qdisc is replaced %d times", n)
+	}
+}
+
+func TestShapingRootNotReplaced(t *testing.T) {
+	f := withFakeTC(t, "qdisc cake 8001: root refcnt 2 bandwidth 100Mbit\n")
+
+	if err := ensureShapingRoot("eth0"); err == nil {
+		t.Error("shaping is set up over a configured root qdisc")
+	}
+	if n := f.count("tc qdisc replace"); n != 0 {
+		t.Errorf("root qdisc is replaced %d times", n)
+	}
+	if errs := deleteShapingRoots(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if n := f.count("tc qdisc del"); n != 0 {
+		t.Error("root qdisc not created by servers is deleted")
+	}
+}
+
+func TestShapingRootExisting(t *testing.T) {
+	f := withFakeTC(t, "qdisc htb 1: root refcnt 2 r2q 10 default 0\n")
+
+	if err := ensureShapingRoot("eth0"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("tc qdisc add"); n != 0 {
+		t.Errorf("existing root qdisc is added again")
+	}
+}
+
+func TestCleanUpDeletesShapingRoots(t *testing.T) {
+	f := withFakeTC(t, "qdisc noqueue 0: root refcnt 2\n")
+	mgr := newTestManager(t, newFakeSupervisor())
+
+	if err := ensureShapingRoot("eth0"); err != nil {
+		t.Fatal(err)
+	}
+	mgr.CleanUp()
+	if n := f.count("tc qdisc del dev eth0 root handle 1:"); n != 1 {
+		t.Errorf("root qdisc is deleted %d times on clean up, want once", n)
+	}
+
+	// and it's created again for new servers
+	if err := ensureShapingRoot("eth0"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("tc qdisc add"); n != 2 {
+		t.Errorf("root qdisc is added %d times, want twice", n)
+	}
+}
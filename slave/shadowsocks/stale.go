@@ -0,0 +1,84 @@
+package shadowsocks
+
+import (
+	"context"
+	"time"
+)
+
+// lastStatAt returns the time the last stat of server is received, or the start time if
+// it sends none since (re)started.
+func (s *Server) lastStatAt() time.Time {
+	at := s.GetStat().UpdatedAt
+	if extra := s.Extra; extra != nil && extra.StartTime.After(at) {
+		return extra.StartTime
+	}
+	return at
+}
+
+// watchStale checks the servers every half of the stale threshold until ctx is done.
+func (mgr *manager) watchStale(ctx context.Context) {
+	ticker := time.NewTicker(mgr.staleAfter / 2)
+	defer ticker.Stop()
+
+	// last stat time of the servers already reported, to report each staleness once
+	reported := make(map[int32]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mgr.checkStale(reported)
+		}
+	}
+}
+
+func (mgr *manager) checkStale(reported map[int32]time.Time) {
+	now := mgr.clock.Now()
+	servers := mgr.ListServers()
+	for port := range reported {
+		if _, ok := servers[port]; !ok {
+			delete(reported, port)
+		}
+	}
+
+	for port, s := range servers {
+		last := s.lastStatAt()
+		if last.IsZero() || now.Sub(last) < mgr.staleAfter || !s.Alive() {
+			continue
+		}
+		if at, ok := reported[port]; ok && at.Equal(last) {
+			continue
+		}
+		reported[port] = last
+
+		mgr.logger.Warnf("Server(%d) sends no stats since %s, it may be wedged", port, last)
+
+		e := Event{
+			Type:      EventStale,
+			Port:      port,
+			UserID:    s.UserID,
+			Namespace: s.Namespace,
+			At:        now,
+		}
+		if mgr.staleRestart {
+			if err := mgr.restart(port); err != nil {
+				mgr.logger.Warnf("Can not restart stale server(%d), %s", port, err)
+				e.Err = err
+			} else {
+				delete(reported, port)
+			}
+		}
+		mgr.events.publish(e)
+	}
+}
+
+// restart restarts the managed server on port.
+func (mgr *manager) restart(port int32) error {
+	mgr.serverMu.RLock()
+	s, ok := mgr.servers[port]
+	mgr.serverMu.RUnlock()
+	if !ok {
+		return ErrServerNotFound
+	}
+	return s.Restart()
+}
@@ -0,0 +1,143 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// statPrefix is the prefix of stat packets, e.g. `stat: {"8001":11370}`, or with the
+// traffic split by direction, e.g. `stat: {"8001":{"rx":1370,"tx":10000}}`.
+const statPrefix = "stat:"
+
+const (
+	// minStatPacketSize is the size of the shortest stat packet possible, e.g. `stat:{}`.
+	minStatPacketSize = len(statPrefix) + len("{}")
+	// maxStatPacketSize is the max size of a stat packet, ss-server reports one port per
+	// packet so a larger one is malformed.
+	maxStatPacketSize = 1024
+)
+
+// parseTraffic parses the combined traffic, or the split one if it's an object.
+func parseTraffic(data json.RawMessage) (Stat, error) {
+	var stat Stat
+	if err := json.Unmarshal(data, &stat.Traffic); err == nil {
+		return stat, nil
+	}
+
+	var split struct {
+		Rx *int64 `json:"rx"`
+		Tx *int64 `json:"tx"`
+	}
+	if err := json.Unmarshal(data, &split); err != nil {
+		return stat, err
+	}
+	if split.Rx == nil || split.Tx == nil {
+		return stat, errors.New("incomplete traffic")
+	}
+	stat.Rx, stat.Tx = *split.Rx, *split.Tx
+	stat.Traffic = stat.Rx + stat.Tx
+	return stat, nil
+}
+
+// ParseStatPacket parses the port and traffic from a stat packet sent by ss-server, the
+// packet must be trimmed. Rx and Tx are set only if the traffic is split in packet.
+func ParseStatPacket(data []byte) (int32, Stat, error) {
+	if len(data) < minStatPacketSize {
+		return 0, Stat{}, errors.New("packet too short")
+	}
+	if len(data) > maxStatPacketSize {
+		return 0, Stat{}, errors.New("packet too large")
+	}
+	if !bytes.HasPrefix(data, []byte(statPrefix)) {
+		return 0, Stat{}, errors.New("unrecognized command")
+	}
+
+	var stats map[string]json.RawMessage
+	body := bytes.TrimSpace(data[len(statPrefix):])
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return 0, Stat{}, err
+	}
+
+	for portS, traffic := range stats {
+		port, err := strconv.Atoi(portS)
+		if err != nil || !validPort(int32(port)) {
+			return 0, Stat{}, fmt.Errorf("invalid port %q", portS)
+		}
+		stat, err := parseTraffic(traffic)
+		if err != nil {
+			return 0, Stat{}, fmt.Errorf("invalid traffic %s", traffic)
+		}
+		if stat.Traffic < 0 || stat.Rx < 0 || stat.Tx < 0 {
+			return 0, Stat{}, fmt.Errorf("invalid traffic %s", traffic)
+		}
+		return int32(port), stat, nil
+	}
+	return 0, Stat{}, errors.New("empty stat")
+}
+
+// splitStat splits the tcp stream into stats framed by '\n' or '\0'.
+func splitStat(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\n\x00"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// listenTCP listens on {listenAddr}:{udpPort} over tcp and handles the stats framed by
+// '\n' or '\0'.
+func (mgr *manager) listenTCP(ctx context.Context) error {
+	l, err := net.Listen(mgr.statNetwork("tcp"), mgr.managerAddress())
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					mgr.logger.Warnf("Stop receiving stats over tcp, %s", err)
+				}
+				return
+			}
+			go mgr.handleStatConn(conn)
+		}
+	}()
+
+	mgr.logger.Debugf("Listening on tcp %s", mgr.managerAddress())
+	return nil
+}
+
+func (mgr *manager) handleStatConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(splitStat)
+	// a stat larger than the buffer fails the scan and closes the connection
+	scanner.Buffer(make([]byte, 0, maxStatPacketSize), maxStatPacketSize)
+	for scanner.Scan() {
+		data := trimPacket(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		mgr.logger.Debugf("Receving packet from %s: %s", conn.RemoteAddr(), data)
+
+		mgr.safeHandleStat(data)
+	}
+	if err := scanner.Err(); err != nil {
+		mgr.logger.Warnf("Stop receiving stats from %s, %s", conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,82 @@
+package shadowsocks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStatPacket(t *testing.T) {
+	tests := []struct {
+		packet string
+		port   int32
+		stat   Stat
+	}{
+		{`stat: {"8001":11370}`, 8001, Stat{Traffic: 11370}},
+		{`stat: {"8001":{"rx":1370,"tx":10000}}`, 8001, Stat{Traffic: 11370, Rx: 1370, Tx: 10000}},
+		{`stat:{"8002":0}`, 8002, Stat{}},
+	}
+	for _, tt := range tests {
+		port, stat, err := ParseStatPacket([]byte(tt.packet))
+		if err != nil {
+			t.Errorf("%s: %s", tt.packet, err)
+			continue
+		}
+		if port != tt.port || stat != tt.stat {
+			t.Errorf("%s: got %d %+v, want %d %+v", tt.packet, port, stat, tt.port, tt.stat)
+		}
+	}
+}
+
+func TestParseStatPacketInvalid(t *testing.T) {
+	for _, packet := range []string{
+		`stat: {"8001":{"rx":1370}}`,
+		`stat: {"8001":{"rx":-1,"tx":10}}`,
+		`stat: {"8001":-1}`,
+		`stat: {"0":1}`,
+		`stat: {}`,
+		`ping`,
+	} {
+		if _, _, err := ParseStatPacket([]byte(packet)); err == nil {
+			t.Errorf("%s: parsed without error", packet)
+		}
+	}
+}
+
+func TestHandleStatSplit(t *testing.T) {
+	mgr := newTestManager(t, newFakeSupervisor())
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+
+	mgr.handleStat([]byte(`stat: {"20001":{"rx":30,"tx":70}}`))
+	stat := mgr.servers[20001].GetStat()
+	if stat.Traffic != 100 || stat.Rx != 30 || stat.Tx != 70 {
+		t.Errorf("got %+v after split stat, want traffic 100, rx 30 and tx 70", stat)
+	}
+
+	mgr.handleStat([]byte(`stat: {"20001":150}`))
+	stat = mgr.servers[20001].GetStat()
+	if stat.Traffic != 150 || stat.Rx != 0 || stat.Tx != 0 {
+		t.Errorf("got %+v after combined stat, want traffic 150 only", stat)
+	}
+}
+
+func TestHandleStatMalformed(t *testing.T) {
+	mgr := newTestManager(t, newFakeSupervisor())
+	if err := mgr.Add(testServer(20001)); err != nil {
+		t.Fatal(err)
+	}
+
+	oversized := `stat: {"20001":1` + strings.Repeat("0", maxStatPacketSize) + `}`
+	for _, packet := range []string{"sta", "", oversized} {
+		mgr.handleStat([]byte(packet))
+		if stat := mgr.servers[20001].GetStat(); !stat.UpdatedAt.IsZero() {
+			t.Errorf("%.16q: got %+v, want it dropped", packet, stat)
+		}
+	}
+
+	mgr.handleStat([]byte(`stat: {"20001":100}`))
+	if stat := mgr.servers[20001].GetStat(); stat.Traffic != 100 || stat.UpdatedAt.IsZero() {
+		t.Errorf("got %+v after valid stat, want traffic 100", stat)
+	}
+}
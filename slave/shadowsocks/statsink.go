@@ -0,0 +1,63 @@
+package shadowsocks
+
+import "sync"
+
+// StatSink receives the stats of servers, e.g. to forward them to external systems.
+// Record is called in the stat handling loop after the manager updates its own state,
+// so it should return quickly.
+type StatSink interface {
+	Record(port int32, stat Stat)
+}
+
+// StatSinkFunc adapts a function to `StatSink`.
+type StatSinkFunc func(port int32, stat Stat)
+
+// Record calls f(port, stat).
+func (f StatSinkFunc) Record(port int32, stat Stat) {
+	f(port, stat)
+}
+
+// NoopStatSink drops all stats.
+var NoopStatSink StatSink = StatSinkFunc(func(int32, Stat) {})
+
+// MemoryStatSink keeps the latest stat of each port in memory.
+type MemoryStatSink struct {
+	mu    sync.RWMutex
+	stats map[int32]Stat
+}
+
+// NewMemoryStatSink returns an empty `MemoryStatSink`.
+func NewMemoryStatSink() *MemoryStatSink {
+	return &MemoryStatSink{
+		stats: make(map[int32]Stat),
+	}
+}
+
+// Record implements the `StatSink` interface.
+func (m *MemoryStatSink) Record(port int32, stat Stat) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats[port] = stat
+}
+
+// Get returns the latest stat of the port.
+func (m *MemoryStatSink) Get(port int32) (Stat, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stat, ok := m.stats[port]
+	return stat, ok
+}
+
+// Stats returns a copy of the latest stats of all ports.
+func (m *MemoryStatSink) Stats() map[int32]Stat {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := make(map[int32]Stat, len(m.stats))
+	for port, stat := range m.stats {
+		stats[port] = stat
+	}
+	return stats
+}
@@ -0,0 +1,280 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	proc "github.com/arkbriar/ssmgr/slave/shadowsocks/process"
+)
+
+// Handle identifies a ss-server run by a `Supervisor`.
+type Handle interface {
+	// Pid returns the pid of the local process, or -1 if it's not one.
+	Pid() int
+}
+
+// Supervisor runs the ss-server processes, e.g. as forked processes, systemd units or
+// container sidecars.
+type Supervisor interface {
+	// Start starts the ss-server of the server, whose config file is saved in its run path.
+	Start(s *Server) (Handle, error)
+	// Stop stops the ss-server and waits for it to exit.
+	Stop(h Handle) error
+	// Alive returns if the ss-server is still running.
+	Alive(h Handle) bool
+	// Recover finds the ss-server started before from its run path.
+	Recover(runPath string) (Handle, error)
+}
+
+// ExecSupervisor runs ss-servers as processes forked by the slave, it's the default
+// supervisor.
+type ExecSupervisor struct {
+	// StopTimeout is how long a process is given to exit after SIGTERM before it's
+	// killed, defaultStopTimeout if 0.
+	StopTimeout time.Duration
+}
+
+// defaultStopTimeout is the default time given to ss-server to exit on SIGTERM, so it
+// reports the final stats and closes the connections.
+const defaultStopTimeout = 5 * time.Second
+
+// stopCheckInterval is the interval of checking whether a stopping process exited.
+const stopCheckInterval = 100 * time.Millisecond
+
+type execHandle struct {
+	proc *os.Process
+	// exited is closed when the process forked by the slave exits, it's nil for the
+	// daemonized or recovered processes, which are not children of the slave.
+	exited chan struct{}
+}
+
+func (h *execHandle) Pid() int {
+	return h.proc.Pid
+}
+
+// earlyExitWindow is how long a started ss-server is watched by default, an exit within
+// it is reported as a start failure.
+const earlyExitWindow = 500 * time.Millisecond
+
+// startGraceWindow returns how long the started ss-server is watched.
+func (s *Server) startGraceWindow() time.Duration {
+	if s.startGrace > 0 {
+		return s.startGrace
+	}
+	return earlyExitWindow
+}
+
+// logTailSize is the max bytes read from the tail of ss_server.log to explain an exit.
+const logTailSize = 2048
+
+// Start implements the `Supervisor` interface.
+func (sup ExecSupervisor) Start(s *Server) (Handle, error) {
+	cmd := s.command()
+
+	// redirect the stdout and stderr to ss_server.log, daemonized ss-server reports the
+	// errors before forking there as well
+	var logFile string
+	if len(s.runPath) != 0 {
+		logFile = path.Join(s.runPath, "ss_server.log")
+		logw, err := os.Create(logFile)
+		if err != nil {
+			s.log().Warnf("Can not open log file, %s", err)
+		} else {
+			defer logw.Close()
+			cmd.Stdout, cmd.Stderr = logw, logw
+		}
+	}
+
+	var h *execHandle
+	if len(s.opts.PidFile) != 0 {
+		// ss-server will fork and exit when pidfile is specified, so run it
+		if err := cmd.Run(); err != nil {
+			return nil, earlyExitError(err, logFile)
+		}
+		// the pidfile may be written after ss-server exits
+		var p *os.Process
+		err := s.pidRetry.do(func() (err error) {
+			p, err = findProcFromPidFile(s.opts.PidFile)
+			return
+		})
+		if err != nil {
+			s.log().Warn(err)
+			return nil, earlyExitError(errors.New("can not get process from pid file"), logFile)
+		}
+		h = &execHandle{proc: p}
+	} else {
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		h = &execHandle{proc: cmd.Process, exited: make(chan struct{})}
+		go func() {
+			cmd.Wait()
+			close(h.exited)
+		}()
+	}
+
+	// watch the process for a while, ss-server exits soon on a bad cipher, an unsupported
+	// flag or a bind failure
+	if h.exited != nil {
+		select {
+		case <-h.exited:
+			return nil, earlyExitError(errors.New("exited"), logFile)
+		case <-time.After(s.startGraceWindow()):
+		}
+	} else {
+		time.Sleep(s.startGraceWindow())
+		if !sup.Alive(h) {
+			return nil, earlyExitError(errors.New("exited"), logFile)
+		}
+	}
+	return h, nil
+}
+
+// earlyExitError explains the exit of ss-server with the tail of its log.
+func earlyExitError(err error, logFile string) error {
+	if len(logFile) == 0 {
+		return fmt.Errorf("ss-server %s", err)
+	}
+	cause := likelyCause(readTail(logFile, logTailSize))
+	if len(cause) == 0 {
+		return fmt.Errorf("ss-server %s", err)
+	}
+	return fmt.Errorf("ss-server %s: %s", err, cause)
+}
+
+// readTail reads at most n bytes from the end of file.
+func readTail(filename string, n int64) string {
+	f, err := os.Open(filename)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil && fi.Size() > n {
+		f.Seek(-n, io.SeekEnd)
+	}
+	data, _ := ioutil.ReadAll(f)
+	return string(data)
+}
+
+// likelyCause picks the last error line in the log, or the last line if there's none.
+func likelyCause(tail string) string {
+	lines := strings.Split(strings.TrimSpace(tail), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.Contains(lines[i], "ERROR") {
+			return strings.TrimSpace(lines[i])
+		}
+	}
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// Stop implements the `Supervisor` interface.
+func (sup ExecSupervisor) Stop(h Handle) error {
+	eh := h.(*execHandle)
+
+	timeout := sup.StopTimeout
+	if timeout <= 0 {
+		timeout = defaultStopTimeout
+	}
+	if err := proc.Terminate(eh.proc); err == nil && eh.waitExit(timeout) {
+		return nil
+	}
+
+	err := eh.proc.Kill()
+	if eh.exited != nil {
+		<-eh.exited
+	} else {
+		eh.proc.Wait()
+	}
+	return err
+}
+
+// waitExit waits at most timeout for the process to exit and returns if it exited.
+func (h *execHandle) waitExit(timeout time.Duration) bool {
+	if h.exited != nil {
+		select {
+		case <-h.exited:
+			return true
+		case <-time.After(timeout):
+			return false
+		}
+	}
+
+	// not a child of the slave, poll it
+	deadline := time.Now().Add(timeout)
+	for proc.Alive(h.proc.Pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(stopCheckInterval)
+	}
+	return true
+}
+
+// Alive implements the `Supervisor` interface.
+func (ExecSupervisor) Alive(h Handle) bool {
+	eh, ok := h.(*execHandle)
+	if !ok || eh.proc == nil {
+		return false
+	}
+	if eh.exited != nil {
+		select {
+		case <-eh.exited:
+			return false
+		default:
+			return true
+		}
+	}
+	return proc.Alive(eh.proc.Pid)
+}
+
+// Recover implements the `Supervisor` interface.
+func (ExecSupervisor) Recover(runPath string) (Handle, error) {
+	if err := trustPidFile(runPath); err != nil {
+		return nil, err
+	}
+	p, err := findProcFromPidFile(path.Join(runPath, "ss_server.pid"))
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyServerProc(p.Pid, runPath); err != nil {
+		return nil, err
+	}
+	return &execHandle{proc: p}, nil
+}
+
+var (
+	errProcNotAlive = errors.New("process is not alive")
+	// errPidReused is returned when the pid in pidfile belongs to another process now.
+	errPidReused = errors.New("pid is reused by another process")
+)
+
+// verifyServerProc verifies the process is alive and is started with the config file in
+// runPath, so a stale pid reused by an unrelated process isn't adopted. Only the liveness
+// is checked if the command line can't be read.
+func verifyServerProc(pid int, runPath string) error {
+	if !proc.Alive(pid) {
+		return errProcNotAlive
+	}
+	args, err := proc.Cmdline(pid)
+	if err == proc.ErrNotSupported {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	conf := path.Join(runPath, "ss_server.conf")
+	for i := 1; i+1 < len(args); i++ {
+		if args[i] == "-c" && path.Clean(args[i+1]) == path.Clean(conf) {
+			return nil
+		}
+	}
+	return errPidReused
+}
@@ -0,0 +1,107 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// tailPollInterval is the interval of checking a followed log for new lines.
+const tailPollInterval = 250 * time.Millisecond
+
+func (mgr *manager) TailLog(port int32, ctx context.Context) (<-chan string, error) {
+	mgr.serverMu.RLock()
+	s, ok := mgr.servers[port]
+	mgr.serverMu.RUnlock()
+	if !ok {
+		return nil, ErrServerNotFound
+	}
+
+	filename := path.Join(s.runPath, "ss_server.log")
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	// follow from the end like `tail -f`
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		defer func() { f.Close() }()
+
+		var (
+			pending []byte
+			buf     = make([]byte, 4096)
+		)
+		for {
+			n, err := f.Read(buf)
+			if n > 0 {
+				pending = append(pending, buf[:n]...)
+				for {
+					i := bytes.IndexByte(pending, '\n')
+					if i < 0 {
+						break
+					}
+					select {
+					case lines <- string(pending[:i]):
+					case <-ctx.Done():
+						return
+					}
+					pending = pending[i+1:]
+				}
+				continue
+			}
+			if err != nil && err != io.EOF {
+				mgr.logger.Warnf("Stop tailing %s, %s", filename, err)
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(tailPollInterval):
+			}
+
+			// reopen the log when it's rotated or truncated, e.g. on restart
+			if reopened := reopenIfRotated(f, filename); reopened != nil {
+				f.Close()
+				f, pending = reopened, nil
+			}
+		}
+	}()
+	return lines, nil
+}
+
+// reopenIfRotated returns the file newly created at filename, or nil if f is still the
+// file there and is not truncated.
+func reopenIfRotated(f *os.File, filename string) *os.File {
+	cur, err := os.Stat(filename)
+	if err != nil {
+		// rotated but not recreated yet
+		return nil
+	}
+	old, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	if os.SameFile(old, cur) && cur.Size() >= offset {
+		return nil
+	}
+
+	reopened, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	return reopened
+}
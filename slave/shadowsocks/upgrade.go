@@ -0,0 +1,88 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// upgradeStagger is the delay between starting two restarts in `UpgradeAll`.
+const upgradeStagger = time.Second
+
+func (mgr *manager) UpgradeAll(drainTimeout time.Duration) error {
+	servers := mgr.ListServers()
+	ports := make([]int, 0, len(servers))
+	for port := range servers {
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+
+	concurrency := mgr.upgradeConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var (
+		mu     sync.Mutex
+		done   int
+		failed []int
+		wg     sync.WaitGroup
+	)
+	for i, p := range ports {
+		if i > 0 {
+			time.Sleep(upgradeStagger)
+		}
+		sem <- struct{}{}
+
+		wg.Add(1)
+		go func(port int32) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := mgr.upgrade(port, drainTimeout)
+
+			mu.Lock()
+			done++
+			if err != nil {
+				failed = append(failed, int(port))
+			}
+			e := Event{
+				Type:  EventUpgraded,
+				Port:  port,
+				At:    mgr.clock.Now(),
+				Done:  done,
+				Total: len(ports),
+				Err:   err,
+			}
+			mu.Unlock()
+
+			if err != nil {
+				mgr.logger.Warnf("Can not upgrade server(%d), %s", port, err)
+			} else {
+				mgr.logger.Infof("Server(%d) upgraded (%d/%d)", port, e.Done, e.Total)
+			}
+			mgr.events.publish(e)
+		}(int32(p))
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Ints(failed)
+		return fmt.Errorf("failed to upgrade servers %v", failed)
+	}
+	return nil
+}
+
+// upgrade restarts the server of given port, it's skipped if the server has been
+// removed during upgrading.
+func (mgr *manager) upgrade(port int32, drainTimeout time.Duration) error {
+	mgr.serverMu.RLock()
+	s, ok := mgr.servers[port]
+	mgr.serverMu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return s.RestartWithDrain(drainTimeout)
+}
@@ -0,0 +1,79 @@
+package shadowsocks
+
+import (
+	"context"
+	"time"
+)
+
+// usageInterval is the interval of sampling the resource usage of servers.
+const usageInterval = watchInterval
+
+// resourceUsage is a sample of the resource usage of a server process.
+type resourceUsage struct {
+	pid        int
+	at         time.Time
+	cpuTime    float64 // total cpu time in seconds
+	cpuPercent float64 // cpu usage since the previous sample
+	rssBytes   int64
+}
+
+// ResourceUsage returns the cpu usage in percent of one core and the resident memory
+// in bytes of the server process, sampled periodically by manager. Both are 0 before
+// the first sample or on non-linux system.
+func (s *Server) ResourceUsage() (cpuPercent float64, rssBytes int64) {
+	u, ok := s.usage.Load().(resourceUsage)
+	if !ok {
+		return 0, 0
+	}
+	return u.cpuPercent, u.rssBytes
+}
+
+// sampleUsage samples the resource usage of the server process.
+func (s *Server) sampleUsage(now time.Time) error {
+	pid := s.trackedPid()
+	if pid <= 0 {
+		s.usage.Store(resourceUsage{})
+		return nil
+	}
+	cpuTime, rss, err := readProcUsage(pid)
+	if err != nil {
+		return err
+	}
+
+	u := resourceUsage{pid: pid, at: now, cpuTime: cpuTime, rssBytes: rss}
+	// the cpu usage is unknown until there are two samples of the same process
+	if prev, ok := s.usage.Load().(resourceUsage); ok && prev.pid == pid {
+		if elapsed := now.Sub(prev.at).Seconds(); elapsed > 0 {
+			u.cpuPercent = (cpuTime - prev.cpuTime) / elapsed * 100
+		}
+	}
+	s.usage.Store(u)
+	return nil
+}
+
+// watchUsage samples the resource usage of servers every usageInterval until ctx is done.
+func (mgr *manager) watchUsage(ctx context.Context) {
+	ticker := time.NewTicker(usageInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mgr.serverMu.RLock()
+			servers := make([]*Server, 0, len(mgr.servers))
+			for _, s := range mgr.servers {
+				servers = append(servers, s)
+			}
+			mgr.serverMu.RUnlock()
+
+			now := mgr.clock.Now()
+			for _, s := range servers {
+				if err := s.sampleUsage(now); err != nil {
+					mgr.logger.Debugf("Can not sample resource usage of server(%d), %s", s.Port, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// +build linux
+
+package shadowsocks
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// usageSupported is true if the resource usage of processes can be read.
+const usageSupported = true
+
+// clockTicks is the USER_HZ of /proc/<pid>/stat, which is 100 on almost all systems.
+const clockTicks = 100
+
+// readCPUTime reads the user and system cpu time of process in seconds from
+// /proc/<pid>/stat.
+func readCPUTime(pid int) (float64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// the command name may contain spaces, so fields are counted after the last ')'
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, errors.New("malformed stat")
+	}
+	// fields after ')' start from the 3rd one (state), utime and stime are 14th and 15th
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 13 {
+		return 0, errors.New("malformed stat")
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return float64(utime+stime) / clockTicks, nil
+}
+
+// readRSS reads the resident set size of process in bytes from /proc/<pid>/status.
+func readRSS(pid int) (int64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// formatted as "VmRSS:	    1234 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "VmRSS:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	// kernel threads and zombies have no VmRSS
+	return 0, nil
+}
+
+// readProcUsage reads the cpu time in seconds and rss in bytes of process.
+func readProcUsage(pid int) (float64, int64, error) {
+	cpu, err := readCPUTime(pid)
+	if err != nil {
+		return 0, 0, err
+	}
+	rss, err := readRSS(pid)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cpu, rss, nil
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package shadowsocks
+
+import "errors"
+
+// usageSupported is true if the resource usage of processes can be read.
+const usageSupported = false
+
+// readProcUsage is not supported on non-linux system.
+func readProcUsage(pid int) (float64, int64, error) {
+	return 0, 0, errors.New("reading resource usage is not supported")
+}